@@ -4,8 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
 
 	"github.com/yusuf-musleh/mmar/constants"
+	"github.com/yusuf-musleh/mmar/internal/admin"
 	"github.com/yusuf-musleh/mmar/internal/client"
 	"github.com/yusuf-musleh/mmar/internal/server"
 	"github.com/yusuf-musleh/mmar/internal/utils"
@@ -28,6 +30,91 @@ func main() {
 		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_API_KEYS_FILE, "api-keys.json"),
 		constants.SERVER_API_KEYS_FILE_HELP,
 	)
+	serverTcpTunnelPorts := serverCmd.String(
+		"tcp-tunnel-ports",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_TCP_TUNNEL_PORTS, ""),
+		constants.SERVER_TCP_TUNNEL_PORTS_HELP,
+	)
+	serverUdpTunnelPorts := serverCmd.String(
+		"udp-tunnel-ports",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_UDP_TUNNEL_PORTS, ""),
+		constants.SERVER_UDP_TUNNEL_PORTS_HELP,
+	)
+	serverReclaimGracePeriod := serverCmd.String(
+		"reclaim-grace-period",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_RECLAIM_GRACE, strconv.Itoa(constants.RECLAIM_GRACE_PERIOD)),
+		constants.SERVER_RECLAIM_GRACE_HELP,
+	)
+	serverMaxTunnelsPerIP := serverCmd.String(
+		"max-tunnels-per-ip",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_MAX_TUNNELS_IP, strconv.Itoa(constants.MAX_TUNNELS_PER_IP)),
+		constants.SERVER_MAX_TUNNELS_IP_HELP,
+	)
+	serverMaxRequestBodySize := serverCmd.String(
+		"max-request-body-size",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_SERVER_MAX_BODY, strconv.Itoa(constants.MAX_REQ_BODY_SIZE)),
+		constants.SERVER_MAX_REQ_BODY_HELP,
+	)
+	serverRequestBodyReadTimeout := serverCmd.String(
+		"request-body-read-timeout",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_BODY_READ_TIMEOUT, strconv.Itoa(constants.REQ_BODY_READ_CHUNK_TIMEOUT)),
+		constants.SERVER_BODY_READ_TIMEOUT_HELP,
+	)
+	serverDestRequestTimeout := serverCmd.String(
+		"dest-request-timeout",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_DEST_REQ_TIMEOUT, strconv.Itoa(constants.DEST_REQUEST_TIMEOUT)),
+		constants.SERVER_DEST_REQ_TIMEOUT_HELP,
+	)
+	serverHeartbeatTimeout := serverCmd.String(
+		"heartbeat-timeout",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_HEARTBEAT_TIMEOUT, strconv.Itoa(constants.HEARTBEAT_FROM_SERVER_TIMEOUT)),
+		constants.SERVER_HEARTBEAT_TIMEOUT_HELP,
+	)
+	serverClientHeartbeatTimeout := serverCmd.String(
+		"client-heartbeat-timeout",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_CLIENT_HEARTBEAT, strconv.Itoa(constants.HEARTBEAT_FROM_CLIENT_TIMEOUT)),
+		constants.SERVER_CLIENT_HEARTBEAT_HELP,
+	)
+	serverMaxFrameSize := serverCmd.String(
+		"max-frame-size",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_MAX_FRAME_SIZE, strconv.Itoa(constants.MAX_FRAME_SIZE)),
+		constants.SERVER_MAX_FRAME_SIZE_HELP,
+	)
+	serverMaxUdpSessions := serverCmd.String(
+		"max-udp-sessions",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_MAX_UDP_SESSIONS, strconv.Itoa(constants.MAX_UDP_SESSIONS)),
+		constants.SERVER_MAX_UDP_SESSIONS_HELP,
+	)
+	serverConfigFile := serverCmd.String(
+		"config",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_SERVER_CONFIG, ""),
+		constants.SERVER_CONFIG_FILE_HELP,
+	)
+	serverErrorPagesDir := serverCmd.String(
+		"error-pages-dir",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_ERROR_PAGES_DIR, ""),
+		constants.SERVER_ERROR_PAGES_DIR_HELP,
+	)
+	serverTlsCert := serverCmd.String(
+		"tls-cert",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_TLS_CERT, ""),
+		constants.SERVER_TLS_CERT_HELP,
+	)
+	serverTlsKey := serverCmd.String(
+		"tls-key",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_TLS_KEY, ""),
+		constants.SERVER_TLS_KEY_HELP,
+	)
+	serverTlsClientCa := serverCmd.String(
+		"tls-client-ca",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_TLS_CLIENT_CA, ""),
+		constants.SERVER_TLS_CLIENT_CA_HELP,
+	)
+	serverTlsRequireClientCert := serverCmd.Bool(
+		"tls-require-client-cert",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_TLS_REQ_CLIENT, "") == "true",
+		constants.SERVER_TLS_REQ_CLIENT_HELP,
+	)
 
 	clientCmd := flag.NewFlagSet(constants.CLIENT_CMD, flag.ExitOnError)
 	clientLocalPort := clientCmd.String(
@@ -70,6 +157,72 @@ func main() {
 		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_API_KEY, ""),
 		constants.CLIENT_AUTH_TOKEN_HELP,
 	)
+	clientTunnelType := clientCmd.String(
+		"tunnel-type",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_TUNNEL_TYPE, constants.TUNNEL_TYPE_HTTP),
+		constants.CLIENT_TUNNEL_TYPE_HELP,
+	)
+	clientLabels := clientCmd.String(
+		"labels",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_LABELS, ""),
+		constants.CLIENT_LABELS_HELP,
+	)
+	clientMaxRequestBodySize := clientCmd.String(
+		"max-request-body-size",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_MAX_REQ_BODY, ""),
+		constants.CLIENT_MAX_REQ_BODY_HELP,
+	)
+	clientLocalMaxIdleConns := clientCmd.String(
+		"local-max-idle-conns",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_LOCAL_IDLE_CONNS, strconv.Itoa(constants.LOCAL_MAX_IDLE_CONNS)),
+		constants.CLIENT_IDLE_CONNS_HELP,
+	)
+	clientTls := clientCmd.Bool(
+		"tls",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_TLS, "") == "true",
+		constants.CLIENT_TLS_HELP,
+	)
+	clientTlsCa := clientCmd.String(
+		"tls-ca",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_TLS_CA, ""),
+		constants.CLIENT_TLS_CA_HELP,
+	)
+	clientTlsPin := clientCmd.String(
+		"tls-pin",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_TLS_PIN, ""),
+		constants.CLIENT_TLS_PIN_HELP,
+	)
+	clientTlsCert := clientCmd.String(
+		"tls-client-cert",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_TLS_CLIENT_CERT, ""),
+		constants.CLIENT_TLS_CERT_HELP,
+	)
+	clientTlsKey := clientCmd.String(
+		"tls-client-key",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_TLS_CLIENT_KEY, ""),
+		constants.CLIENT_TLS_KEY_HELP,
+	)
+
+	adminCmd := flag.NewFlagSet(constants.ADMIN_CMD, flag.ExitOnError)
+	adminTunnelHost := adminCmd.String(
+		"tunnel-host",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_TUNNEL_HOST, constants.TUNNEL_HOST),
+		constants.ADMIN_TUNNEL_HOST_HELP,
+	)
+	adminTunnelHttpPort := adminCmd.String(
+		"tunnel-http-port",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_TUNNEL_HTTP_PORT, constants.TUNNEL_HTTP_PORT),
+		constants.ADMIN_HTTP_PORT_HELP,
+	)
+	adminOutput := adminCmd.String(
+		"output",
+		utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_ADMIN_OUTPUT, "table"),
+		constants.ADMIN_OUTPUT_HELP,
+	)
+	adminCmd.Usage = func() {
+		admin.Usage()
+		adminCmd.PrintDefaults()
+	}
 
 	versionCmd := flag.NewFlagSet(constants.VERSION_CMD, flag.ExitOnError)
 	versionCmd.Usage = utils.MmarVersionUsage
@@ -85,24 +238,60 @@ func main() {
 	case constants.SERVER_CMD:
 		serverCmd.Parse(os.Args[2:])
 		mmarServerConfig := server.ConfigOptions{
-			HttpPort:    *serverHttpPort,
-			TcpPort:     *serverTcpPort,
-			ApiKeysFile: *serverApiKeysFile,
+			HttpPort:               *serverHttpPort,
+			TcpPort:                *serverTcpPort,
+			ApiKeysFile:            *serverApiKeysFile,
+			TcpTunnelPorts:         *serverTcpTunnelPorts,
+			UdpTunnelPorts:         *serverUdpTunnelPorts,
+			TlsCertFile:            *serverTlsCert,
+			TlsKeyFile:             *serverTlsKey,
+			TlsClientCaFile:        *serverTlsClientCa,
+			TlsRequireClientCert:   *serverTlsRequireClientCert,
+			ReclaimGracePeriod:     *serverReclaimGracePeriod,
+			ErrorPagesDir:          *serverErrorPagesDir,
+			ConfigFile:             *serverConfigFile,
+			MaxTunnelsPerIP:        *serverMaxTunnelsPerIP,
+			MaxRequestBodySize:     *serverMaxRequestBodySize,
+			RequestBodyReadTimeout: *serverRequestBodyReadTimeout,
+			DestRequestTimeout:     *serverDestRequestTimeout,
+			HeartbeatTimeout:       *serverHeartbeatTimeout,
+			ClientHeartbeatTimeout: *serverClientHeartbeatTimeout,
+			MaxFrameSize:           *serverMaxFrameSize,
+			MaxUdpSessions:         *serverMaxUdpSessions,
 		}
 		server.Run(mmarServerConfig)
 	case constants.CLIENT_CMD:
 		clientCmd.Parse(os.Args[2:])
 		mmarClientConfig := client.ConfigOptions{
-			LocalPort:      *clientLocalPort,
-			TunnelHttpPort: *clientTunnelHttpPort,
-			TunnelTcpPort:  *clientTunnelTcpPort,
-			TunnelHost:     *clientTunnelHost,
-			CustomDns:      *clientCustomDns,
-			CustomCert:     *clientCustomCert,
-			CustomName:     *clientCustomName,
-			APIKey:         *clientAPIKey,
+			LocalPort:          *clientLocalPort,
+			TunnelHttpPort:     *clientTunnelHttpPort,
+			TunnelTcpPort:      *clientTunnelTcpPort,
+			TunnelHost:         *clientTunnelHost,
+			CustomDns:          *clientCustomDns,
+			CustomCert:         *clientCustomCert,
+			CustomName:         *clientCustomName,
+			APIKey:             *clientAPIKey,
+			TunnelType:         *clientTunnelType,
+			Labels:             *clientLabels,
+			MaxRequestBodySize: *clientMaxRequestBodySize,
+			LocalMaxIdleConns:  *clientLocalMaxIdleConns,
+			Tls:                *clientTls,
+			TlsCaFile:          *clientTlsCa,
+			TlsPin:             *clientTlsPin,
+			TlsCertFile:        *clientTlsCert,
+			TlsKeyFile:         *clientTlsKey,
 		}
 		client.Run(mmarClientConfig)
+	case constants.ADMIN_CMD:
+		adminCmd.Parse(os.Args[2:])
+		mmarAdminConfig := admin.ConfigOptions{
+			TunnelHost:     *adminTunnelHost,
+			TunnelHttpPort: *adminTunnelHttpPort,
+			Output:         *adminOutput,
+			Username:       utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_ADMIN_USERNAME, constants.SERVER_STATS_DEFAULT_USERNAME),
+			Password:       utils.EnvVarOrDefault(constants.MMAR_ENV_VAR_ADMIN_PASSWORD, constants.SERVER_STATS_DEFAULT_PASSWORD),
+		}
+		admin.Run(mmarAdminConfig, adminCmd.Args())
 	case constants.VERSION_CMD:
 		versionCmd.Parse(os.Args[2:])
 		fmt.Println("mmar version", constants.MMAR_VERSION)
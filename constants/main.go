@@ -6,29 +6,80 @@ const (
 	VERSION_CMD       = "version"
 	SERVER_CMD        = "server"
 	CLIENT_CMD        = "client"
+	ADMIN_CMD         = "admin"
 	CLIENT_LOCAL_PORT = "8000"
 	SERVER_HTTP_PORT  = "3376"
 	SERVER_TCP_PORT   = "6673"
 	TUNNEL_HOST       = "mmar.dev"
 	TUNNEL_HTTP_PORT  = "443"
 
-	MMAR_ENV_VAR_SERVER_HTTP_PORT = "MMAR__SERVER_HTTP_PORT"
-	MMAR_ENV_VAR_SERVER_TCP_PORT  = "MMAR__SERVER_TCP_PORT"
-	MMAR_ENV_VAR_LOCAL_PORT       = "MMAR__LOCAL_PORT"
-	MMAR_ENV_VAR_TUNNEL_HTTP_PORT = "MMAR__TUNNEL_HTTP_PORT"
-	MMAR_ENV_VAR_TUNNEL_TCP_PORT  = "MMAR__TUNNEL_TCP_PORT"
-	MMAR_ENV_VAR_TUNNEL_HOST      = "MMAR__TUNNEL_HOST"
-	MMAR_ENV_VAR_CUSTOM_DNS       = "MMAR__CUSTOM_DNS"
-	MMAR_ENV_VAR_CUSTOM_CERT      = "MMAR__CUSTOM_CERT"
-	MMAR_ENV_VAR_CUSTOM_NAME      = "MMAR__CUSTOM_NAME"
-	MMAR_ENV_VAR_API_KEY          = "MMAR__API_KEY"
-	MMAR_ENV_VAR_API_KEYS_FILE    = "MMAR__API_KEYS_FILE"
+	TUNNEL_TYPE_HTTP = "http"
+	TUNNEL_TYPE_TCP  = "tcp"
+	TUNNEL_TYPE_UDP  = "udp"
+
+	MMAR_ENV_VAR_SERVER_HTTP_PORT  = "MMAR__SERVER_HTTP_PORT"
+	MMAR_ENV_VAR_SERVER_TCP_PORT   = "MMAR__SERVER_TCP_PORT"
+	MMAR_ENV_VAR_LOCAL_PORT        = "MMAR__LOCAL_PORT"
+	MMAR_ENV_VAR_TUNNEL_HTTP_PORT  = "MMAR__TUNNEL_HTTP_PORT"
+	MMAR_ENV_VAR_TUNNEL_TCP_PORT   = "MMAR__TUNNEL_TCP_PORT"
+	MMAR_ENV_VAR_TUNNEL_HOST       = "MMAR__TUNNEL_HOST"
+	MMAR_ENV_VAR_CUSTOM_DNS        = "MMAR__CUSTOM_DNS"
+	MMAR_ENV_VAR_CUSTOM_CERT       = "MMAR__CUSTOM_CERT"
+	MMAR_ENV_VAR_CUSTOM_NAME       = "MMAR__CUSTOM_NAME"
+	MMAR_ENV_VAR_API_KEY           = "MMAR__API_KEY"
+	MMAR_ENV_VAR_API_KEYS_FILE     = "MMAR__API_KEYS_FILE"
+	MMAR_ENV_VAR_TCP_TUNNEL_PORTS  = "MMAR__TCP_TUNNEL_PORTS"
+	MMAR_ENV_VAR_UDP_TUNNEL_PORTS  = "MMAR__UDP_TUNNEL_PORTS"
+	MMAR_ENV_VAR_TUNNEL_TYPE       = "MMAR__TUNNEL_TYPE"
+	MMAR_ENV_VAR_LABELS            = "MMAR__LABELS"
+	MMAR_ENV_VAR_TLS_CERT          = "MMAR__TLS_CERT"
+	MMAR_ENV_VAR_TLS_KEY           = "MMAR__TLS_KEY"
+	MMAR_ENV_VAR_TLS               = "MMAR__TLS"
+	MMAR_ENV_VAR_TLS_CA            = "MMAR__TLS_CA"
+	MMAR_ENV_VAR_TLS_PIN           = "MMAR__TLS_PIN"
+	MMAR_ENV_VAR_TLS_CLIENT_CA     = "MMAR__TLS_CLIENT_CA"
+	MMAR_ENV_VAR_TLS_REQ_CLIENT    = "MMAR__TLS_REQUIRE_CLIENT_CERT"
+	MMAR_ENV_VAR_TLS_CLIENT_CERT   = "MMAR__TLS_CLIENT_CERT"
+	MMAR_ENV_VAR_TLS_CLIENT_KEY    = "MMAR__TLS_CLIENT_KEY"
+	MMAR_ENV_VAR_RECLAIM_GRACE     = "MMAR__RECLAIM_GRACE_PERIOD"
+	MMAR_ENV_VAR_ERROR_PAGES_DIR   = "MMAR__ERROR_PAGES_DIR"
+	MMAR_ENV_VAR_SERVER_CONFIG     = "MMAR__SERVER_CONFIG_FILE"
+	MMAR_ENV_VAR_MAX_REQ_BODY      = "MMAR__MAX_REQUEST_BODY_SIZE"
+	MMAR_ENV_VAR_LOCAL_IDLE_CONNS  = "MMAR__LOCAL_MAX_IDLE_CONNS"
+	MMAR_ENV_VAR_SERVER_MAX_BODY   = "MMAR__SERVER_MAX_REQUEST_BODY_SIZE"
+	MMAR_ENV_VAR_MAX_TUNNELS_IP    = "MMAR__MAX_TUNNELS_PER_IP"
+	MMAR_ENV_VAR_BODY_READ_TIMEOUT = "MMAR__REQUEST_BODY_READ_TIMEOUT"
+	MMAR_ENV_VAR_DEST_REQ_TIMEOUT  = "MMAR__DEST_REQUEST_TIMEOUT"
+	MMAR_ENV_VAR_HEARTBEAT_TIMEOUT = "MMAR__HEARTBEAT_TIMEOUT"
+	MMAR_ENV_VAR_CLIENT_HEARTBEAT  = "MMAR__CLIENT_HEARTBEAT_TIMEOUT"
+	MMAR_ENV_VAR_MAX_FRAME_SIZE    = "MMAR__MAX_FRAME_SIZE"
+	MMAR_ENV_VAR_MAX_UDP_SESSIONS  = "MMAR__MAX_UDP_SESSIONS"
+	MMAR_ENV_VAR_ADMIN_USERNAME    = "MMAR__ADMIN_USERNAME"
+	MMAR_ENV_VAR_ADMIN_PASSWORD    = "MMAR__ADMIN_PASSWORD"
+	MMAR_ENV_VAR_ADMIN_OUTPUT      = "MMAR__ADMIN_OUTPUT"
 
 	SERVER_STATS_DEFAULT_USERNAME = "admin"
 	SERVER_STATS_DEFAULT_PASSWORD = "admin"
 
-	SERVER_HTTP_PORT_HELP = "Define port where mmar will bind to and run on server for HTTP requests."
-	SERVER_TCP_PORT_HELP  = "Define port where mmar will bind to and run on server for TCP connections."
+	SERVER_HTTP_PORT_HELP         = "Define port where mmar will bind to and run on server for HTTP requests."
+	SERVER_TCP_PORT_HELP          = "Define port where mmar will bind to and run on server for TCP connections."
+	SERVER_TCP_TUNNEL_PORTS_HELP  = "Define range of public ports the mmar server can allocate for TCP tunnels, TCP tunnels are disabled if not provided. (eg: 20000-20100)"
+	SERVER_TLS_CERT_HELP          = "Define path to PEM file containing the TLS certificate (chain) to encrypt connections from mmar clients with, requires --tls-key as well. (eg: /path/to/cert.pem)"
+	SERVER_TLS_KEY_HELP           = "Define path to PEM file containing the private key of the TLS certificate. (eg: /path/to/key.pem)"
+	SERVER_TLS_CLIENT_CA_HELP     = "Define path to PEM file containing CA certificates to verify client certificates against, clients presenting a valid one are authenticated by the identity it maps to in the API keys file. (eg: /path/to/client-ca.pem)"
+	SERVER_TLS_REQ_CLIENT_HELP    = "Require mmar clients to present a client certificate verified against --tls-client-ca, rejecting connections without one."
+	SERVER_RECLAIM_GRACE_HELP     = "Define for how many seconds the subdomain of a disconnected tunnel stays reserved, so only the mmar client that held it can reclaim it. Set to 0 to disable reservations."
+	SERVER_ERROR_PAGES_DIR_HELP   = "Directory of html/template files to render error pages with, each named after the error code it renders (eg: localhost_not_running.html), with default.html used for the rest."
+	SERVER_MAX_TUNNELS_IP_HELP    = "Define the maximum number of tunnels mmar clients can create from the same IP."
+	SERVER_MAX_REQ_BODY_HELP      = "Define the maximum size in bytes of request bodies tunnels accept, mmar clients can only lower it for their tunnels."
+	SERVER_BODY_READ_TIMEOUT_HELP = "Define for how many seconds to wait for each chunk of a request body, before failing the request."
+	SERVER_DEST_REQ_TIMEOUT_HELP  = "Define for how many seconds mmar clients wait for their local server to respond to a request, before failing it."
+	SERVER_HEARTBEAT_TIMEOUT_HELP = "Define for how many seconds without receiving anything from a mmar client, before sending it a heartbeat to check the connection is still alive."
+	SERVER_CLIENT_HEARTBEAT_HELP  = "Define for how many seconds mmar clients wait without receiving anything from the mmar server, before sending it a heartbeat to check the connection is still alive."
+	SERVER_MAX_FRAME_SIZE_HELP    = "Define the maximum size in bytes of the messages mmar clients can send through their tunnel connection, mmar clients sending larger ones are disconnected."
+	SERVER_MAX_UDP_SESSIONS_HELP  = "Define the maximum number of sessions each UDP tunnel keeps open at once, datagrams from new source addresses are dropped until one of them closes."
+	SERVER_CONFIG_FILE_HELP       = "Define path to JSON file containing the server config, its options override the ones passed in through flags and environment variables. Sending SIGHUP to mmar server reloads it without dropping tunnels. (eg: /path/to/mmar-server.json)"
+	SERVER_UDP_TUNNEL_PORTS_HELP  = "Define range of public ports the mmar server can allocate for UDP tunnels, UDP tunnels are disabled if not provided. (eg: 20000-20100)"
 
 	CLIENT_LOCAL_PORT_HELP    = "Define the port where your local dev server is running to expose through mmar."
 	CLIENT_HTTP_PORT_HELP     = "Define port of mmar HTTP server to make requests through the tunnel."
@@ -38,24 +89,85 @@ const (
 	CLIENT_CUSTOM_CERT_HELP   = "Define path to file custom TLS certificate containing complete ASN.1 DER content (certificate, signature algorithm and signature). Currently used for testing, but may be used to allow mmar client to work with a dev server using custom TLS certificate setups. (eg: /path/to/cert)"
 	CLIENT_CUSTOM_NAME_HELP   = "Define a custom name for the tunnel subdomain. If not provided, a random subdomain will be generated. (eg: myapp, myproject)"
 	CLIENT_AUTH_TOKEN_HELP    = "Define authentication token required to create tunnels. Must match a key in the server's API keys file."
+	CLIENT_TUNNEL_TYPE_HELP   = "Define the type of tunnel to create, either \"http\" to expose a local web server on a subdomain, \"tcp\" to expose any local TCP service (eg: Postgres, Redis, SSH) on a public port, or \"udp\" to expose a local UDP service (eg: DNS, game servers) on a public port."
+	CLIENT_LABELS_HELP        = "Define labels to attach to the tunnel, shown in the mmar server's stats. (eg: env=staging,team=payments)"
+	CLIENT_MAX_REQ_BODY_HELP  = "Define the maximum size in bytes of request bodies the tunnel accepts, lower than the mmar server's limit. (defaults to the mmar server's limit)"
+	CLIENT_IDLE_CONNS_HELP    = "Define the maximum number of idle connections to your local dev server kept open, to reuse when forwarding requests. Set to 0 to open a new connection for every request."
+	CLIENT_TLS_HELP           = "Connect to the mmar server over TLS, verifying its certificate against the system's trusted CAs. Enabled automatically when --tls-ca, --tls-pin or --tls-client-cert is provided."
+	CLIENT_TLS_CA_HELP        = "Define path to PEM file containing CA certificates to verify the mmar server's TLS certificate against, instead of the system's trusted CAs. (eg: /path/to/ca.pem)"
+	CLIENT_TLS_CERT_HELP      = "Define path to PEM file containing a client certificate to present to the mmar server, to authenticate with instead of an API key. Requires --tls-client-key as well and enables TLS. (eg: /path/to/client-cert.pem)"
+	CLIENT_TLS_KEY_HELP       = "Define path to PEM file containing the private key of the client certificate. (eg: /path/to/client-key.pem)"
+	CLIENT_TLS_PIN_HELP       = "Define the SHA-256 hashes of public keys the mmar server's TLS certificate must have, base64 encoded and separated by commas. (eg: sha256/AbC...=, generated with: openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64)"
 	SERVER_API_KEYS_FILE_HELP = "Define path to YAML file containing API keys and their tunnel limits. (eg: /path/to/api-keys.yaml)"
 
-	TUNNEL_MESSAGE_PROTOCOL_VERSION = 4
-	TUNNEL_MESSAGE_DATA_DELIMITER   = '\n'
-	ID_CHARSET                      = "abcdefghijklmnopqrstuvwxyz0123456789"
-	ID_LENGTH                       = 6
+	ADMIN_TUNNEL_HOST_HELP      = "Define host domain of the mmar server to manage."
+	ADMIN_HTTP_PORT_HELP        = "Define port of mmar HTTP server to send admin requests to, on its stats subdomain."
+	ADMIN_OUTPUT_HELP           = "Define the output format, either \"table\" or \"json\"."
+	ADMIN_KILL_REASON_HELP      = "Define the reason the tunnel is closed for, shown to its mmar client."
+	ADMIN_KEY_HELP              = "Define the API key to add, a random one is generated if neither --key nor --identity is provided."
+	ADMIN_IDENTITY_HELP         = "Define the client certificate identity to add instead of an API key."
+	ADMIN_KEY_LIMIT_HELP        = "Define the maximum number of tunnels that can be open at once with the API key."
+	ADMIN_RESERVATION_NOTE_HELP = "Define a note on why the subdomain is reserved."
+
+	TUNNEL_MESSAGE_PROTOCOL_VERSION        = 6
+	HELLO_MESSAGE_PROTOCOL_VERSION         = 6
+	LEGACY_TUNNEL_MESSAGE_PROTOCOL_VERSION = 4
+	TUNNEL_REQUEST_PAYLOAD_VERSION         = 1
+	TUNNEL_MESSAGE_DATA_DELIMITER          = '\n'
+	ID_CHARSET                             = "abcdefghijklmnopqrstuvwxyz0123456789"
+	ID_LENGTH                              = 6
+	RESUME_TOKEN_LENGTH                    = 32
+	REQUEST_ID_LENGTH                      = 8
+	DEFAULT_ERROR_PAGE                     = "default.html"
+
+	FEATURE_STREAMING   = "streaming"
+	FEATURE_WEBSOCKET   = "websocket"
+	FEATURE_TCP_TUNNELS = "tcp"
+	FEATURE_UDP_TUNNELS = "udp"
+
+	// Tunnels closed by mmar server are told the reason they were closed for
+	FEATURE_TUNNEL_CLOSED = "tunnel_closed"
 
 	MAX_TUNNELS_PER_IP            = 5
 	TUNNEL_RECONNECT_TIMEOUT      = 3
 	GRACEFUL_SHUTDOWN_TIMEOUT     = 3
 	TUNNEL_CREATE_TIMEOUT         = 3
+	TLS_HANDSHAKE_TIMEOUT         = 5
+	ADMIN_REQUEST_TIMEOUT         = 10
+	TUNNEL_WRITE_TIMEOUT          = 30
+	LOCAL_IDLE_CONN_TIMEOUT       = 90
+	CUSTOM_CERT_RELOAD_INTERVAL   = 5
+	OUTGOING_QUEUE_TIMEOUT        = 30
 	REQ_BODY_READ_CHUNK_TIMEOUT   = 3
 	DEST_REQUEST_TIMEOUT          = 30
 	HEARTBEAT_FROM_SERVER_TIMEOUT = 5
 	HEARTBEAT_FROM_CLIENT_TIMEOUT = 2
 	READ_DEADLINE                 = 3
+	RECLAIM_GRACE_PERIOD          = 60
+	MAX_RECONNECT_QUEUED_REQUESTS = 100
+	MAX_RECONNECT_QUEUED_BYTES    = 10000000 // 10mb
 	MAX_REQ_BODY_SIZE             = 10000000 // 10mb
+	MAX_FRAME_SIZE                = 16777216 // 16mb
+	MIN_FRAME_SIZE                = 131072   // 128kb
+	MAX_MALFORMED_MESSAGES        = 10
+	MALFORMED_MESSAGES_INTERVAL   = 60
 	REQUEST_ID_BUFF_SIZE          = 4
+	MESSAGE_HEADER_BUFF_SIZE      = 32
+	HTTP_HEAD_BUFF_SIZE           = 1024
+	BODY_CHUNK_SIZE               = 32768  // 32kb
+	STREAM_WINDOW_SIZE            = 262144 // 256kb
+	WINDOW_INCREMENT_BUFF_SIZE    = 4
+	OUTGOING_QUEUE_SIZE           = 64
+	LOCAL_MAX_IDLE_CONNS          = 100
+	UDP_SESSION_IDLE_TIMEOUT      = 60
+	MAX_UDP_SESSIONS              = 1000
+	MAX_UDP_DATAGRAM_SIZE         = 65535
+	STATS_LATENCY_SAMPLES         = 1000
+	STATS_DEFAULT_PAGE_SIZE       = 100
+	STATS_MAX_PAGE_SIZE           = 1000
+	MASKED_TOKEN_MIN_LENGTH       = 12
+	MASKED_TOKEN_VISIBLE_CHARS    = 4
+	ADMIN_MAX_REQUEST_BODY_SIZE   = 64 * 1024
 
 	CLIENT_DISCONNECT_ERR_TEXT                    = "Tunnel is closed, cannot connect to mmar client."
 	LOCALHOST_NOT_RUNNING_ERR_TEXT                = "Tunneled successfully, but nothing is running on localhost."
@@ -63,6 +175,7 @@ const (
 	READ_BODY_CHUNK_ERR_TEXT                      = "Error reading request body"
 	READ_BODY_CHUNK_TIMEOUT_ERR_TEXT              = "Timeout reading request body"
 	READ_RESP_BODY_ERR_TEXT                       = "Could not read response from destination server, check your server's logs for any errors."
+	REQUEST_CANCELED_ERR_TEXT                     = "Request was canceled by mmar server"
 	MAX_REQ_BODY_SIZE_ERR_TEXT                    = "Request too large"
 	FAILED_TO_FORWARD_TO_MMAR_CLIENT_ERR_TEXT     = "Failed to forward request to mmar client"
 	FAILED_TO_READ_RESP_FROM_MMAR_CLIENT_ERR_TEXT = "Fail to read response from mmad client"
@@ -71,6 +184,33 @@ const (
 	AUTH_TOKEN_REQUIRED_ERR_TEXT                  = "Authentication token is required to create tunnels."
 	AUTH_TOKEN_INVALID_ERR_TEXT                   = "Invalid authentication token provided."
 	AUTH_TOKEN_LIMIT_EXCEEDED_ERR_TEXT            = "Tunnel limit exceeded for this authentication token."
+	TUNNEL_TYPE_UNSUPPORTED_ERR_TEXT              = "Tunnel type is not supported by the mmar server."
+	TUNNEL_PORTS_EXHAUSTED_ERR_TEXT               = "No public ports are available on the mmar server for a new tunnel, please try again later."
+	TUNNEL_NOT_HTTP_ERR_TEXT                      = "Tunnel does not accept HTTP requests."
+	PROTOCOL_VERSION_UNSUPPORTED_ERR_TEXT         = "The mmar server does not support the message protocol of this mmar client, please update mmar."
+	TLS_PIN_MISMATCH_ERR_TEXT                     = "TLS certificate of the mmar server does not match any of the pinned public keys"
+	TUNNEL_ERR_TEXT                               = "An error occured while attempting to tunnel."
+	RECONNECT_QUEUE_FULL_ERR_TEXT                 = "Too many requests are waiting for the tunnel to reconnect, please try again later."
+	RECONNECT_TIMEDOUT_ERR_TEXT                   = "Tunnel did not reconnect in time to forward the request."
+	CLIENT_CERT_INVALID_ERR_TEXT                  = "Client certificate does not match any identity allowed to create tunnels."
+	PROTOCOL_NEGOTIATION_TIMEDOUT_ERR_TEXT        = "The mmar server did not respond to the protocol negotiation, it is likely running an older version of mmar."
+	TUNNEL_CLOSED_ERR_TEXT                        = "Tunnel was closed by an administrator."
+
+	// Codes identifying tunnel errors in error responses to end-users
+	ERR_CODE_TUNNEL_NOT_FOUND         = "tunnel_not_found"
+	ERR_CODE_TUNNEL_NOT_HTTP          = "tunnel_not_http"
+	ERR_CODE_TUNNEL_DISCONNECTED      = "tunnel_disconnected"
+	ERR_CODE_TUNNEL_UNAVAILABLE       = "tunnel_unavailable"
+	ERR_CODE_TUNNEL_ERROR             = "tunnel_error"
+	ERR_CODE_LOCALHOST_NOT_RUNNING    = "localhost_not_running"
+	ERR_CODE_DEST_REQUEST_TIMEDOUT    = "dest_request_timed_out"
+	ERR_CODE_INVALID_RESP_FROM_DEST   = "invalid_response_from_dest"
+	ERR_CODE_INVALID_RESP_FROM_CLIENT = "invalid_response_from_client"
+	ERR_CODE_REQUEST_BODY_TIMEDOUT    = "request_body_timed_out"
+	ERR_CODE_INVALID_REQUEST_BODY     = "invalid_request_body"
+	ERR_CODE_REQUEST_TOO_LARGE        = "request_too_large"
+	ERR_CODE_RECONNECT_QUEUE_FULL     = "reconnect_queue_full"
+	ERR_CODE_RECONNECT_TIMEDOUT       = "reconnect_timed_out"
 
 	// TERMINAL ANSI ESCAPED COLORS
 	DEFAULT_COLOR = ""
@@ -85,6 +225,7 @@ var (
 	MMAR_SUBCOMMANDS = [][]string{
 		{"server", "Runs a mmar server. Run this on your publicly reachable server if you're self-hosting mmar."},
 		{"client", "Runs a mmar client. Run this on your machine to expose your localhost on a public URL."},
+		{"admin", "Manages the tunnels, API keys and reserved subdomains of a mmar server. Run this wherever you manage your self-hosted mmar server from."},
 		{"version", "Prints the installed version of mmar."},
 	}
 )
@@ -0,0 +1,576 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yusuf-musleh/mmar/constants"
+)
+
+var UNKNOWN_COMMAND_ERR = errors.New("unknown command, run `mmar admin -h` to see the available commands")
+
+type ConfigOptions struct {
+	TunnelHost     string
+	TunnelHttpPort string
+	Output         string
+	Username       string
+	Password       string
+}
+
+// Runs an admin command against the stats subdomain of the mmar server
+type AdminClient struct {
+	ConfigOptions
+	httpClient *http.Client
+	out        io.Writer
+}
+
+// An admin command, run with the arguments following it
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(ac *AdminClient, args []string) error
+}
+
+var commands = []command{
+	{"tunnels ls", "tunnels ls [flags]", "List the tunnels open on the mmar server, filtered, sorted and paginated as in the stats.", (*AdminClient).listTunnels},
+	{"tunnels inspect", "tunnels inspect <id>", "Show the details of a tunnel.", (*AdminClient).inspectTunnel},
+	{"tunnels kill", "tunnels kill <id> [--reason REASON]", "Close a tunnel, its mmar client is told the reason and exits.", (*AdminClient).killTunnel},
+	{"keys ls", "keys ls", "List the API keys and identities, with their limits and tunnels open.", (*AdminClient).listKeys},
+	{"keys add", "keys add [--key KEY | --identity IDENTITY] --limit N", "Add an API key, generating one if not provided, or a client certificate identity.", (*AdminClient).addKey},
+	{"keys limit", "keys limit <id> --limit N", "Change the limit of tunnels of an API key or identity.", (*AdminClient).setKeyLimit},
+	{"keys revoke", "keys revoke <id>", "Revoke an API key or identity, closing all of its tunnels.", (*AdminClient).revokeKey},
+	{"reservations ls", "reservations ls", "List the reserved subdomains.", (*AdminClient).listReservations},
+	{"reservations add", "reservations add <subdomain> [--note NOTE]", "Reserve a subdomain so no mmar client can use it.", (*AdminClient).reserveSubdomain},
+	{"reservations rm", "reservations rm <subdomain>", "Release a reserved subdomain.", (*AdminClient).releaseSubdomain},
+}
+
+func Usage() {
+	fmt.Fprintf(os.Stdout, "Manages the tunnels, API keys and reserved subdomains of a mmar server through its admin API.\n\n")
+	fmt.Fprintf(os.Stdout, "Usage:\n  mmar admin [flags] <command> [command flags]\n\nCommands:\n")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.usage, cmd.description)
+	}
+	tw.Flush()
+	fmt.Fprintf(
+		os.Stdout,
+		"\nCredentials of the stats page are read from the %s and %s environment variables.\n\nFlags:\n",
+		constants.MMAR_ENV_VAR_ADMIN_USERNAME,
+		constants.MMAR_ENV_VAR_ADMIN_PASSWORD,
+	)
+}
+
+// Flags of a command, along with the ones every command accepts so they can be passed
+// in after the command as well
+func (ac *AdminClient) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&ac.TunnelHost, "tunnel-host", ac.TunnelHost, constants.ADMIN_TUNNEL_HOST_HELP)
+	fs.StringVar(&ac.TunnelHttpPort, "tunnel-http-port", ac.TunnelHttpPort, constants.ADMIN_HTTP_PORT_HELP)
+	fs.StringVar(&ac.Output, "output", ac.Output, constants.ADMIN_OUTPUT_HELP)
+	return fs
+}
+
+// Parse the flags of a command, which can come before or after its positional arguments
+func (ac *AdminClient) parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	if ac.Output != "table" && ac.Output != "json" {
+		return nil, fmt.Errorf("invalid output \"%s\", expected table or json", ac.Output)
+	}
+	return positional, nil
+}
+
+// Base URL of the stats subdomain of the mmar server, along with the host to send
+// requests with. Subdomains of localhost are not resolved, so they are sent to localhost.
+func (ac *AdminClient) statsUrl() (string, string) {
+	scheme := "https"
+	port := ac.TunnelHttpPort
+	if ac.TunnelHost == "localhost" {
+		scheme = "http"
+		if port == constants.TUNNEL_HTTP_PORT {
+			port = constants.SERVER_HTTP_PORT
+		}
+	}
+
+	portStr := ""
+	if port != constants.TUNNEL_HTTP_PORT {
+		portStr = ":" + port
+	}
+	host := "stats." + ac.TunnelHost + portStr
+	if ac.TunnelHost == "localhost" {
+		return fmt.Sprintf("%s://localhost%s", scheme, portStr), host
+	}
+	return fmt.Sprintf("%s://%s", scheme, host), host
+}
+
+// Send a request to the admin API, with the body JSON encoded if provided, returning
+// the body of the response. Responses with an error status are returned as errors.
+func (ac *AdminClient) request(method string, path string, body any) ([]byte, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	baseUrl, host := ac.statsUrl()
+	req, err := http.NewRequest(method, baseUrl+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = host
+	req.SetBasicAuth(ac.Username, ac.Password)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := ac.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach mmar server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from mmar server: %v", err)
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf(
+			"invalid credentials, set them with %s and %s",
+			constants.MMAR_ENV_VAR_ADMIN_USERNAME,
+			constants.MMAR_ENV_VAR_ADMIN_PASSWORD,
+		)
+	}
+	if resp.StatusCode >= 300 {
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(respBody, &errResp) == nil && errResp.Error != "" {
+			return nil, errors.New(errResp.Error)
+		}
+		return nil, fmt.Errorf("mmar server responded with %s", resp.Status)
+	}
+	return respBody, nil
+}
+
+// Print the response as indented JSON if requested, otherwise decode it into v to be
+// printed as a table. Returns false if it was already printed.
+func (ac *AdminClient) decode(respBody []byte, v any) (bool, error) {
+	if ac.Output == "json" {
+		var indented bytes.Buffer
+		if len(respBody) > 0 {
+			if err := json.Indent(&indented, respBody, "", "  "); err != nil {
+				return false, err
+			}
+			indented.WriteByte('\n')
+		}
+		_, err := ac.out.Write(indented.Bytes())
+		return false, err
+	}
+	return true, json.Unmarshal(respBody, v)
+}
+
+// Print rows as a table with its columns aligned, the first row being the header
+func (ac *AdminClient) printTable(rows [][]string) {
+	tw := tabwriter.NewWriter(ac.out, 0, 0, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+}
+
+// Print a message once a command succeeded, unless the output is JSON
+func (ac *AdminClient) printDone(format string, args ...any) {
+	if ac.Output == "json" {
+		fmt.Fprintln(ac.out, "{}")
+		return
+	}
+	fmt.Fprintf(ac.out, format+"\n", args...)
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// Format a time returned by the admin API relative to now, for tables
+func formatAge(value string) string {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return orDash(value)
+	}
+	return time.Since(parsed).Round(time.Second).String() + " ago"
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+type tunnel struct {
+	Id               string            `json:"id"`
+	Type             string            `json:"type"`
+	ProtocolVersion  string            `json:"protocolVersion"`
+	CreatedOn        string            `json:"createdOn"`
+	Port             string            `json:"port"`
+	Labels           map[string]string `json:"labels"`
+	ClientVersion    string            `json:"clientVersion"`
+	RemoteIp         string            `json:"remoteIp"`
+	Identity         string            `json:"identity"`
+	Requests         int64             `json:"requests"`
+	Errors           int64             `json:"errors"`
+	BytesIn          int64             `json:"bytesIn"`
+	BytesOut         int64             `json:"bytesOut"`
+	LastRequestOn    string            `json:"lastRequestOn"`
+	InflightRequests int               `json:"inflightRequests"`
+	LatencyP50Ms     float64           `json:"latencyP50Ms"`
+	LatencyP95Ms     float64           `json:"latencyP95Ms"`
+	Features         []string          `json:"features"`
+	Limits           map[string]int64  `json:"limits"`
+	Reclaimable      bool              `json:"reclaimable"`
+}
+
+func formatLabels(labels map[string]string) string {
+	pairs := []string{}
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	slices.Sort(pairs)
+	return orDash(strings.Join(pairs, ","))
+}
+
+func (ac *AdminClient) listTunnels(args []string) error {
+	fs := ac.flagSet("tunnels ls")
+	query := url.Values{}
+	for _, name := range []string{"type", "ip", "label", "sort", "limit", "offset"} {
+		fs.Func(name, fmt.Sprintf("Only list tunnels by %s, as in the stats query string.", name), func(value string) error {
+			query.Add(name, value)
+			return nil
+		})
+	}
+	if _, err := ac.parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	respBody, err := ac.request("GET", "/admin/tunnels?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	var stats struct {
+		ConnectedClientsCount int      `json:"connectedClientsCount"`
+		MatchingClientsCount  int      `json:"matchingClientsCount"`
+		ConnectedClients      []tunnel `json:"connectedClients"`
+	}
+	if asTable, err := ac.decode(respBody, &stats); !asTable || err != nil {
+		return err
+	}
+
+	rows := [][]string{{"ID", "TYPE", "PORT", "REMOTE IP", "IDENTITY", "REQUESTS", "ERRORS", "IN", "OUT", "CREATED", "LABELS"}}
+	for _, t := range stats.ConnectedClients {
+		rows = append(rows, []string{
+			t.Id, t.Type, orDash(t.Port), t.RemoteIp, orDash(t.Identity),
+			strconv.FormatInt(t.Requests, 10), strconv.FormatInt(t.Errors, 10),
+			formatBytes(t.BytesIn), formatBytes(t.BytesOut), formatAge(t.CreatedOn), formatLabels(t.Labels),
+		})
+	}
+	ac.printTable(rows)
+	fmt.Fprintf(ac.out, "\n%d of %d matching tunnels, %d open\n", len(stats.ConnectedClients), stats.MatchingClientsCount, stats.ConnectedClientsCount)
+	return nil
+}
+
+func (ac *AdminClient) inspectTunnel(args []string) error {
+	positional, err := ac.parseArgs(ac.flagSet("tunnels inspect"), args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: mmar admin tunnels inspect <id>")
+	}
+
+	respBody, err := ac.request("GET", "/admin/tunnels/"+url.PathEscape(positional[0]), nil)
+	if err != nil {
+		return err
+	}
+	var t tunnel
+	if asTable, err := ac.decode(respBody, &t); !asTable || err != nil {
+		return err
+	}
+
+	limits := []string{}
+	for name, limit := range t.Limits {
+		limits = append(limits, fmt.Sprintf("%s=%d", name, limit))
+	}
+	slices.Sort(limits)
+	ac.printTable([][]string{
+		{"ID", t.Id},
+		{"TYPE", t.Type},
+		{"PORT", orDash(t.Port)},
+		{"REMOTE IP", t.RemoteIp},
+		{"IDENTITY", orDash(t.Identity)},
+		{"CLIENT VERSION", orDash(t.ClientVersion)},
+		{"PROTOCOL VERSION", t.ProtocolVersion},
+		{"FEATURES", orDash(strings.Join(t.Features, ","))},
+		{"LIMITS", orDash(strings.Join(limits, ","))},
+		{"LABELS", formatLabels(t.Labels)},
+		{"CREATED", formatAge(t.CreatedOn)},
+		{"LAST REQUEST", formatAge(t.LastRequestOn)},
+		{"REQUESTS", fmt.Sprintf("%d (%d errors, %d inflight)", t.Requests, t.Errors, t.InflightRequests)},
+		{"LATENCY", fmt.Sprintf("p50 %.1fms, p95 %.1fms", t.LatencyP50Ms, t.LatencyP95Ms)},
+		{"BYTES", fmt.Sprintf("%s in, %s out", formatBytes(t.BytesIn), formatBytes(t.BytesOut))},
+		{"RECLAIMABLE", strconv.FormatBool(t.Reclaimable)},
+	})
+	return nil
+}
+
+func (ac *AdminClient) killTunnel(args []string) error {
+	fs := ac.flagSet("tunnels kill")
+	reason := fs.String("reason", "", constants.ADMIN_KILL_REASON_HELP)
+	positional, err := ac.parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: mmar admin tunnels kill <id> [--reason REASON]")
+	}
+
+	path := "/admin/tunnels/" + url.PathEscape(positional[0])
+	if *reason != "" {
+		path += "?reason=" + url.QueryEscape(*reason)
+	}
+	if _, err := ac.request("DELETE", path, nil); err != nil {
+		return err
+	}
+	ac.printDone("Tunnel %s closed", positional[0])
+	return nil
+}
+
+type key struct {
+	Id       string `json:"id"`
+	Key      string `json:"key"`
+	Identity string `json:"identity"`
+	Limit    int    `json:"limit"`
+	Tunnels  int    `json:"tunnels"`
+}
+
+func (ac *AdminClient) listKeys(args []string) error {
+	if _, err := ac.parseArgs(ac.flagSet("keys ls"), args); err != nil {
+		return err
+	}
+
+	respBody, err := ac.request("GET", "/admin/keys", nil)
+	if err != nil {
+		return err
+	}
+	var keys []key
+	if asTable, err := ac.decode(respBody, &keys); !asTable || err != nil {
+		return err
+	}
+
+	rows := [][]string{{"ID", "KEY", "IDENTITY", "LIMIT", "TUNNELS"}}
+	for _, k := range keys {
+		rows = append(rows, []string{k.Id, orDash(k.Key), orDash(k.Identity), strconv.Itoa(k.Limit), strconv.Itoa(k.Tunnels)})
+	}
+	ac.printTable(rows)
+	return nil
+}
+
+func (ac *AdminClient) addKey(args []string) error {
+	fs := ac.flagSet("keys add")
+	apiKey := fs.String("key", "", constants.ADMIN_KEY_HELP)
+	identity := fs.String("identity", "", constants.ADMIN_IDENTITY_HELP)
+	limit := fs.Int("limit", 1, constants.ADMIN_KEY_LIMIT_HELP)
+	if _, err := ac.parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	respBody, err := ac.request("POST", "/admin/keys", map[string]any{"key": *apiKey, "identity": *identity, "limit": *limit})
+	if err != nil {
+		return err
+	}
+	var k key
+	if asTable, err := ac.decode(respBody, &k); !asTable || err != nil {
+		return err
+	}
+
+	ac.printTable([][]string{{"ID", "KEY", "IDENTITY", "LIMIT"}, {k.Id, orDash(k.Key), orDash(k.Identity), strconv.Itoa(k.Limit)}})
+	if k.Key != "" {
+		fmt.Fprintln(ac.out, "\nThe API key is only shown once, keep it somewhere safe.")
+	}
+	return nil
+}
+
+func (ac *AdminClient) setKeyLimit(args []string) error {
+	fs := ac.flagSet("keys limit")
+	limit := fs.Int("limit", -1, constants.ADMIN_KEY_LIMIT_HELP)
+	positional, err := ac.parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || *limit < 0 {
+		return errors.New("usage: mmar admin keys limit <id> --limit N")
+	}
+
+	respBody, err := ac.request("PATCH", "/admin/keys/"+url.PathEscape(positional[0]), map[string]int{"limit": *limit})
+	if err != nil {
+		return err
+	}
+	var k key
+	if asTable, err := ac.decode(respBody, &k); !asTable || err != nil {
+		return err
+	}
+	ac.printDone("Limit of %s changed to %d, it has %d tunnels open", k.Id, k.Limit, k.Tunnels)
+	return nil
+}
+
+func (ac *AdminClient) revokeKey(args []string) error {
+	positional, err := ac.parseArgs(ac.flagSet("keys revoke"), args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: mmar admin keys revoke <id>")
+	}
+
+	if _, err := ac.request("DELETE", "/admin/keys/"+url.PathEscape(positional[0]), nil); err != nil {
+		return err
+	}
+	ac.printDone("Key %s revoked", positional[0])
+	return nil
+}
+
+type reservation struct {
+	Subdomain  string `json:"subdomain"`
+	Type       string `json:"type"`
+	Note       string `json:"note"`
+	ReservedOn string `json:"reservedOn"`
+	ExpiresOn  string `json:"expiresOn"`
+}
+
+func (ac *AdminClient) listReservations(args []string) error {
+	if _, err := ac.parseArgs(ac.flagSet("reservations ls"), args); err != nil {
+		return err
+	}
+
+	respBody, err := ac.request("GET", "/admin/reservations", nil)
+	if err != nil {
+		return err
+	}
+	var reservations []reservation
+	if asTable, err := ac.decode(respBody, &reservations); !asTable || err != nil {
+		return err
+	}
+
+	rows := [][]string{{"SUBDOMAIN", "TYPE", "RESERVED", "EXPIRES", "NOTE"}}
+	for _, r := range reservations {
+		rows = append(rows, []string{r.Subdomain, r.Type, formatAge(r.ReservedOn), orDash(r.ExpiresOn), orDash(r.Note)})
+	}
+	ac.printTable(rows)
+	return nil
+}
+
+func (ac *AdminClient) reserveSubdomain(args []string) error {
+	fs := ac.flagSet("reservations add")
+	note := fs.String("note", "", constants.ADMIN_RESERVATION_NOTE_HELP)
+	positional, err := ac.parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: mmar admin reservations add <subdomain> [--note NOTE]")
+	}
+
+	respBody, err := ac.request("PUT", "/admin/reservations/"+url.PathEscape(positional[0]), map[string]string{"note": *note})
+	if err != nil {
+		return err
+	}
+	var r reservation
+	if asTable, err := ac.decode(respBody, &r); !asTable || err != nil {
+		return err
+	}
+	ac.printDone("Subdomain %s reserved", r.Subdomain)
+	return nil
+}
+
+func (ac *AdminClient) releaseSubdomain(args []string) error {
+	positional, err := ac.parseArgs(ac.flagSet("reservations rm"), args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: mmar admin reservations rm <subdomain>")
+	}
+
+	if _, err := ac.request("DELETE", "/admin/reservations/"+url.PathEscape(positional[0]), nil); err != nil {
+		return err
+	}
+	ac.printDone("Subdomain %s released", positional[0])
+	return nil
+}
+
+func Run(config ConfigOptions, args []string) {
+	ac := &AdminClient{
+		ConfigOptions: config,
+		httpClient:    &http.Client{Timeout: constants.ADMIN_REQUEST_TIMEOUT * time.Second},
+		out:           os.Stdout,
+	}
+
+	// Commands are a resource followed by an action, eg: tunnels ls
+	if len(args) < 2 {
+		Usage()
+		os.Exit(0)
+	}
+	name := args[0] + " " + args[1]
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		err := cmd.run(ac, args[2:])
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Error: %v\n", UNKNOWN_COMMAND_ERR)
+	os.Exit(1)
+}
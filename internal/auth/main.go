@@ -1,10 +1,18 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 )
 
@@ -12,27 +20,38 @@ import (
 var (
 	ErrAuthTokenRequired = errors.New("authentication token is required")
 	ErrAuthTokenInvalid  = errors.New("invalid authentication token")
+	ErrClientCertInvalid = errors.New("client certificate does not match any identity")
+	ErrKeyExists         = errors.New("API key or identity already exists")
+	ErrKeyNotFound       = errors.New("API key or identity not found")
+	ErrInvalidKeyConfig  = errors.New("either an API key or an identity is required, with a limit of at least 0")
 )
 
+// Tunnels of client certificate identities are tracked under this prefix,
+// so they never collide with API keys
+const CERT_IDENTITY_PREFIX = "cert:"
+
+// An entry either has an API key, or an identity matching the subject common name
+// or one of the SANs (DNS name, email address or URI) of a client certificate
 type ApiKeyConfig struct {
-	Key   string `json:"key"`
-	Limit int    `json:"limit"`
+	Key      string `json:"key,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	Limit    int    `json:"limit"`
 }
 
 type ApiKeysConfig []ApiKeyConfig
 
 type AuthManager struct {
-	mu            sync.RWMutex
-	apiKeys       map[string]int
-	tunnelsPerKey map[string][]string
-	configFile    string
+	mu         sync.RWMutex
+	apiKeys    map[string]int
+	identities map[string]int
+	configFile string
 }
 
 func NewAuthManager(configFile string) (*AuthManager, error) {
 	am := &AuthManager{
-		apiKeys:       make(map[string]int),
-		tunnelsPerKey: make(map[string][]string),
-		configFile:    configFile,
+		apiKeys:    make(map[string]int),
+		identities: make(map[string]int),
+		configFile: configFile,
 	}
 
 	if err := am.loadApiKeys(); err != nil {
@@ -60,14 +79,15 @@ func (am *AuthManager) loadApiKeys() error {
 	am.mu.Lock()
 	defer am.mu.Unlock()
 
-	am.apiKeys = func() map[string]int {
-		m := make(map[string]int)
-		for _, entry := range config {
-			m[entry.Key] = entry.Limit
+	am.apiKeys = make(map[string]int)
+	am.identities = make(map[string]int)
+	for _, entry := range config {
+		if entry.Identity != "" {
+			am.identities[entry.Identity] = entry.Limit
+		} else {
+			am.apiKeys[entry.Key] = entry.Limit
 		}
-
-		return m
-	}()
+	}
 
 	// print all keys and quota in key | limit format
 	fmt.Println("Loaded API keys and their limits:")
@@ -75,6 +95,9 @@ func (am *AuthManager) loadApiKeys() error {
 	for key, limit := range am.apiKeys {
 		fmt.Printf("%s | %d\n", key, limit)
 	}
+	for identity, limit := range am.identities {
+		fmt.Printf("%s%s | %d\n", CERT_IDENTITY_PREFIX, identity, limit)
+	}
 	fmt.Println("-------------------------------------")
 
 	return nil
@@ -100,59 +123,42 @@ func (am *AuthManager) ValidateToken(token string) (bool, int, error) {
 	return true, limit, nil
 }
 
-func (am *AuthManager) CheckTunnelLimit(token string) bool {
+// Map a verified client certificate to its identity, the returned token is used
+// in place of an API key to track the identity's tunnels
+func (am *AuthManager) ValidateCertificate(cert *x509.Certificate) (string, int, error) {
 	am.mu.RLock()
 	defer am.mu.RUnlock()
 
-	tunnels := am.tunnelsPerKey[token]
-	limit := am.apiKeys[token]
-
-	return len(tunnels) >= limit
-}
-
-func (am *AuthManager) AddTunnel(token string, tunnelId string) {
-	am.mu.Lock()
-	defer am.mu.Unlock()
-
-	if am.tunnelsPerKey[token] == nil {
-		am.tunnelsPerKey[token] = []string{}
-	}
-	am.tunnelsPerKey[token] = append(am.tunnelsPerKey[token], tunnelId)
-}
-
-func (am *AuthManager) RemoveTunnel(token string, tunnelId string) {
-	am.mu.Lock()
-	defer am.mu.Unlock()
-
-	tunnels := am.tunnelsPerKey[token]
-	if tunnels == nil {
-		return
+	candidates := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	candidates = append(candidates, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		candidates = append(candidates, uri.String())
 	}
 
-	for i, id := range tunnels {
-		if id == tunnelId {
-			am.tunnelsPerKey[token] = append(tunnels[:i], tunnels[i+1:]...)
-			break
+	for _, identity := range candidates {
+		if limit, exists := am.identities[identity]; exists {
+			return CERT_IDENTITY_PREFIX + identity, limit, nil
 		}
 	}
+	return "", 0, ErrClientCertInvalid
 }
 
-func (am *AuthManager) GetTunnelCount(token string) int {
-	am.mu.RLock()
-	defer am.mu.RUnlock()
-
-	tunnels := am.tunnelsPerKey[token]
-	if tunnels == nil {
-		return 0
+// Limit of an API key or of a client certificate identity token, callers must hold the lock
+func (am *AuthManager) limitOf(token string) (int, bool) {
+	if identity, ok := strings.CutPrefix(token, CERT_IDENTITY_PREFIX); ok {
+		limit, exists := am.identities[identity]
+		return limit, exists
 	}
-	return len(tunnels)
+	limit, exists := am.apiKeys[token]
+	return limit, exists
 }
 
+// Limit of tunnels of an API key or client certificate identity token, 0 if it does not exist
 func (am *AuthManager) GetTokenLimit(token string) int {
 	am.mu.RLock()
 	defer am.mu.RUnlock()
 
-	limit, exists := am.apiKeys[token]
+	limit, exists := am.limitOf(token)
 	if !exists {
 		return 0
 	}
@@ -169,3 +175,214 @@ func (am *AuthManager) GetAllTokens() map[string]int {
 	}
 	return result
 }
+
+// Length in bytes of the API keys generated when none is provided, hex encoded
+const GENERATED_KEY_LENGTH = 24
+
+// Length in bytes of the fingerprints API keys and identities can be referred to by
+const FINGERPRINT_LENGTH = 6
+
+// An API key or client certificate identity along with its usage, as listed to admins
+type KeyInfo struct {
+	// Fingerprint to refer to the entry by without revealing the API key
+	Id       string `json:"id"`
+	Key      string `json:"key,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	Limit    int    `json:"limit"`
+	// Number of tunnels open, filled in by mmar server which keeps track of them
+	Tunnels int `json:"tunnels"`
+}
+
+// Token tunnels of the API key or identity are tracked by
+func (k KeyInfo) Token() string {
+	return tokenOf(ApiKeyConfig{Key: k.Key, Identity: k.Identity})
+}
+
+// Fingerprint of an API key or identity token, safe to show since it cannot be reversed
+func Fingerprint(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:FINGERPRINT_LENGTH])
+}
+
+func generateApiKey() string {
+	b := make([]byte, GENERATED_KEY_LENGTH)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Token of an API key or identity, so its tunnels are tracked like ones of an API key
+func tokenOf(entry ApiKeyConfig) string {
+	if entry.Identity != "" {
+		return CERT_IDENTITY_PREFIX + entry.Identity
+	}
+	return entry.Key
+}
+
+// Resolve a reference to an API key or identity, either its fingerprint or the token of
+// an identity. API keys themselves are not accepted, to keep them out of URLs and logs.
+// Callers must hold the lock.
+func (am *AuthManager) resolveToken(ref string) (string, bool) {
+	if _, exists := am.limitOf(ref); exists && strings.HasPrefix(ref, CERT_IDENTITY_PREFIX) {
+		return ref, true
+	}
+	for key := range am.apiKeys {
+		if Fingerprint(key) == ref {
+			return key, true
+		}
+	}
+	for identity := range am.identities {
+		if token := CERT_IDENTITY_PREFIX + identity; Fingerprint(token) == ref {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+// Info of an API key or identity token, callers must hold the lock
+func (am *AuthManager) keyInfo(token string) KeyInfo {
+	limit, _ := am.limitOf(token)
+	info := KeyInfo{Id: Fingerprint(token), Limit: limit}
+	if identity, isIdentity := strings.CutPrefix(token, CERT_IDENTITY_PREFIX); isIdentity {
+		info.Identity = identity
+	} else {
+		info.Key = token
+	}
+	return info
+}
+
+// List the API keys and identities along with their limits
+func (am *AuthManager) ListKeys() []KeyInfo {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	keys := []KeyInfo{}
+	for key := range am.apiKeys {
+		keys = append(keys, am.keyInfo(key))
+	}
+	for identity := range am.identities {
+		keys = append(keys, am.keyInfo(CERT_IDENTITY_PREFIX+identity))
+	}
+	slices.SortFunc(keys, func(a, b KeyInfo) int {
+		return strings.Compare(a.Identity+a.Key, b.Identity+b.Key)
+	})
+	return keys
+}
+
+// Add an API key or identity, generating an API key if neither is provided, and persist
+// it to the API keys file
+func (am *AuthManager) AddKey(entry ApiKeyConfig) (KeyInfo, error) {
+	if entry.Limit < 0 || (entry.Key != "" && entry.Identity != "") {
+		return KeyInfo{}, ErrInvalidKeyConfig
+	}
+	if entry.Key == "" && entry.Identity == "" {
+		entry.Key = generateApiKey()
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	token := tokenOf(entry)
+	if _, exists := am.limitOf(token); exists {
+		return KeyInfo{}, ErrKeyExists
+	}
+	apiKeys, identities := maps.Clone(am.apiKeys), maps.Clone(am.identities)
+	if entry.Identity != "" {
+		identities[entry.Identity] = entry.Limit
+	} else {
+		apiKeys[entry.Key] = entry.Limit
+	}
+	if err := am.saveApiKeys(apiKeys, identities); err != nil {
+		return KeyInfo{}, err
+	}
+	return am.keyInfo(token), nil
+}
+
+// Change the tunnel limit of an API key or identity, referred to by its fingerprint, and persist it to the API keys file. Tunnels already open are kept.
+func (am *AuthManager) SetKeyLimit(ref string, limit int) (KeyInfo, error) {
+	if limit < 0 {
+		return KeyInfo{}, ErrInvalidKeyConfig
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	token, ok := am.resolveToken(ref)
+	if !ok {
+		return KeyInfo{}, ErrKeyNotFound
+	}
+	apiKeys, identities := maps.Clone(am.apiKeys), maps.Clone(am.identities)
+	if identity, isIdentity := strings.CutPrefix(token, CERT_IDENTITY_PREFIX); isIdentity {
+		identities[identity] = limit
+	} else {
+		apiKeys[token] = limit
+	}
+	if err := am.saveApiKeys(apiKeys, identities); err != nil {
+		return KeyInfo{}, err
+	}
+	return am.keyInfo(token), nil
+}
+
+// Revoke an API key or identity, referred to by its fingerprint, and persist it
+// to the API keys file. Returns its token, for callers to close the tunnels created with it.
+func (am *AuthManager) RevokeKey(ref string) (string, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	token, ok := am.resolveToken(ref)
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	apiKeys, identities := maps.Clone(am.apiKeys), maps.Clone(am.identities)
+	if identity, isIdentity := strings.CutPrefix(token, CERT_IDENTITY_PREFIX); isIdentity {
+		delete(identities, identity)
+	} else {
+		delete(apiKeys, token)
+	}
+	if err := am.saveApiKeys(apiKeys, identities); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Write the changed API keys and identities to the API keys file, replacing it at once so
+// it is never left partially written, and only then apply them, so the ones in use never
+// differ from the ones persisted. Callers must hold the lock.
+func (am *AuthManager) saveApiKeys(apiKeys map[string]int, identities map[string]int) error {
+	config := ApiKeysConfig{}
+	for key, limit := range apiKeys {
+		config = append(config, ApiKeyConfig{Key: key, Limit: limit})
+	}
+	for identity, limit := range identities {
+		config = append(config, ApiKeyConfig{Identity: identity, Limit: limit})
+	}
+	slices.SortFunc(config, func(a, b ApiKeyConfig) int {
+		return strings.Compare(a.Identity+a.Key, b.Identity+b.Key)
+	})
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize API keys: %v", err)
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(am.configFile), filepath.Base(am.configFile)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write API keys file: %v", err)
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err := tempFile.Write(append(data, '\n')); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("failed to write API keys file: %v", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to write API keys file: %v", err)
+	}
+	// Keep the permissions of the existing file, since it holds secrets
+	if info, err := os.Stat(am.configFile); err == nil {
+		os.Chmod(tempFile.Name(), info.Mode().Perm())
+	}
+	if err := os.Rename(tempFile.Name(), am.configFile); err != nil {
+		return fmt.Errorf("failed to write API keys file: %v", err)
+	}
+	am.apiKeys, am.identities = apiKeys, identities
+	return nil
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/yusuf-musleh/mmar/constants"
+	"github.com/yusuf-musleh/mmar/internal/logger"
+)
+
+var CUSTOM_CERT_INVALID_ERR = errors.New("Invalid custom certificate")
+
+// Forwards requests to the local dev server, built once so connections to it are kept
+// alive and reused across requests
+type localForwarder struct {
+	customDns    string
+	customCert   string
+	maxIdleConns int
+	// Client forwarding requests, replaced once the custom certificate changes
+	client atomic.Pointer[http.Client]
+	// Modification time of the custom certificate file the client was built with
+	certModTime time.Time
+}
+
+func newLocalForwarder(customDns string, customCert string, maxIdleConns int) (*localForwarder, error) {
+	lf := &localForwarder{customDns: customDns, customCert: customCert, maxIdleConns: maxIdleConns}
+
+	var rootCAs *x509.CertPool
+	if customCert != "" {
+		certPool, modTime, err := loadCustomCert(customCert)
+		if errors.Is(err, CUSTOM_CERT_INVALID_ERR) {
+			logger.Log(constants.YELLOW, "Warning: Could not load custom certificate")
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read certificate from file: %v", err)
+		}
+		rootCAs, lf.certModTime = certPool, modTime
+	}
+	lf.client.Store(lf.newClient(rootCAs))
+	return lf, nil
+}
+
+// Read and parse the custom TLS certificate (ASN.1 DER), along with the modification
+// time of its file
+func loadCustomCert(certFile string) (*x509.CertPool, time.Time, error) {
+	info, err := os.Stat(certFile)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	certData, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	cert, err := x509.ParseCertificate(certData)
+	if err != nil {
+		return nil, info.ModTime(), fmt.Errorf("%w: %v", CUSTOM_CERT_INVALID_ERR, err)
+	}
+	certPool := x509.NewCertPool()
+	certPool.AddCert(cert)
+	return certPool, info.ModTime(), nil
+}
+
+func (lf *localForwarder) newClient(rootCAs *x509.CertPool) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = lf.maxIdleConns
+	transport.MaxIdleConnsPerHost = lf.maxIdleConns
+	transport.IdleConnTimeout = constants.LOCAL_IDLE_CONN_TIMEOUT * time.Second
+	transport.DisableKeepAlives = lf.maxIdleConns == 0
+
+	// Use custom DNS if set
+	if lf.customDns != "" {
+		dialer := &net.Dialer{
+			Resolver: &net.Resolver{
+				PreferGo: true,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					return net.Dial("udp", lf.customDns)
+				},
+			},
+		}
+		transport.DialContext = dialer.DialContext
+	}
+
+	// Use custom TLS certificate if setup
+	if rootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		// Do not follow redirects, let the end-user's client handle it
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (lf *localForwarder) Do(req *http.Request) (*http.Response, error) {
+	return lf.client.Load().Do(req)
+}
+
+// Reload the custom certificate whenever its file changes, until the context is done.
+// Requests already being forwarded complete with the previous certificate.
+func (lf *localForwarder) watchCustomCert(ctx context.Context) {
+	ticker := time.NewTicker(constants.CUSTOM_CERT_RELOAD_INTERVAL * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(lf.customCert)
+		if err != nil || info.ModTime().Equal(lf.certModTime) {
+			continue
+		}
+		certPool, modTime, err := loadCustomCert(lf.customCert)
+		if err != nil {
+			logger.Log(constants.YELLOW, fmt.Sprintf("Warning: Could not reload custom certificate, keeping the previous one: %v", err))
+			// Do not attempt again until the file changes again
+			lf.certModTime = info.ModTime()
+			continue
+		}
+		lf.certModTime = modTime
+
+		previous := lf.client.Swap(lf.newClient(certPool))
+		previous.CloseIdleConnections()
+		logger.Log(constants.GREEN, "Custom certificate reloaded")
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -15,7 +14,8 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
-	"strings"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -25,21 +25,69 @@ import (
 )
 
 type ConfigOptions struct {
-	LocalPort      string
-	TunnelHttpPort string
-	TunnelTcpPort  string
-	TunnelHost     string
-	CustomDns      string
-	CustomCert     string
-	CustomName     string
-	APIKey         string
+	LocalPort          string
+	TunnelHttpPort     string
+	TunnelTcpPort      string
+	TunnelHost         string
+	CustomDns          string
+	CustomCert         string
+	CustomName         string
+	APIKey             string
+	TunnelType         string
+	Labels             string
+	MaxRequestBodySize string
+	LocalMaxIdleConns  string
+	Tls                bool
+	TlsCaFile          string
+	TlsPin             string
+	TlsCertFile        string
+	TlsKeyFile         string
 }
 
 type MmarClient struct {
 	// Tunnel to Server
 	protocol.Tunnel
 	ConfigOptions
-	subdomain string
+	subdomain  string
+	publicPort string
+	// Secret issued by mmar server to reclaim the subdomain after reconnecting
+	resumeToken      string
+	inflightRequests *sync.Map
+	// Labels and limits requested for the tunnel, parsed from the config options
+	labels map[string]string
+	limits protocol.TunnelLimits
+	// Limits mmar server applies to the tunnel, received once it is created
+	appliedLimits protocol.TunnelLimits
+	// Used to connect to mmar server over TLS, nil if TLS is not enabled
+	tlsConfig *tls.Config
+	// Forwards requests to localhost, reusing connections to it
+	forwarder *localForwarder
+}
+
+// Request from mmar server that is being forwarded to localhost
+type InflightRequest struct {
+	// Request body received from mmar server
+	body *protocol.StreamBuffer
+	// Stream data received from mmar server, once the connection switches protocols,
+	// or for streams and sessions of TCP/UDP tunnels
+	stream *protocol.StreamBuffer
+	// Window for sending the response body (or stream data) to mmar server
+	sendWindow *protocol.SendWindow
+	cancel     context.CancelFunc
+}
+
+var REQUEST_CANCELED_ERR = errors.New(constants.REQUEST_CANCELED_ERR_TEXT)
+var PROTOCOL_VERSION_UNSUPPORTED_ERR = errors.New(constants.PROTOCOL_VERSION_UNSUPPORTED_ERR_TEXT)
+var PROTOCOL_NEGOTIATION_TIMEDOUT_ERR = errors.New(constants.PROTOCOL_NEGOTIATION_TIMEDOUT_ERR_TEXT)
+var TUNNEL_TYPE_UNSUPPORTED_ERR = errors.New(constants.TUNNEL_TYPE_UNSUPPORTED_ERR_TEXT)
+
+// Features supported by mmar client, advertised to mmar server during negotiation
+var CLIENT_FEATURES = []string{
+	constants.FEATURE_STREAMING,
+	constants.FEATURE_WEBSOCKET,
+	constants.FEATURE_TCP_TUNNELS,
+	constants.FEATURE_UDP_TUNNELS,
+	constants.FEATURE_TUNNEL_CLOSED,
 }
 
 func (mc *MmarClient) localizeRequest(request *http.Request) {
@@ -56,73 +104,13 @@ func (mc *MmarClient) localizeRequest(request *http.Request) {
 }
 
 // Process requests coming from mmar server and forward them to localhost
-func (mc *MmarClient) handleRequestMessage(tunnelMsg protocol.TunnelMessage) {
-	fwdClient := &http.Client{
-		Timeout: constants.DEST_REQUEST_TIMEOUT * time.Second,
-		// Do not follow redirects, let the end-user's client handle it
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
-
-	// Use custom DNS if set
-	if mc.CustomDns != "" {
-		r := &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				return net.Dial("udp", mc.CustomDns)
-			},
-		}
-		dialer := &net.Dialer{
-			Resolver: r,
-		}
-
-		tp := &http.Transport{
-			DialContext: dialer.DialContext,
-		}
-
-		fwdClient.Transport = tp
-	}
-
-	// Use custom TLS certificate if setup
-	if mc.CustomCert != "" {
-		certData, certFileErr := os.ReadFile(mc.CustomCert)
-		if certFileErr != nil {
-			logger.Log(
-				constants.RED,
-				fmt.Sprintf(
-					"Could not read certificate from file: %v",
-					certFileErr,
-				))
-			os.Exit(1)
-		}
-
-		cert, certErr := x509.ParseCertificate(certData)
-		if certErr != nil {
-			logger.Log(constants.YELLOW, "Warning: Could not load custom certificate")
-		} else {
-			fwdClient.Transport.(*http.Transport).TLSClientConfig = &tls.Config{
-				RootCAs: x509.NewCertPool(),
-			}
-			fwdClient.Transport.(*http.Transport).TLSClientConfig.RootCAs.AddCert(cert)
-		}
-	}
-
-	reqReader := bufio.NewReader(bytes.NewReader(tunnelMsg.MsgData))
-
-	// Extract RequestId
-	reqIdBuff := make([]byte, constants.REQUEST_ID_BUFF_SIZE)
-	_, err := io.ReadFull(reqReader, reqIdBuff)
-	if err != nil {
-		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to parse RequestId for request: %v\n", err))
-		return
-	}
+func (mc *MmarClient) handleRequestMessage(ctx context.Context, reqId uint32, reqHead []byte, inflightRequest InflightRequest) {
+	defer mc.removeInflightRequest(reqId)
 
-	// Include RequestId in tunnel back message
-	msgData := []byte{}
-	msgData = append(msgData, reqIdBuff...)
+	// Include RequestId in tunnel back messages
+	msgData := protocol.RequestIdMsgData(reqId, nil)
 
-	req, reqErr := http.ReadRequest(reqReader)
+	req, reqErr := http.ReadRequest(bufio.NewReader(bytes.NewReader(reqHead)))
 	if reqErr != nil {
 		if errors.Is(reqErr, io.EOF) {
 			logger.Log(constants.DEFAULT_COLOR, "Connection to mmar server closed or disconnected. Exiting...")
@@ -136,18 +124,37 @@ func (mc *MmarClient) handleRequestMessage(tunnelMsg protocol.TunnelMessage) {
 		log.Fatalf("Failed to read data from TCP conn: %v", reqErr)
 	}
 
+	// Request body is streamed from mmar server in chunks
+	if req.ContentLength != 0 {
+		req.Body = inflightRequest.body
+	} else {
+		req.Body = http.NoBody
+	}
+
 	// Convert request to target localhost
 	mc.localizeRequest(req)
 
-	resp, fwdErr := fwdClient.Do(req)
+	// Only waiting for the response headers is timed out, since the response body
+	// may be streamed indefinitely (eg: Server-Sent Events) or the connection upgraded
+	fwdCtx, cancelFwd := context.WithCancel(ctx)
+	defer cancelFwd()
+	headerTimeout := time.AfterFunc(mc.destRequestTimeout(), cancelFwd)
+
+	resp, fwdErr := mc.forwarder.Do(req.WithContext(fwdCtx))
+	headerTimedOut := !headerTimeout.Stop()
 	if fwdErr != nil {
+		// Request was canceled by mmar server, no need to respond
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return
+		}
+
 		if errors.Is(fwdErr, syscall.ECONNREFUSED) || errors.Is(fwdErr, io.ErrUnexpectedEOF) || errors.Is(fwdErr, io.EOF) {
 			localhostNotRunningMsg := protocol.TunnelMessage{MsgType: protocol.LOCALHOST_NOT_RUNNING, MsgData: msgData}
 			if err := mc.SendMessage(localhostNotRunningMsg); err != nil {
 				log.Fatal(err)
 			}
 			return
-		} else if errors.Is(fwdErr, context.DeadlineExceeded) {
+		} else if errors.Is(fwdErr, context.DeadlineExceeded) || headerTimedOut {
 			destServerTimedoutMsg := protocol.TunnelMessage{MsgType: protocol.DEST_REQUEST_TIMEDOUT, MsgData: msgData}
 			if err := mc.SendMessage(destServerTimedoutMsg); err != nil {
 				log.Fatal(err)
@@ -161,17 +168,271 @@ func (mc *MmarClient) handleRequestMessage(tunnelMsg protocol.TunnelMessage) {
 		}
 		return
 	}
+	defer resp.Body.Close()
+
+	// If the connection switched protocols, it is now a raw stream in both directions,
+	// so write stream data coming from mmar server to it until the stream is closed
+	dataMsgType, endMsgType, abortMsgType := protocol.RESPONSE_BODY_CHUNK, protocol.RESPONSE_BODY_END, protocol.RESPONSE_BODY_ABORT
+	if upgradedConn, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		go io.Copy(upgradedConn, inflightRequest.stream)
+		context.AfterFunc(ctx, func() { upgradedConn.Close() })
+		dataMsgType, endMsgType, abortMsgType = protocol.STREAM_DATA, protocol.STREAM_CLOSE, protocol.STREAM_CLOSE
+	}
 
-	// Writing response to buffer to tunnel it back
-	var responseBuff bytes.Buffer
-	resp.Write(&responseBuff)
-	msgData = append(msgData, responseBuff.Bytes()...)
-	respMessage := protocol.TunnelMessage{MsgType: protocol.RESPONSE, MsgData: msgData}
+	// Writing response line and headers to buffer to tunnel it back, right after the RequestId
+	responseBuff := bytes.NewBuffer(make([]byte, 0, constants.REQUEST_ID_BUFF_SIZE+constants.HTTP_HEAD_BUFF_SIZE))
+	responseBuff.Write(msgData)
+	fmt.Fprintf(responseBuff, "%s %s\r\n", resp.Proto, resp.Status)
+	resp.Header.Write(responseBuff)
+	responseBuff.WriteString("\r\n")
+	respMessage := protocol.TunnelMessage{MsgType: protocol.RESPONSE, MsgData: responseBuff.Bytes()}
 	if err := mc.SendMessage(respMessage); err != nil {
 		log.Fatal(err)
 	}
 
-	logger.LogHTTP(req, resp.StatusCode, resp.ContentLength, false, true)
+	// Stream response body (or upgraded connection data) back in chunks as it is read from localhost
+	buf := protocol.NewRequestIdBuffer(reqId)
+	defer buf.Release()
+	var contentLength int64
+	for {
+		n, readErr := resp.Body.Read(buf.Data())
+		contentLength += int64(n)
+		if n > 0 {
+			// Wait for mmar server to have room for more of the response
+			if err := inflightRequest.sendWindow.Acquire(ctx, n); err != nil {
+				return
+			}
+			chunkMsg := protocol.TunnelMessage{MsgType: dataMsgType, MsgData: buf.MsgData(n)}
+			if err := mc.SendMessage(chunkMsg); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if readErr != nil {
+			// Request was canceled or stream was closed by mmar server, no need to continue
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return
+			}
+
+			respBodyEndType := endMsgType
+			if !errors.Is(readErr, io.EOF) {
+				logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to read response body: %v", readErr))
+				respBodyEndType = abortMsgType
+			}
+			respBodyEndMsg := protocol.TunnelMessage{MsgType: respBodyEndType, MsgData: msgData}
+			if err := mc.SendMessage(respBodyEndMsg); err != nil {
+				log.Fatal(err)
+			}
+			break
+		}
+	}
+
+	logger.LogHTTP(req, resp.StatusCode, contentLength, false, true)
+}
+
+// Add an inflight request (or stream) received from mmar server, data received for it is
+// buffered without blocking the tunnel, granting mmar server more room to send as it is consumed
+func (mc *MmarClient) newInflightRequest(ctx context.Context, reqId uint32, hasBody bool) (context.Context, InflightRequest) {
+	reqCtx, cancel := context.WithCancel(ctx)
+	sendWindowUpdate := func(increment int) {
+		windowUpdateMsg := protocol.TunnelMessage{
+			MsgType: protocol.WINDOW_UPDATE,
+			MsgData: protocol.WindowUpdateMsgData(reqId, increment),
+		}
+		if err := mc.SendMessage(windowUpdateMsg); err != nil {
+			logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send Window Update msg to server: %v", err))
+		}
+	}
+
+	inflightRequest := InflightRequest{
+		stream:     protocol.NewStreamBuffer(sendWindowUpdate),
+		sendWindow: protocol.NewSendWindow(),
+		cancel:     cancel,
+	}
+	if hasBody {
+		inflightRequest.body = protocol.NewStreamBuffer(sendWindowUpdate)
+	}
+
+	// Stop waiting on data from mmar server once the request is canceled
+	context.AfterFunc(reqCtx, func() {
+		if inflightRequest.body != nil {
+			inflightRequest.body.CloseWithError(REQUEST_CANCELED_ERR)
+		}
+		inflightRequest.stream.CloseWithError(REQUEST_CANCELED_ERR)
+	})
+
+	mc.inflightRequests.Store(reqId, inflightRequest)
+	return reqCtx, inflightRequest
+}
+
+// Start forwarding a request received from mmar server, its body is written
+// into the request as chunks are received
+func (mc *MmarClient) addInflightRequest(ctx context.Context, tunnelMsg protocol.TunnelMessage) {
+	reqId, reqHead, err := protocol.ExtractRequestId(tunnelMsg.MsgData)
+	if err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to parse RequestId for request: %v\n", err))
+		return
+	}
+
+	reqCtx, inflightRequest := mc.newInflightRequest(ctx, reqId, true)
+	go mc.handleRequestMessage(reqCtx, reqId, reqHead, inflightRequest)
+}
+
+func (mc *MmarClient) removeInflightRequest(reqId uint32) {
+	inflight, loaded := mc.inflightRequests.LoadAndDelete(reqId)
+	if !loaded {
+		return
+	}
+	inflight.(InflightRequest).cancel()
+}
+
+// Retrieve inflight request a message from mmar server is keyed by
+func (mc *MmarClient) inflightRequestFromMsg(tunnelMsg protocol.TunnelMessage) (uint32, InflightRequest, []byte, bool) {
+	reqId, data, err := protocol.ExtractRequestId(tunnelMsg.MsgData)
+	if err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to parse RequestId for request: %v\n", err))
+		return 0, InflightRequest{}, nil, false
+	}
+
+	inflight, loaded := mc.inflightRequests.Load(reqId)
+	if !loaded {
+		return 0, InflightRequest{}, nil, false
+	}
+	return reqId, inflight.(InflightRequest), data, true
+}
+
+// Buffer request body chunk received from mmar server for the forwarded request
+func (mc *MmarClient) handleRequestBodyChunk(tunnelMsg protocol.TunnelMessage) {
+	reqId, inflightRequest, chunk, ok := mc.inflightRequestFromMsg(tunnelMsg)
+	if !ok || inflightRequest.body == nil {
+		tunnelMsg.Release()
+		return
+	}
+	mc.bufferInflightData(reqId, inflightRequest.body, chunk, tunnelMsg.Release)
+}
+
+func (mc *MmarClient) handleRequestBodyEnd(tunnelMsg protocol.TunnelMessage) {
+	_, inflightRequest, _, ok := mc.inflightRequestFromMsg(tunnelMsg)
+	if !ok || inflightRequest.body == nil {
+		return
+	}
+	inflightRequest.body.Close()
+}
+
+// Buffer stream data received from mmar server for the upgraded connection, or for the
+// local connection of a TCP/UDP tunnel
+func (mc *MmarClient) handleStreamData(tunnelMsg protocol.TunnelMessage) {
+	reqId, inflightRequest, data, ok := mc.inflightRequestFromMsg(tunnelMsg)
+	if !ok {
+		tunnelMsg.Release()
+		return
+	}
+	mc.bufferInflightData(reqId, inflightRequest.stream, data, tunnelMsg.Release)
+}
+
+// Buffer data until it is consumed, releasing the message it was received in afterwards
+func (mc *MmarClient) bufferInflightData(reqId uint32, buffer *protocol.StreamBuffer, data []byte, release func()) {
+	// Errors occur if the request is already done, so the data is not needed, or if
+	// mmar server sent more than it was allowed to
+	if err := buffer.Write(data, release); errors.Is(err, protocol.STREAM_WINDOW_EXCEEDED) {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to buffer data for request: %v", err))
+		mc.removeInflightRequest(reqId)
+	}
+}
+
+// Grant more room to send on a stream, once mmar server consumed its data
+func (mc *MmarClient) handleWindowUpdate(tunnelMsg protocol.TunnelMessage) {
+	reqId, increment, err := protocol.ExtractWindowUpdate(tunnelMsg.MsgData)
+	if err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to parse Window Update: %v", err))
+		return
+	}
+
+	// The stream might have already completed, in which case the update is not needed
+	inflight, ok := mc.inflightRequests.Load(reqId)
+	if !ok {
+		return
+	}
+	inflight.(InflightRequest).sendWindow.Update(increment)
+}
+
+func (mc *MmarClient) handleRequestCanceled(tunnelMsg protocol.TunnelMessage) {
+	reqId, _, _, ok := mc.inflightRequestFromMsg(tunnelMsg)
+	if !ok {
+		return
+	}
+	mc.removeInflightRequest(reqId)
+}
+
+// Cancel all requests being forwarded, since their responses cannot be tunneled back
+func (mc *MmarClient) cancelInflightRequests() {
+	mc.inflightRequests.Range(func(reqId, _ any) bool {
+		mc.removeInflightRequest(reqId.(uint32))
+		return true
+	})
+}
+
+// Settle on the protocol version and features to use with mmar server, before creating
+// or reclaiming a tunnel
+func (mc *MmarClient) negotiate() error {
+	hello := protocol.Hello{
+		Versions: []int{constants.TUNNEL_MESSAGE_PROTOCOL_VERSION},
+		Features: CLIENT_FEATURES,
+	}
+	helloData, err := hello.MsgData()
+	if err != nil {
+		return err
+	}
+	helloMsg := protocol.TunnelMessage{MsgType: protocol.HELLO, MsgData: helloData}
+	if err := mc.SendMessage(helloMsg); err != nil {
+		return err
+	}
+
+	// mmar servers predating negotiation never respond, so do not wait on them forever
+	mc.Tunnel.Conn.SetReadDeadline(time.Now().Add(constants.TUNNEL_CREATE_TIMEOUT * time.Second))
+	defer mc.Tunnel.Conn.SetReadDeadline(time.Time{})
+
+	var ackMsg protocol.TunnelMessage
+	for ackMsg.MsgType != protocol.HELLO_ACK {
+		ackMsg, err = mc.ReceiveMessage()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return PROTOCOL_NEGOTIATION_TIMEDOUT_ERR
+		} else if err != nil {
+			return err
+		}
+	}
+
+	ack, err := protocol.ParseHelloAck(ackMsg.MsgData)
+	if err != nil {
+		return err
+	}
+	if ack.Version == 0 {
+		return PROTOCOL_VERSION_UNSUPPORTED_ERR
+	}
+	mc.Tunnel.Version = uint8(ack.Version)
+	mc.Tunnel.Features = ack.Features
+
+	// TCP/UDP tunnels are only supported if enabled on mmar server, their features
+	// are named after the tunnel types
+	if mc.TunnelType != constants.TUNNEL_TYPE_HTTP && !mc.Supports(mc.TunnelType) {
+		return TUNNEL_TYPE_UNSUPPORTED_ERR
+	}
+	return nil
+}
+
+// Request to create or reclaim a tunnel with the subdomain (and public port for TCP/UDP tunnels)
+func (mc *MmarClient) tunnelRequest(subdomain string, port int) protocol.TunnelRequest {
+	return protocol.TunnelRequest{
+		Version:       constants.TUNNEL_REQUEST_PAYLOAD_VERSION,
+		Subdomain:     subdomain,
+		AuthToken:     mc.APIKey,
+		TunnelType:    mc.TunnelType,
+		Port:          port,
+		Labels:        mc.labels,
+		Limits:        mc.limits,
+		ClientVersion: constants.MMAR_VERSION,
+		ResumeToken:   mc.resumeToken,
+	}
 }
 
 // Keep attempting to reconnect the existing tunnel until successful
@@ -182,24 +443,34 @@ func (mc *MmarClient) reconnectTunnel(ctx context.Context) {
 			return
 		}
 		logger.Log(constants.DEFAULT_COLOR, "Attempting to reconnect...")
-		conn, err := net.DialTimeout(
-			"tcp",
-			net.JoinHostPort(mc.ConfigOptions.TunnelHost, mc.ConfigOptions.TunnelTcpPort),
-			constants.TUNNEL_CREATE_TIMEOUT*time.Second,
-		)
+		conn, err := dialMmarServer(mc.ConfigOptions, mc.tlsConfig)
 		if err != nil {
 			time.Sleep(constants.TUNNEL_RECONNECT_TIMEOUT * time.Second)
 			continue
 		}
-		mc.Tunnel.Conn = conn
-		mc.Tunnel.Reader = bufio.NewReader(conn)
+		mc.Tunnel.Close()
+		mc.Tunnel = protocol.NewTunnel(conn)
 
-		// Try to reclaim the same subdomain with auth token
-		reclaimData := mc.subdomain
-		if mc.APIKey != "" {
-			reclaimData = mc.subdomain + "|" + mc.APIKey
+		// The mmar server might have been updated in the meantime, so negotiate again
+		if err := mc.negotiate(); err != nil {
+			if errors.Is(err, PROTOCOL_VERSION_UNSUPPORTED_ERR) || errors.Is(err, TUNNEL_TYPE_UNSUPPORTED_ERR) {
+				logger.Log(constants.YELLOW, fmt.Sprintf("%v Exiting...", err))
+				os.Exit(0)
+			}
+			mc.Tunnel.Close()
+			time.Sleep(constants.TUNNEL_RECONNECT_TIMEOUT * time.Second)
+			continue
+		}
+
+		// Try to reclaim the same subdomain with auth token and resume token, and the same
+		// public port for TCP/UDP tunnels
+		publicPort, _ := strconv.Atoi(mc.publicPort)
+		reclaimData, err := mc.tunnelRequest(mc.subdomain, publicPort).MsgData()
+		if err != nil {
+			logger.Log(constants.DEFAULT_COLOR, "Tunnel failed to reconnect. Exiting...")
+			os.Exit(0)
 		}
-		reclaimTunnelMsg := protocol.TunnelMessage{MsgType: protocol.RECLAIM_TUNNEL, MsgData: []byte(reclaimData)}
+		reclaimTunnelMsg := protocol.TunnelMessage{MsgType: protocol.RECLAIM_TUNNEL, MsgData: reclaimData}
 		if err := mc.SendMessage(reclaimTunnelMsg); err != nil {
 			logger.Log(constants.DEFAULT_COLOR, "Tunnel failed to reconnect. Exiting...")
 			os.Exit(0)
@@ -217,7 +488,7 @@ func (mc *MmarClient) ProcessTunnelMessages(ctx context.Context) {
 		default:
 			// Send heartbeat if nothing has been read for a while
 			receiveMessageTimeout := time.AfterFunc(
-				constants.HEARTBEAT_FROM_CLIENT_TIMEOUT*time.Second,
+				mc.heartbeatTimeout(),
 				func() {
 					heartbeatMsg := protocol.TunnelMessage{MsgType: protocol.HEARTBEAT_FROM_CLIENT}
 					if err := mc.SendMessage(heartbeatMsg); err != nil {
@@ -247,6 +518,7 @@ func (mc *MmarClient) ProcessTunnelMessages(ctx context.Context) {
 				}
 
 				logger.Log(constants.DEFAULT_COLOR, "Tunnel connection disconnected.")
+				mc.cancelInflightRequests()
 
 				// Keep trying to reconnect
 				mc.reconnectTunnel(ctx)
@@ -256,13 +528,31 @@ func (mc *MmarClient) ProcessTunnelMessages(ctx context.Context) {
 
 			switch tunnelMsg.MsgType {
 			case protocol.TUNNEL_CREATED, protocol.TUNNEL_RECLAIMED:
-				tunnelSubdomain := string(tunnelMsg.MsgData)
-				mc.subdomain = tunnelSubdomain
-				logger.LogTunnelCreated(tunnelSubdomain, mc.TunnelHost, mc.TunnelHttpPort, mc.LocalPort)
+				// TCP/UDP tunnels also include the public port they accept connections on
+				tunnelCreated, err := protocol.ParseTunnelCreated(tunnelMsg.MsgData)
+				if err != nil {
+					logger.Log(constants.DEFAULT_COLOR, "Tunnel failed to be created. Exiting...")
+					os.Exit(0)
+				}
+				mc.subdomain = tunnelCreated.Subdomain
+				mc.publicPort = strconv.Itoa(tunnelCreated.Port)
+				mc.resumeToken = tunnelCreated.ResumeToken
+				mc.appliedLimits = tunnelCreated.Limits
+				if mc.TunnelType == constants.TUNNEL_TYPE_TCP || mc.TunnelType == constants.TUNNEL_TYPE_UDP {
+					logger.LogPortTunnelCreated(mc.TunnelType, mc.TunnelHost, mc.publicPort, mc.LocalPort)
+				} else {
+					logger.LogTunnelCreated(mc.subdomain, mc.TunnelHost, mc.TunnelHttpPort, mc.LocalPort)
+				}
+				mc.logAppliedLimits()
 			case protocol.CLIENT_TUNNEL_LIMIT:
+				// mmar servers include their limit of tunnels per IP, unless they predate it
+				maxTunnels := string(tunnelMsg.MsgData)
+				if maxTunnels == "" {
+					maxTunnels = strconv.Itoa(constants.MAX_TUNNELS_PER_IP)
+				}
 				limit := logger.ColorLogStr(
 					constants.RED,
-					fmt.Sprintf("(%v/%v)", constants.MAX_TUNNELS_PER_IP, constants.MAX_TUNNELS_PER_IP),
+					fmt.Sprintf("(%v/%v)", maxTunnels, maxTunnels),
 				)
 				logger.Log(
 					constants.DEFAULT_COLOR,
@@ -301,14 +591,56 @@ func (mc *MmarClient) ProcessTunnelMessages(ctx context.Context) {
 					"Tunnel limit exceeded for this authentication token.",
 				)
 				os.Exit(0)
+			case protocol.TUNNEL_TYPE_UNSUPPORTED:
+				logger.Log(
+					constants.RED,
+					fmt.Sprintf("Tunnel type \"%s\" is not supported by the mmar server.", mc.TunnelType),
+				)
+				os.Exit(0)
+			case protocol.TUNNEL_PORTS_EXHAUSTED:
+				logger.Log(
+					constants.RED,
+					constants.TUNNEL_PORTS_EXHAUSTED_ERR_TEXT,
+				)
+				os.Exit(0)
+			case protocol.CLIENT_CERT_INVALID:
+				logger.Log(
+					constants.RED,
+					constants.CLIENT_CERT_INVALID_ERR_TEXT,
+				)
+				os.Exit(0)
+			case protocol.TUNNEL_CLOSED:
+				// Tunnel was closed by mmar server, so there is no point in reconnecting
+				reason := string(tunnelMsg.MsgData)
+				if reason == "" {
+					reason = constants.TUNNEL_CLOSED_ERR_TEXT
+				}
+				logger.Log(constants.RED, fmt.Sprintf("Tunnel was closed by the mmar server: %s", reason))
+				os.Exit(0)
 			case protocol.REQUEST:
-				go mc.handleRequestMessage(tunnelMsg)
+				mc.addInflightRequest(ctx, tunnelMsg)
+			case protocol.REQUEST_BODY_CHUNK:
+				mc.handleRequestBodyChunk(tunnelMsg)
+			case protocol.REQUEST_BODY_END:
+				mc.handleRequestBodyEnd(tunnelMsg)
+			case protocol.REQUEST_CANCELED, protocol.STREAM_CLOSE, protocol.UDP_SESSION_CLOSE:
+				mc.handleRequestCanceled(tunnelMsg)
+			case protocol.STREAM_DATA, protocol.UDP_DATAGRAM:
+				mc.handleStreamData(tunnelMsg)
+			case protocol.STREAM_OPEN:
+				mc.addInflightStream(ctx, tunnelMsg)
+			case protocol.UDP_SESSION_OPEN:
+				mc.addInflightUdpSession(ctx, tunnelMsg)
+			case protocol.WINDOW_UPDATE:
+				mc.handleWindowUpdate(tunnelMsg)
 			case protocol.HEARTBEAT_ACK:
 				// Got a heartbeat ack, that means the connection is healthy,
 				// we do not need to perform any action
 			case protocol.HEARTBEAT_FROM_SERVER:
+				// Skip the ack if the outgoing queue is full, mmar server gives up on the
+				// tunnel if it stays that way
 				heartbeatAckMsg := protocol.TunnelMessage{MsgType: protocol.HEARTBEAT_ACK}
-				if err := mc.SendMessage(heartbeatAckMsg); err != nil {
+				if err := mc.PostMessage(heartbeatAckMsg); err != nil && !errors.Is(err, protocol.OUTGOING_QUEUE_FULL) {
 					logger.Log(constants.DEFAULT_COLOR, "Failed to send Heartbeat Ack. Exiting...")
 					os.Exit(0)
 				}
@@ -318,17 +650,62 @@ func (mc *MmarClient) ProcessTunnelMessages(ctx context.Context) {
 }
 
 func Run(config ConfigOptions) {
+	switch config.TunnelType {
+	case constants.TUNNEL_TYPE_HTTP, constants.TUNNEL_TYPE_TCP, constants.TUNNEL_TYPE_UDP:
+	default:
+		logger.Log(
+			constants.RED,
+			fmt.Sprintf("Invalid tunnel type \"%s\", must be one of \"http\", \"tcp\" or \"udp\".", config.TunnelType),
+		)
+		os.Exit(1)
+	}
+
+	labels, err := parseLabels(config.Labels)
+	if err != nil {
+		logger.Log(constants.RED, fmt.Sprintf("Invalid labels \"%s\", %v.", config.Labels, err))
+		os.Exit(1)
+	}
+
+	var limits protocol.TunnelLimits
+	if config.MaxRequestBodySize != "" {
+		maxRequestBodySize, err := strconv.ParseInt(config.MaxRequestBodySize, 10, 64)
+		if err != nil || maxRequestBodySize <= 0 {
+			logger.Log(
+				constants.RED,
+				fmt.Sprintf("Invalid max request body size \"%s\", must be a positive number of bytes.", config.MaxRequestBodySize),
+			)
+			os.Exit(1)
+		}
+		limits.MaxRequestBodySize = maxRequestBodySize
+	}
+
+	maxIdleConns, err := strconv.Atoi(config.LocalMaxIdleConns)
+	if err != nil || maxIdleConns < 0 {
+		logger.Log(
+			constants.RED,
+			fmt.Sprintf("Invalid max idle connections \"%s\", must be 0 or a positive number.", config.LocalMaxIdleConns),
+		)
+		os.Exit(1)
+	}
+	forwarder, err := newLocalForwarder(config.CustomDns, config.CustomCert, maxIdleConns)
+	if err != nil {
+		logger.Log(constants.RED, fmt.Sprintf("Could not set up forwarding to localhost, %v", err))
+		os.Exit(1)
+	}
+
 	logger.LogStartMmarClient(config.TunnelHost, config.TunnelTcpPort, config.TunnelHttpPort, config.LocalPort)
 
 	// Channel handler for interrupt signal
 	sigInt := make(chan os.Signal, 1)
 	signal.Notify(sigInt, os.Interrupt)
 
-	conn, err := net.DialTimeout(
-		"tcp",
-		net.JoinHostPort(config.TunnelHost, config.TunnelTcpPort),
-		constants.TUNNEL_CREATE_TIMEOUT*time.Second,
-	)
+	tlsConfig, err := newTlsConfig(config)
+	if err != nil {
+		logger.Log(constants.RED, fmt.Sprintf("Invalid TLS configuration, %v.", err))
+		os.Exit(1)
+	}
+
+	conn, err := dialMmarServer(config, tlsConfig)
 	if err != nil {
 		logger.Log(
 			constants.DEFAULT_COLOR,
@@ -343,9 +720,23 @@ func Run(config ConfigOptions) {
 	}
 	defer conn.Close()
 	mmarClient := MmarClient{
-		protocol.Tunnel{Conn: conn, Reader: bufio.NewReader(conn)},
+		protocol.NewTunnel(conn),
 		config,
 		"",
+		"",
+		"",
+		&sync.Map{},
+		labels,
+		limits,
+		protocol.TunnelLimits{},
+		tlsConfig,
+		forwarder,
+	}
+
+	// Agree on the protocol to use with mmar server before creating the tunnel
+	if err := mmarClient.negotiate(); err != nil {
+		logger.Log(constants.YELLOW, fmt.Sprintf("%v Exiting...", err))
+		os.Exit(0)
 	}
 
 	// Create context to cancel running gouroutines when shutting down
@@ -354,12 +745,16 @@ func Run(config ConfigOptions) {
 	// Process Tunnel Messages coming from mmar server
 	go mmarClient.ProcessTunnelMessages(ctx)
 
-	// Create tunnel message with custom name and auth token if provided
-	var tunnelMsgData []byte
-	if mmarClient.CustomName != "" || mmarClient.APIKey != "" {
-		// Format: "customName|authToken" (use | as delimiter)
-		msgParts := []string{mmarClient.CustomName, mmarClient.APIKey}
-		tunnelMsgData = []byte(strings.Join(msgParts, "|"))
+	// Pick up changes to the custom certificate without restarting
+	if config.CustomCert != "" {
+		go forwarder.watchCustomCert(ctx)
+	}
+
+	// Create tunnel message with custom name and auth token if provided, along with the tunnel type
+	tunnelMsgData, err := mmarClient.tunnelRequest(mmarClient.CustomName, 0).MsgData()
+	if err != nil {
+		logger.Log(constants.DEFAULT_COLOR, "Failed to create Tunnel. Exiting...")
+		os.Exit(0)
 	}
 	createTunnelMsg := protocol.TunnelMessage{MsgType: protocol.CREATE_TUNNEL, MsgData: tunnelMsgData}
 	if err := mmarClient.SendMessage(createTunnelMsg); err != nil {
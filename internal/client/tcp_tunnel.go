@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"github.com/yusuf-musleh/mmar/constants"
+	"github.com/yusuf-musleh/mmar/internal/logger"
+	"github.com/yusuf-musleh/mmar/internal/protocol"
+)
+
+// Start streaming a connection accepted by the TCP tunnel on mmar server to localhost,
+// data received from mmar server is buffered until it is written to the local connection
+func (mc *MmarClient) addInflightStream(ctx context.Context, tunnelMsg protocol.TunnelMessage) {
+	streamId, remoteAddr, err := protocol.ExtractRequestId(tunnelMsg.MsgData)
+	if err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to parse RequestId for stream: %v\n", err))
+		return
+	}
+
+	streamCtx, inflightStream := mc.newInflightRequest(ctx, streamId, false)
+	go mc.handleStream(streamCtx, streamId, string(remoteAddr), inflightStream)
+}
+
+// Connect a stream from mmar server to localhost and pass data in both directions
+// until either side closes it
+func (mc *MmarClient) handleStream(ctx context.Context, streamId uint32, remoteAddr string, inflightStream InflightRequest) {
+	defer mc.removeInflightRequest(streamId)
+
+	// Include StreamId in tunnel back messages
+	msgData := protocol.RequestIdMsgData(streamId, nil)
+
+	localConn, dialErr := net.DialTimeout(
+		"tcp",
+		net.JoinHostPort("localhost", mc.LocalPort),
+		mc.destRequestTimeout(),
+	)
+	if dialErr != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to connect to localhost:%s: %v", mc.LocalPort, dialErr))
+		if ctx.Err() == nil {
+			closeMsg := protocol.TunnelMessage{MsgType: protocol.STREAM_CLOSE, MsgData: msgData}
+			if err := mc.SendMessage(closeMsg); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+	defer localConn.Close()
+	logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("TCP connection opened from %s", remoteAddr))
+
+	// Write stream data coming from mmar server to localhost, once mmar server closes
+	// the stream the local connection is closed as well
+	go func() {
+		io.Copy(localConn, inflightStream.stream)
+		localConn.Close()
+	}()
+
+	// Stream data coming from localhost back to mmar server
+	buf := protocol.NewRequestIdBuffer(streamId)
+	defer buf.Release()
+	var bytesStreamed int64
+	for {
+		n, readErr := localConn.Read(buf.Data())
+		bytesStreamed += int64(n)
+		if n > 0 {
+			// Wait for mmar server to have room for more stream data
+			if err := inflightStream.sendWindow.Acquire(ctx, n); err != nil {
+				break
+			}
+			dataMsg := protocol.TunnelMessage{MsgType: protocol.STREAM_DATA, MsgData: buf.MsgData(n)}
+			if err := mc.SendMessage(dataMsg); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+
+	// If the stream was not closed by mmar server, localhost closed it first, so let mmar server know
+	if ctx.Err() == nil {
+		closeMsg := protocol.TunnelMessage{MsgType: protocol.STREAM_CLOSE, MsgData: msgData}
+		if err := mc.SendMessage(closeMsg); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("TCP connection closed from %s, %d bytes sent", remoteAddr, bytesStreamed))
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/yusuf-musleh/mmar/constants"
+)
+
+var TLS_PIN_MISMATCH_ERR = errors.New(constants.TLS_PIN_MISMATCH_ERR_TEXT)
+
+// Build the TLS config to connect to mmar server with, returns nil if TLS is not enabled
+func newTlsConfig(config ConfigOptions) (*tls.Config, error) {
+	if !config.Tls && config.TlsCaFile == "" && config.TlsPin == "" && config.TlsCertFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: config.TunnelHost,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	// Verify against the provided CAs instead of the system's, eg: for self-signed certificates
+	if config.TlsCaFile != "" {
+		caData, err := os.ReadFile(config.TlsCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA certificates from file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no valid CA certificates found in %s", config.TlsCaFile)
+		}
+	}
+
+	// Present a client certificate to authenticate with, instead of an API key
+	if config.TlsCertFile != "" || config.TlsKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.TlsCertFile, config.TlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// Besides being verified, the certificate must have one of the pinned public keys
+	if config.TlsPin != "" {
+		pins := []string{}
+		for _, pin := range strings.Split(config.TlsPin, ",") {
+			pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+			if decoded, err := base64.StdEncoding.DecodeString(pin); err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("invalid TLS pin \"%s\", must be a base64 encoded SHA-256 hash", pin)
+			}
+			pins = append(pins, pin)
+		}
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return TLS_PIN_MISMATCH_ERR
+			}
+			hash := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			if !slices.Contains(pins, base64.StdEncoding.EncodeToString(hash[:])) {
+				return TLS_PIN_MISMATCH_ERR
+			}
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// Connect to mmar server, over TLS if it is enabled
+func dialMmarServer(config ConfigOptions, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: constants.TUNNEL_CREATE_TIMEOUT * time.Second}
+	addr := net.JoinHostPort(config.TunnelHost, config.TunnelTcpPort)
+	if tlsConfig == nil {
+		return dialer.Dial("tcp", addr)
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/yusuf-musleh/mmar/constants"
+	"github.com/yusuf-musleh/mmar/internal/logger"
+	"github.com/yusuf-musleh/mmar/internal/protocol"
+)
+
+// Start relaying datagrams of a session opened by the UDP tunnel on mmar server to localhost,
+// datagrams received from mmar server are buffered until they are written to the local socket
+func (mc *MmarClient) addInflightUdpSession(ctx context.Context, tunnelMsg protocol.TunnelMessage) {
+	sessionId, remoteAddr, err := protocol.ExtractRequestId(tunnelMsg.MsgData)
+	if err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to parse RequestId for UDP session: %v\n", err))
+		return
+	}
+
+	// Each session gets its own local socket, so replies from localhost can be matched to it
+	localConn, dialErr := net.Dial("udp", net.JoinHostPort("localhost", mc.LocalPort))
+	if dialErr != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to connect to localhost:%s: %v", mc.LocalPort, dialErr))
+		closeMsg := protocol.TunnelMessage{MsgType: protocol.UDP_SESSION_CLOSE, MsgData: protocol.RequestIdMsgData(sessionId, nil)}
+		if err := mc.SendMessage(closeMsg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	sessionCtx, inflightSession := mc.newInflightRequest(ctx, sessionId, false)
+	context.AfterFunc(sessionCtx, func() { localConn.Close() })
+
+	// Write datagrams coming from mmar server to localhost, one at a time
+	go func() {
+		buf := make([]byte, constants.MAX_UDP_DATAGRAM_SIZE)
+		for {
+			n, readErr := inflightSession.stream.Read(buf)
+			if readErr != nil {
+				return
+			}
+			// Errors such as nothing listening on the local port are reported when reading
+			localConn.Write(buf[:n])
+		}
+	}()
+
+	go mc.handleUdpSession(sessionCtx, sessionId, string(remoteAddr), localConn, inflightSession)
+}
+
+// Relay datagrams coming from localhost back to mmar server until the session is closed
+func (mc *MmarClient) handleUdpSession(
+	ctx context.Context,
+	sessionId uint32,
+	remoteAddr string,
+	localConn net.Conn,
+	inflightSession InflightRequest,
+) {
+	defer mc.removeInflightRequest(sessionId)
+	logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("UDP session opened from %s", remoteAddr))
+
+	buf := make([]byte, constants.MAX_UDP_DATAGRAM_SIZE)
+	var datagramsRelayed int64
+	for {
+		n, readErr := localConn.Read(buf)
+		if readErr != nil {
+			if errors.Is(readErr, net.ErrClosed) || ctx.Err() != nil {
+				break
+			}
+			// Errors such as nothing listening on the local port do not end the session,
+			// since the local service might start listening later
+			logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to read UDP datagram from localhost:%s: %v", mc.LocalPort, readErr))
+			continue
+		}
+
+		// Wait for mmar server to have room for more datagrams
+		if err := inflightSession.sendWindow.Acquire(ctx, n); err != nil {
+			break
+		}
+		datagramsRelayed++
+		datagramMsg := protocol.TunnelMessage{MsgType: protocol.UDP_DATAGRAM, MsgData: protocol.RequestIdMsgData(sessionId, buf[:n])}
+		if err := mc.SendMessage(datagramMsg); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("UDP session closed from %s, %d datagrams sent", remoteAddr, datagramsRelayed))
+}
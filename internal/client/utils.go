@@ -0,0 +1,66 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/yusuf-musleh/mmar/constants"
+	"github.com/yusuf-musleh/mmar/internal/logger"
+	"github.com/yusuf-musleh/mmar/internal/protocol"
+)
+
+// Parse labels to attach to the tunnel, in the format: "key1=value1,key2=value2"
+func parseLabels(labels string) (map[string]string, error) {
+	if labels == "" {
+		return nil, nil
+	}
+
+	parsed := map[string]string{}
+	for _, label := range strings.Split(labels, ",") {
+		key, value, ok := strings.Cut(label, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("label \"%s\" must be in the format key=value", label)
+		}
+		parsed[key] = strings.TrimSpace(value)
+	}
+	return parsed, nil
+}
+
+// Time to wait for localhost to respond to forwarded requests, as applied by mmar server
+func (mc *MmarClient) destRequestTimeout() time.Duration {
+	return limitOrDefault(mc.appliedLimits.DestRequestTimeout, constants.DEST_REQUEST_TIMEOUT)
+}
+
+// Time to wait without receiving anything from mmar server before sending it a heartbeat,
+// as applied by mmar server
+func (mc *MmarClient) heartbeatTimeout() time.Duration {
+	return limitOrDefault(mc.appliedLimits.ClientHeartbeatTimeout, constants.HEARTBEAT_FROM_CLIENT_TIMEOUT)
+}
+
+// mmar servers predating sending their limits leave them unset, so the defaults apply
+func limitOrDefault(seconds int64, defaultSeconds int64) time.Duration {
+	if seconds <= 0 {
+		seconds = defaultSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Show the limits mmar server applies to the tunnel, if it sent them
+func (mc *MmarClient) logAppliedLimits() {
+	limits := mc.appliedLimits
+	if limits == (protocol.TunnelLimits{}) {
+		return
+	}
+	logger.Log(
+		constants.DEFAULT_COLOR,
+		fmt.Sprintf(
+			"Tunnel limits: max request body size %d bytes, request body read timeout %ds, localhost response timeout %ds, heartbeat timeout %ds\n",
+			limits.MaxRequestBodySize,
+			limits.RequestBodyReadTimeout,
+			limits.DestRequestTimeout,
+			limits.ClientHeartbeatTimeout,
+		),
+	)
+}
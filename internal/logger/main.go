@@ -1,9 +1,11 @@
 package logger
 
 import (
+	"bufio"
 	"fmt"
 	"html"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 
@@ -18,18 +20,45 @@ type WrappedResponseWriter struct {
 	contentLength int64
 }
 
+func NewWrappedResponseWriter(w http.ResponseWriter) *WrappedResponseWriter {
+	return &WrappedResponseWriter{ResponseWriter: w, statusCode: http.StatusOK, contentLength: 0}
+}
+
+// Status code of the response, 200 if it was not explicitly written
+func (wrw *WrappedResponseWriter) StatusCode() int {
+	return wrw.statusCode
+}
+
 // Capture the response status code then call the actual ResponseWriter's WriteHeader
 func (wrw *WrappedResponseWriter) WriteHeader(statusCode int) {
 	wrw.statusCode = statusCode
 	wrw.ResponseWriter.WriteHeader(statusCode)
 }
 
-// Capture the response content length then call the actual ResponseWriter's Write
+// Capture the response content length then call the actual ResponseWriter's Write,
+// the content length accumulates since the response might be written in chunks
 func (wrw *WrappedResponseWriter) Write(data []byte) (int, error) {
-	wrw.contentLength = int64(len(data))
+	wrw.contentLength += int64(len(data))
 	return wrw.ResponseWriter.Write(data)
 }
 
+// Flush buffered response data to the client if supported by the actual ResponseWriter
+func (wrw *WrappedResponseWriter) Flush() {
+	if flusher, ok := wrw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack the underlying connection if supported, capturing the switch in protocols
+func (wrw *WrappedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := wrw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	wrw.statusCode = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
 func ColorLogStr(color string, logstr string) string {
 	return color + logstr + constants.RESET
 }
@@ -115,8 +144,8 @@ func LogHTTP(req *http.Request, statusCode int, contentLength int64, includeSubd
 func LoggerMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Initializing WrappedResponseWrapper with default values
-		wrw := WrappedResponseWriter{ResponseWriter: w, statusCode: http.StatusOK, contentLength: 0}
-		h.ServeHTTP(&wrw, r)
+		wrw := NewWrappedResponseWriter(w)
+		h.ServeHTTP(wrw, r)
 		LogHTTP(r, wrw.statusCode, wrw.contentLength, true, false)
 	})
 }
@@ -196,3 +225,23 @@ A mmar tunnel is now open on:
 		localPort,
 	)
 }
+
+// Log tunnels exposed on a public port rather than a subdomain, such as TCP/UDP tunnels
+func LogPortTunnelCreated(tunnelType string, tunnelHost string, publicPort string, localPort string) {
+	logStr := `%s
+
+A mmar tunnel is now open on:
+
+>>>  %s://%s:%s %s localhost:%s
+
+`
+	log.Printf(
+		logStr,
+		ColorLogStr(constants.GREEN, "Tunnel created successfully!"),
+		tunnelType,
+		tunnelHost,
+		publicPort,
+		ColorLogStr(constants.GREEN, "->"),
+		localPort,
+	)
+}
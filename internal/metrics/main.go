@@ -0,0 +1,283 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Content type of metrics written in the Prometheus text exposition format
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Default buckets of latency histograms, in seconds
+var DEFAULT_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Separates label values in the keys of series, it cannot appear in valid UTF-8
+const labelValuesSeparator = "\xff"
+
+// Metrics registered to be exposed together
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// A metric and its series, one for each combination of label values it was
+// recorded with
+type metric struct {
+	mu         sync.Mutex
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+	buckets    []float64
+	series     map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	// Value of counters and gauges, or sum of the observations of histograms
+	value float64
+	// Observations of histograms per bucket, not cumulative
+	bucketCounts []uint64
+	count        uint64
+}
+
+type Counter struct{ *metric }
+type Gauge struct{ *metric }
+type Histogram struct{ *metric }
+
+func (r *Registry) register(name string, help string, metricType string, buckets []float64, labelNames []string) *metric {
+	m := &metric{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     map[string]*series{},
+	}
+
+	// Metrics without labels are exposed even before they are recorded
+	if len(labelNames) == 0 {
+		m.seriesOf(nil)
+	}
+
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+	return m
+}
+
+// Register a counter, a value that only goes up
+func (r *Registry) NewCounter(name string, help string, labelNames ...string) Counter {
+	return Counter{r.register(name, help, "counter", nil, labelNames)}
+}
+
+// Register a gauge, a value that can go up and down
+func (r *Registry) NewGauge(name string, help string, labelNames ...string) Gauge {
+	return Gauge{r.register(name, help, "gauge", nil, labelNames)}
+}
+
+// Register a histogram, counting observations in buckets by their upper bounds
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) Histogram {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	return Histogram{r.register(name, help, "histogram", buckets, labelNames)}
+}
+
+// Retrieve the series of the label values, creating it if it does not exist. Callers
+// must hold the lock.
+func (m *metric) seriesOf(labelValues []string) *series {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, labelValuesSeparator)
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: slices.Clone(labelValues)}
+		if m.buckets != nil {
+			s.bucketCounts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Remove all series recorded with the value for the label, such as ones of a tunnel
+// that was closed, so they do not pile up
+func (m *metric) DeleteLabel(labelName string, labelValue string) {
+	index := slices.Index(m.labelNames, labelName)
+	if index == -1 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, s := range m.series {
+		if s.labelValues[index] == labelValue {
+			delete(m.series, key)
+		}
+	}
+}
+
+func (c Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Increase the counter, negative values are ignored since counters only go up
+func (c Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	c.mu.Lock()
+	c.seriesOf(labelValues).value += value
+	c.mu.Unlock()
+}
+
+func (g Gauge) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	g.seriesOf(labelValues).value = value
+	g.mu.Unlock()
+}
+
+func (g Gauge) Add(value float64, labelValues ...string) {
+	g.mu.Lock()
+	g.seriesOf(labelValues).value += value
+	g.mu.Unlock()
+}
+
+func (h Histogram) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.seriesOf(labelValues)
+	s.value += value
+	s.count++
+	// Observations above the largest bucket are only counted in +Inf
+	if i, _ := slices.BinarySearch(h.buckets, value); i < len(h.buckets) {
+		s.bucketCounts[i]++
+	}
+}
+
+// Write all the registered metrics in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, m := range metrics {
+		m.writeTo(cw)
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+func (m *metric) writeTo(w *countingWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.metricType)
+
+	// Series are sorted so they are always written in the same order
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		if m.metricType != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labelNames, s.labelValues, "", ""), formatValue(s.value))
+			continue
+		}
+
+		// Buckets are cumulative, each counting observations less than or equal to its bound
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += s.bucketCounts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labelNames, s.labelValues, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labelNames, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labelNames, s.labelValues, "", ""), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labelNames, s.labelValues, "", ""), s.count)
+	}
+}
+
+// Format labels as {name="value",...}, with an extra label such as the bucket bound
+// of histograms if provided
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, "%s=\"%s\"", name, escapeLabelValue(values[i]))
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, "%s=\"%s\"", extraName, extraValue)
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+// Count the bytes written, keeping the first error so the rest of the writes are skipped
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/yusuf-musleh/mmar/constants"
+)
+
+// Size of the pooled buffers, fitting a chunk of data along with the RequestId it is for
+const pooledBufferSize = constants.REQUEST_ID_BUFF_SIZE + constants.BODY_CHUNK_SIZE
+
+// Buffers chunks of data are read into, either from the tunnel connection or to be sent
+// over it, are pooled so tunnels streaming data do not allocate a buffer for every chunk
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, pooledBufferSize)
+		return &buf
+	},
+}
+
+func getPooledBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+func putPooledBuffer(buf *[]byte) {
+	bufferPool.Put(buf)
+}
+
+// Pooled buffer to read a chunk of data of a request (or stream) into, with its RequestId
+// already in place ahead of it, so the chunk is sent without being copied into a new
+// message. It must be released once it is no longer used.
+type RequestIdBuffer struct {
+	buf *[]byte
+}
+
+func NewRequestIdBuffer(reqId uint32) RequestIdBuffer {
+	buf := getPooledBuffer()
+	binary.LittleEndian.PutUint32(*buf, reqId)
+	return RequestIdBuffer{buf: buf}
+}
+
+// Room to read a chunk of up to BODY_CHUNK_SIZE bytes into
+func (rb RequestIdBuffer) Data() []byte {
+	return (*rb.buf)[constants.REQUEST_ID_BUFF_SIZE:]
+}
+
+// Message data carrying the first n bytes of the chunk, valid until the buffer is released
+func (rb RequestIdBuffer) MsgData(n int) []byte {
+	return (*rb.buf)[:constants.REQUEST_ID_BUFF_SIZE+n]
+}
+
+func (rb RequestIdBuffer) Release() {
+	putPooledBuffer(rb.buf)
+}
@@ -0,0 +1,51 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/yusuf-musleh/mmar/constants"
+)
+
+var INVALID_MESSAGE_LENGTH = errors.New("Invalid Tunnel Message Length")
+var MESSAGE_TOO_LARGE = errors.New("Tunnel Message exceeds the max frame size")
+var TOO_MANY_MALFORMED_MESSAGES = errors.New("Too many malformed Tunnel Messages received")
+
+// Error of a malformed message received over the tunnel, wrapping the reason it was
+// rejected for (eg: INVALID_MESSAGE_LENGTH)
+type ProtocolError struct {
+	Err error
+	// What was received instead, to log along with the error
+	Received string
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Received == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v: %s", e.Err, e.Received)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// Malformed messages skipped on a tunnel connection within the current interval. Peers
+// sending more than MAX_MALFORMED_MESSAGES of them within MALFORMED_MESSAGES_INTERVAL
+// are either broken or hostile, so their connection is not worth reading from anymore.
+type malformedMessages struct {
+	intervalStart time.Time
+	count         int
+}
+
+// Record a malformed message, returns false once there were too many of them. Only used
+// by the goroutine receiving messages, so it is not synchronized.
+func (mm *malformedMessages) record() bool {
+	now := time.Now()
+	if now.Sub(mm.intervalStart) >= constants.MALFORMED_MESSAGES_INTERVAL*time.Second {
+		mm.intervalStart, mm.count = now, 0
+	}
+	mm.count++
+	return mm.count <= constants.MAX_MALFORMED_MESSAGES
+}
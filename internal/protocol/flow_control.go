@@ -0,0 +1,233 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/yusuf-musleh/mmar/constants"
+)
+
+var STREAM_WINDOW_EXCEEDED = errors.New("Stream data exceeded flow control window")
+var INVALID_WINDOW_UPDATE = errors.New("Invalid Window Update in Tunnel Message")
+
+// Streams sharing the tunnel connection are flow controlled individually, similar to
+// HTTP/2. A sender can only have up to STREAM_WINDOW_SIZE bytes of data in flight on a
+// stream, which the receiver buffers without blocking the tunnel. As the receiver consumes
+// the buffered data, it grants the sender more with WINDOW_UPDATE messages:
+//
+// +------------+-------------------------+
+// | RequestId  | Window Increment        |
+// | (4 bytes)  | (4 bytes)               |
+// +------------+-------------------------+
+func WindowUpdateMsgData(reqId uint32, increment int) []byte {
+	incrementBuff := make([]byte, constants.WINDOW_INCREMENT_BUFF_SIZE)
+	binary.LittleEndian.PutUint32(incrementBuff, uint32(increment))
+	return RequestIdMsgData(reqId, incrementBuff)
+}
+
+// Extract the RequestId of the stream and the increment to its window
+func ExtractWindowUpdate(msgData []byte) (uint32, int, error) {
+	reqId, data, err := ExtractRequestId(msgData)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(data) != constants.WINDOW_INCREMENT_BUFF_SIZE {
+		return 0, 0, INVALID_WINDOW_UPDATE
+	}
+	return reqId, int(binary.LittleEndian.Uint32(data)), nil
+}
+
+// Window of data that can be sent on a stream before the receiver grants more
+type SendWindow struct {
+	mu        sync.Mutex
+	available int
+	// Closed and replaced whenever the window is updated, to wake up waiting senders
+	updated chan struct{}
+}
+
+func NewSendWindow() *SendWindow {
+	return &SendWindow{
+		available: constants.STREAM_WINDOW_SIZE,
+		updated:   make(chan struct{}),
+	}
+}
+
+// Wait until the window has room for n bytes and reserve them, n must not exceed
+// the size of the window
+func (sw *SendWindow) Acquire(ctx context.Context, n int) error {
+	for {
+		sw.mu.Lock()
+		if sw.available >= n {
+			sw.available -= n
+			sw.mu.Unlock()
+			return nil
+		}
+		updated := sw.updated
+		sw.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-updated:
+		}
+	}
+}
+
+// Reserve n bytes if the window has room for them without waiting
+func (sw *SendWindow) TryAcquire(n int) bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.available < n {
+		return false
+	}
+	sw.available -= n
+	return true
+}
+
+// Grant more room in the window once the receiver consumed data
+func (sw *SendWindow) Update(increment int) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.available += increment
+	close(sw.updated)
+	sw.updated = make(chan struct{})
+}
+
+// Chunk of data buffered on a stream, along with how to release the buffer it is in once
+// it is consumed
+type streamChunk struct {
+	data    []byte
+	release func()
+}
+
+// Buffer of data received on a stream, writing to it never blocks so the tunnel keeps
+// receiving messages for other streams while this one is consumed. Each read returns
+// data from a single write at most, so message boundaries (eg: UDP datagrams) are kept
+// as long as the read buffer is large enough.
+type StreamBuffer struct {
+	mu       sync.Mutex
+	chunks   []streamChunk
+	buffered int
+	// Consumed data the sender has not been granted back yet
+	consumed int
+	closed   bool
+	err      error
+	// Closed and replaced whenever the buffer changes, to wake up waiting readers
+	changed chan struct{}
+	// Grants the sender more room in its window, once enough data is consumed
+	sendWindowUpdate func(increment int)
+}
+
+func NewStreamBuffer(sendWindowUpdate func(increment int)) *StreamBuffer {
+	return &StreamBuffer{
+		changed:          make(chan struct{}),
+		sendWindowUpdate: sendWindowUpdate,
+	}
+}
+
+func (sb *StreamBuffer) notify() {
+	close(sb.changed)
+	sb.changed = make(chan struct{})
+}
+
+// Buffer data received on the stream without copying it, so it must not be modified
+// afterwards. If set, release is called once the data is consumed or discarded, including
+// right away when it cannot be buffered.
+func (sb *StreamBuffer) Write(data []byte, release func()) error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	if sb.closed || sb.buffered+len(data) > constants.STREAM_WINDOW_SIZE {
+		if release != nil {
+			release()
+		}
+		if sb.closed {
+			return io.ErrClosedPipe
+		}
+		return STREAM_WINDOW_EXCEEDED
+	}
+
+	sb.chunks = append(sb.chunks, streamChunk{data: data, release: release})
+	sb.buffered += len(data)
+	sb.notify()
+	return nil
+}
+
+func (sb *StreamBuffer) Read(p []byte) (int, error) {
+	sb.mu.Lock()
+	for len(sb.chunks) == 0 && !sb.closed {
+		changed := sb.changed
+		sb.mu.Unlock()
+		<-changed
+		sb.mu.Lock()
+	}
+
+	if sb.err != nil {
+		sb.mu.Unlock()
+		return 0, sb.err
+	}
+	if len(sb.chunks) == 0 {
+		sb.mu.Unlock()
+		return 0, io.EOF
+	}
+
+	n := copy(p, sb.chunks[0].data)
+	if n == len(sb.chunks[0].data) {
+		if sb.chunks[0].release != nil {
+			sb.chunks[0].release()
+		}
+		sb.chunks[0] = streamChunk{}
+		sb.chunks = sb.chunks[1:]
+	} else {
+		sb.chunks[0].data = sb.chunks[0].data[n:]
+	}
+	sb.buffered -= n
+
+	// Grant the consumed data back in batches, to avoid a window update for every read
+	var increment int
+	sb.consumed += n
+	if sb.consumed >= constants.STREAM_WINDOW_SIZE/2 {
+		increment = sb.consumed
+		sb.consumed = 0
+	}
+	sb.mu.Unlock()
+
+	if increment > 0 && sb.sendWindowUpdate != nil {
+		sb.sendWindowUpdate(increment)
+	}
+	return n, nil
+}
+
+// Close the stream once all data is received, reads return io.EOF after the buffered
+// data is consumed
+func (sb *StreamBuffer) Close() error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if !sb.closed {
+		sb.closed = true
+		sb.notify()
+	}
+	return nil
+}
+
+// Close the stream discarding any buffered data, reads return the error right away
+func (sb *StreamBuffer) CloseWithError(err error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.err != nil {
+		return
+	}
+	sb.closed = true
+	sb.err = err
+	for _, chunk := range sb.chunks {
+		if chunk.release != nil {
+			chunk.release()
+		}
+	}
+	sb.chunks = nil
+	sb.buffered = 0
+	sb.notify()
+}
@@ -2,13 +2,12 @@ package protocol
 
 import (
 	"bufio"
-	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"net/http"
 	"strconv"
 	"time"
 
@@ -36,15 +35,35 @@ const (
 	AUTH_TOKEN_REQUIRED
 	AUTH_TOKEN_INVALID
 	AUTH_TOKEN_LIMIT_EXCEEDED
+	REQUEST_BODY_CHUNK
+	REQUEST_BODY_END
+	RESPONSE_BODY_CHUNK
+	RESPONSE_BODY_END
+	RESPONSE_BODY_ABORT
+	REQUEST_CANCELED
+	STREAM_DATA
+	STREAM_CLOSE
+	STREAM_OPEN
+	TUNNEL_TYPE_UNSUPPORTED
+	TUNNEL_PORTS_EXHAUSTED
+	UDP_SESSION_OPEN
+	UDP_DATAGRAM
+	UDP_SESSION_CLOSE
+	WINDOW_UPDATE
+	HELLO
+	HELLO_ACK
+	CLIENT_CERT_INVALID
+	TUNNEL_CLOSED
 )
 
 var INVALID_MESSAGE_PROTOCOL_VERSION = errors.New("Invalid Message Protocol Version")
 var INVALID_MESSAGE_TYPE = errors.New("Invalid Tunnel Message Type")
+var INVALID_REQUEST_ID = errors.New("Invalid Request Id in Tunnel Message")
 
 func isValidTunnelMessageType(mt uint8) (uint8, error) {
 	// Iterate through all the message type, from first to last, checking
 	// if the provided message type matches one of them
-	for msgType := REQUEST; msgType <= AUTH_TOKEN_LIMIT_EXCEEDED; msgType++ {
+	for msgType := REQUEST; msgType <= TUNNEL_CLOSED; msgType++ {
 		if mt == msgType {
 			return msgType, nil
 		}
@@ -53,42 +72,32 @@ func isValidTunnelMessageType(mt uint8) (uint8, error) {
 	return 0, INVALID_MESSAGE_TYPE
 }
 
-func TunnelErrState(errState uint8) string {
-	// TODO: Have nicer/more elaborative error messages/pages
-	errStates := map[uint8]string{
-		CLIENT_DISCONNECT:         constants.CLIENT_DISCONNECT_ERR_TEXT,
-		LOCALHOST_NOT_RUNNING:     constants.LOCALHOST_NOT_RUNNING_ERR_TEXT,
-		DEST_REQUEST_TIMEDOUT:     constants.DEST_REQUEST_TIMEDOUT_ERR_TEXT,
-		INVALID_RESP_FROM_DEST:    constants.READ_RESP_BODY_ERR_TEXT,
-		INVALID_SUBDOMAIN_NAME:    constants.INVALID_SUBDOMAIN_NAME_ERR_TEXT,
-		SUBDOMAIN_ALREADY_TAKEN:   constants.SUBDOMAIN_ALREADY_TAKEN_ERR_TEXT,
-		AUTH_TOKEN_REQUIRED:       constants.AUTH_TOKEN_REQUIRED_ERR_TEXT,
-		AUTH_TOKEN_INVALID:        constants.AUTH_TOKEN_INVALID_ERR_TEXT,
-		AUTH_TOKEN_LIMIT_EXCEEDED: constants.AUTH_TOKEN_LIMIT_EXCEEDED_ERR_TEXT,
-	}
-	fallbackErr := "An error occured while attempting to tunnel."
-
-	tunnelErr, ok := errStates[errState]
-	if !ok {
-		tunnelErr = fallbackErr
-	}
-	return tunnelErr
-}
-
-func RespondTunnelErr(errState uint8, w http.ResponseWriter) {
-	errBody := TunnelErrState(errState)
-
-	w.Header().Set("Content-Length", strconv.Itoa(len(errBody)))
-	w.Header().Set("Connection", "close")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(errBody))
-}
-
+// Tunnels are created with NewTunnel, which starts the writer of their connection
 type Tunnel struct {
 	Id        string
 	Conn      net.Conn
 	CreatedOn time.Time
 	Reader    *bufio.Reader
+	// Protocol version and features negotiated with the other side of the tunnel,
+	// messages are sent with the negotiated version once there is one
+	Version  uint8
+	Features []string
+	// Largest message data read from the connection, MAX_FRAME_SIZE if not set
+	MaxFrameSize int
+	// Writes messages to the connection, shared by all copies of the tunnel
+	writer *tunnelWriter
+	// Malformed messages received on the connection, shared by all copies of the tunnel
+	malformedMessages *malformedMessages
+}
+
+func NewTunnel(conn net.Conn) Tunnel {
+	return Tunnel{
+		Conn:              conn,
+		CreatedOn:         time.Now(),
+		Reader:            bufio.NewReader(conn),
+		writer:            newTunnelWriter(conn),
+		malformedMessages: &malformedMessages{},
+	}
 }
 
 type TunnelInterface interface {
@@ -98,6 +107,53 @@ type TunnelInterface interface {
 type TunnelMessage struct {
 	MsgType uint8
 	MsgData []byte
+	// Protocol version the message was received with
+	Version uint8
+	// Pooled buffer the data of a received chunk was read into, see Release
+	buffer *[]byte
+}
+
+// Return the pooled buffer the data of the message was read into, once it is no longer
+// used. Only chunks of data of requests and streams are read into pooled buffers, other
+// messages are left to the garbage collector, so it is not required to release them.
+func (tm *TunnelMessage) Release() {
+	if tm.buffer != nil {
+		putPooledBuffer(tm.buffer)
+		tm.buffer = nil
+		tm.MsgData = nil
+	}
+}
+
+// Messages related to a tunneled request are keyed by its RequestId, which
+// prefixes the message data. A REQUEST/RESPONSE message only carries the
+// request/response line and headers, the body is then streamed separately
+// in REQUEST_BODY_CHUNK/RESPONSE_BODY_CHUNK messages until a
+// REQUEST_BODY_END/RESPONSE_BODY_END message is sent. When a response switches
+// protocols (eg: websockets), the connection turns into a raw bidirectional
+// stream, where STREAM_DATA messages carry bytes in both directions until
+// either side sends STREAM_CLOSE. Connections accepted by TCP tunnels are
+// streamed the same way, after the mmar server sends STREAM_OPEN. UDP tunnels
+// relay each datagram in a UDP_DATAGRAM message, keyed by the session of its
+// source address, which starts with UDP_SESSION_OPEN and lasts until either
+// side sends UDP_SESSION_CLOSE:
+//
+// +------------+-------------------------+
+// | RequestId  | Data                    |
+// | (4 bytes)  | (Variable Length)       |
+// +------------+-------------------------+
+func RequestIdMsgData(reqId uint32, data []byte) []byte {
+	msgData := make([]byte, constants.REQUEST_ID_BUFF_SIZE, constants.REQUEST_ID_BUFF_SIZE+len(data))
+	binary.LittleEndian.PutUint32(msgData, reqId)
+	return append(msgData, data...)
+}
+
+// Extract the RequestId a message is keyed by along with the rest of its data
+func ExtractRequestId(msgData []byte) (uint32, []byte, error) {
+	if len(msgData) < constants.REQUEST_ID_BUFF_SIZE {
+		return 0, nil, INVALID_REQUEST_ID
+	}
+	reqId := binary.LittleEndian.Uint32(msgData[:constants.REQUEST_ID_BUFF_SIZE])
+	return reqId, msgData[constants.REQUEST_ID_BUFF_SIZE:], nil
 }
 
 // A TunnelMessage is serialized in the following format:
@@ -106,55 +162,69 @@ type TunnelMessage struct {
 // | Version | Msg Type   | Length of Msg Data  | Delimiter  | Message Data            |
 // | (1 byte)| (1 byte)   | (1 or more bytes)   | (1 byte)   | (Variable Length)       |
 // +---------+------------+---------------------+------------+-------------------------+
-func (tm *TunnelMessage) serializeMessage() ([]byte, error) {
-	serializedMsg := [][]byte{}
-
+//
+// The header, everything ahead of the message data, is appended to dst, so the message
+// data is written after it as is, without copying it
+func (tm *TunnelMessage) serializeHeader(dst []byte, version uint8) ([]byte, error) {
 	// Determine and validate message type to add prefix
 	msgType, err := isValidTunnelMessageType(tm.MsgType)
 	if err != nil {
 		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Invalid TunnelMessage type: %v:", tm.MsgType))
-		return []byte{}, err
+		return dst, err
 	}
 
 	// Add version of TunnelMessage protocol and TunnelMessage type
-	serializedMsg = append(
-		serializedMsg,
-		[]byte{byte(constants.TUNNEL_MESSAGE_PROTOCOL_VERSION), byte(msgType)},
-	)
+	dst = append(dst, byte(version), byte(msgType))
 
 	// Add message data bytes length
-	serializedMsg = append(serializedMsg, []byte(strconv.Itoa(len(tm.MsgData))))
+	dst = strconv.AppendInt(dst, int64(len(tm.MsgData)), 10)
 
 	// Add delimiter to know where the data content starts in the message
-	serializedMsg = append(serializedMsg, []byte{byte(constants.TUNNEL_MESSAGE_DATA_DELIMITER)})
-
-	// Add the message data
-	serializedMsg = append(serializedMsg, tm.MsgData)
+	return append(dst, byte(constants.TUNNEL_MESSAGE_DATA_DELIMITER)), nil
+}
 
-	// Combine all the data with no separators
-	return bytes.Join(serializedMsg, nil), nil
+// Chunks of data of requests and streams are read into pooled buffers, since they are
+// only buffered until they are consumed. Small chunks (eg: UDP datagrams) are not, so
+// buffering many of them does not hold on to much larger buffers.
+func isPooledMessage(msgType uint8, length int) bool {
+	switch msgType {
+	case REQUEST_BODY_CHUNK, RESPONSE_BODY_CHUNK, STREAM_DATA, UDP_DATAGRAM:
+		return length > pooledBufferSize/2 && length <= pooledBufferSize
+	}
+	return false
 }
 
-func (tm *TunnelMessage) readMessageData(length int, reader *bufio.Reader) ([]byte, error) {
-	msgData := make([]byte, length)
+func (tm *TunnelMessage) readMessageData(length int, reader *bufio.Reader) error {
+	var msgData []byte
+	if isPooledMessage(tm.MsgType, length) {
+		tm.buffer = getPooledBuffer()
+		msgData = (*tm.buffer)[:length]
+	} else {
+		msgData = make([]byte, length)
+	}
 
 	if _, err := io.ReadFull(reader, msgData); err != nil {
 		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to read all Msg Data: %v", err))
-		return []byte{}, err
+		tm.Release()
+		return err
 	}
 
-	return msgData, nil
+	tm.MsgData = msgData
+	return nil
 }
 
-func (tm *TunnelMessage) deserializeMessage(reader *bufio.Reader) error {
+// Read the next message, rejecting malformed ones, and ones with data larger than
+// maxFrameSize, with a ProtocolError. The rest of a rejected message is left unread, so
+// where the next message starts is unknown and the connection cannot be read any further.
+func (tm *TunnelMessage) deserializeMessage(reader *bufio.Reader, maxFrameSize int) error {
 	msgProtocolVersion, err := reader.ReadByte()
 	if err != nil {
 		return err
 	}
 
-	// Check if the message protocol version is correct
-	if uint8(msgProtocolVersion) != constants.TUNNEL_MESSAGE_PROTOCOL_VERSION {
-		return INVALID_MESSAGE_PROTOCOL_VERSION
+	// Check if the message protocol version is supported
+	if !isSupportedVersion(uint8(msgProtocolVersion)) {
+		return &ProtocolError{Err: INVALID_MESSAGE_PROTOCOL_VERSION, Received: strconv.Itoa(int(msgProtocolVersion))}
 	}
 
 	msgPrefix, err := reader.ReadByte()
@@ -164,51 +234,83 @@ func (tm *TunnelMessage) deserializeMessage(reader *bufio.Reader) error {
 
 	msgType, err := isValidTunnelMessageType(msgPrefix)
 	if err != nil {
-		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Invalid TunnelMessage prefix: %v", msgPrefix))
-		return err
+		return &ProtocolError{Err: err, Received: strconv.Itoa(int(msgPrefix))}
 	}
 
-	msgLengthStr, err := reader.ReadString('\n')
-	if err != nil {
+	// The length is read without copying it out of the reader's buffer
+	msgLengthBytes, err := reader.ReadSlice(constants.TUNNEL_MESSAGE_DATA_DELIMITER)
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return &ProtocolError{Err: INVALID_MESSAGE_LENGTH, Received: fmt.Sprintf("%.32q...", msgLengthBytes)}
+	} else if err != nil {
 		return err
 	}
 
 	// Determine the length of the data by stripping out the '\n' and convert to int
-	msgLength, err := strconv.Atoi(msgLengthStr[:len(msgLengthStr)-1])
-	if err != nil {
-		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Could not parse message length: %v", msgLengthStr))
-		return err
+	msgLength, err := strconv.ParseInt(string(msgLengthBytes[:len(msgLengthBytes)-1]), 10, 64)
+	if err != nil || msgLength < 0 {
+		return &ProtocolError{Err: INVALID_MESSAGE_LENGTH, Received: fmt.Sprintf("%.32q", msgLengthBytes)}
 	}
 
-	msgData, readErr := tm.readMessageData(msgLength, reader)
-	if readErr != nil {
-		return readErr
+	if msgLength > int64(maxFrameSize) {
+		return &ProtocolError{Err: MESSAGE_TOO_LARGE, Received: strconv.FormatInt(msgLength, 10)}
 	}
 
 	tm.MsgType = msgType
-	tm.MsgData = msgData
-
-	return nil
+	tm.Version = uint8(msgProtocolVersion)
+	return tm.readMessageData(int(msgLength), reader)
 }
 
 func (t *Tunnel) ReservedSubdomain() bool {
 	return t.Id != ""
 }
 
+// Send the message and wait until it is written, its data is no longer used once this
+// returns, so the buffer it is in can be reused right away
 func (t *Tunnel) SendMessage(tunnelMsg TunnelMessage) error {
-	// Serialize tunnel message data
-	serializedMsg, serializeErr := tunnelMsg.serializeMessage()
-	if serializeErr != nil {
-		return serializeErr
+	return t.writer.send(tunnelMsg, t.messageVersion(tunnelMsg))
+}
+
+// Queue the control message without waiting until it is written, failing if too many are
+// already queued. Used to reply from the loop receiving messages, so it never blocks on a
+// peer that is itself blocked writing to us.
+func (t *Tunnel) PostMessage(tunnelMsg TunnelMessage) error {
+	return t.writer.post(tunnelMsg, t.messageVersion(tunnelMsg))
+}
+
+func (t *Tunnel) messageVersion(tunnelMsg TunnelMessage) uint8 {
+	// Negotiation messages are always sent with the version that introduced them, so both
+	// sides can read them regardless of the versions they support
+	if t.Version == 0 || tunnelMsg.MsgType == HELLO || tunnelMsg.MsgType == HELLO_ACK {
+		return constants.HELLO_MESSAGE_PROTOCOL_VERSION
 	}
-	_, err := t.Conn.Write(serializedMsg)
-	return err
+	return t.Version
+}
+
+// Stop writing messages and close the connection
+func (t *Tunnel) Close() error {
+	t.writer.close(TUNNEL_CONNECTION_CLOSED)
+	return t.Conn.Close()
 }
 
 func (t *Tunnel) ReceiveMessage() (TunnelMessage, error) {
+	maxFrameSize := t.MaxFrameSize
+	if maxFrameSize == 0 {
+		maxFrameSize = constants.MAX_FRAME_SIZE
+	}
+
 	// Read and deserialize tunnel message data
 	tunnelMessage := TunnelMessage{}
-	deserializeErr := tunnelMessage.deserializeMessage(t.Reader)
+	deserializeErr := tunnelMessage.deserializeMessage(t.Reader, maxFrameSize)
 
 	return tunnelMessage, deserializeErr
 }
+
+// Record a message that was read in full but cannot be handled (eg: data of a request
+// received before any tunnel is created), so it is skipped. Returns
+// TOO_MANY_MALFORMED_MESSAGES once the other side sent too many of them.
+func (t *Tunnel) RecordMalformedMessage() error {
+	if t.malformedMessages != nil && !t.malformedMessages.record() {
+		return TOO_MANY_MALFORMED_MESSAGES
+	}
+	return nil
+}
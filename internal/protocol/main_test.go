@@ -0,0 +1,202 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/yusuf-musleh/mmar/constants"
+)
+
+var benchmarkMsgSizes = []int{100, 1_000, constants.BODY_CHUNK_SIZE, 1_000_000, 10_000_000}
+
+func benchmarkSizeName(size int) string {
+	switch {
+	case size >= 1_000_000:
+		return fmt.Sprintf("%dMB", size/1_000_000)
+	case size >= 1_000:
+		return fmt.Sprintf("%dKB", size/1_000)
+	}
+	return fmt.Sprintf("%dB", size)
+}
+
+// Tunnel over a loopback TCP connection, whose other end discards everything written to it
+func newDiscardingTunnel(b *testing.B) Tunnel {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatalf("Failed to dial: %v", err)
+	}
+	tunnel := NewTunnel(conn)
+	tunnel.Version = constants.TUNNEL_MESSAGE_PROTOCOL_VERSION
+	b.Cleanup(func() { tunnel.Close() })
+	return tunnel
+}
+
+// Reads the same serialized messages over and over again
+type repeatingReader struct {
+	data   []byte
+	offset int
+}
+
+func (r *repeatingReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.offset:])
+	r.offset = (r.offset + n) % len(r.data)
+	return n, nil
+}
+
+func BenchmarkSendMessage(b *testing.B) {
+	for _, size := range benchmarkMsgSizes {
+		b.Run(benchmarkSizeName(size), func(b *testing.B) {
+			tunnel := newDiscardingTunnel(b)
+			msg := TunnelMessage{
+				MsgType: RESPONSE_BODY_CHUNK,
+				MsgData: RequestIdMsgData(1, make([]byte, size)),
+			}
+
+			b.SetBytes(int64(len(msg.MsgData)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := tunnel.SendMessage(msg); err != nil {
+					b.Fatalf("Failed to send message: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReceiveMessage(b *testing.B) {
+	for _, size := range benchmarkMsgSizes {
+		b.Run(benchmarkSizeName(size), func(b *testing.B) {
+			msgData := RequestIdMsgData(1, make([]byte, size))
+			serializedMsg := fmt.Appendf(
+				nil, "%c%c%d%c",
+				constants.TUNNEL_MESSAGE_PROTOCOL_VERSION, RESPONSE_BODY_CHUNK,
+				len(msgData), constants.TUNNEL_MESSAGE_DATA_DELIMITER,
+			)
+			serializedMsg = append(serializedMsg, msgData...)
+			tunnel := Tunnel{Reader: bufio.NewReader(&repeatingReader{data: serializedMsg})}
+
+			b.SetBytes(int64(len(msgData)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				msg, err := tunnel.ReceiveMessage()
+				if err != nil {
+					b.Fatalf("Failed to receive message: %v", err)
+				}
+				if len(msg.MsgData) != len(msgData) {
+					b.Fatalf("Received %d bytes of data, expected %d", len(msg.MsgData), len(msgData))
+				}
+				msg.Release()
+			}
+		})
+	}
+}
+
+// Max frame size messages are fuzzed with, small enough to exercise oversized messages
+const fuzzMaxFrameSize = 1024
+
+func FuzzDeserializeMessage(f *testing.F) {
+	version := byte(constants.TUNNEL_MESSAGE_PROTOCOL_VERSION)
+	f.Add([]byte{version, HEARTBEAT_ACK, '0', '\n'})
+	f.Add(append([]byte{version, RESPONSE_BODY_CHUNK, '8', '\n'}, RequestIdMsgData(1, []byte("data"))...))
+	f.Add([]byte{version, RESPONSE_BODY_CHUNK, '-', '5', '\n'})
+	f.Add([]byte{version, REQUEST, '9', '9', '9', '9', '9', '9', '9', '9', '9', '9', '9', '9', '9', '9', '9', '9', '9', '9', '9', '9', '\n'})
+	f.Add(append([]byte{version, STREAM_DATA, '1', '0', '2', '5', '\n'}, make([]byte, fuzzMaxFrameSize+1)...))
+	f.Add([]byte{0, 0, '\n'})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := bufio.NewReader(bytes.NewReader(data))
+		for {
+			var msg TunnelMessage
+			err := msg.deserializeMessage(reader, fuzzMaxFrameSize)
+
+			var protocolErr *ProtocolError
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return
+			} else if errors.As(err, &protocolErr) {
+				// Nothing following a malformed message can be read
+				return
+			} else if err != nil {
+				t.Fatalf("deserialize = %v; want a protocol error or EOF", err)
+			}
+			if len(msg.MsgData) > fuzzMaxFrameSize {
+				t.Fatalf("deserialized %d bytes of data; want at most %d", len(msg.MsgData), fuzzMaxFrameSize)
+			}
+
+			// Messages read are serialized back the same way
+			header, err := msg.serializeHeader(nil, msg.Version)
+			if err != nil {
+				t.Fatalf("serialize = %v; want nil", err)
+			}
+			var roundTripped TunnelMessage
+			roundTripReader := bufio.NewReader(bytes.NewReader(append(header, msg.MsgData...)))
+			if err := roundTripped.deserializeMessage(roundTripReader, fuzzMaxFrameSize); err != nil {
+				t.Fatalf("deserialize serialized message = %v; want nil", err)
+			}
+			if roundTripped.MsgType != msg.MsgType || roundTripped.Version != msg.Version || !bytes.Equal(roundTripped.MsgData, msg.MsgData) {
+				t.Fatalf("round tripped message = %+v; want %+v", roundTripped, msg)
+			}
+			msg.Release()
+			roundTripped.Release()
+		}
+	})
+}
+
+func FuzzSerializeMessage(f *testing.F) {
+	f.Add(REQUEST, []byte("GET / HTTP/1.1\n"))
+	f.Add(RESPONSE_BODY_CHUNK, RequestIdMsgData(1, make([]byte, constants.BODY_CHUNK_SIZE)))
+	f.Add(uint8(0), []byte{})
+	f.Add(uint8(255), []byte("data"))
+
+	f.Fuzz(func(t *testing.T, msgType uint8, msgData []byte) {
+		msg := TunnelMessage{MsgType: msgType, MsgData: msgData}
+		header, err := msg.serializeHeader(nil, constants.TUNNEL_MESSAGE_PROTOCOL_VERSION)
+		if _, validErr := isValidTunnelMessageType(msgType); validErr != nil {
+			if !errors.Is(err, INVALID_MESSAGE_TYPE) {
+				t.Fatalf("serialize invalid type %d = %v; want %v", msgType, err, INVALID_MESSAGE_TYPE)
+			}
+			return
+		} else if err != nil {
+			t.Fatalf("serialize = %v; want nil", err)
+		}
+
+		// Messages are only read if they fit in the max frame size
+		var deserialized TunnelMessage
+		reader := bufio.NewReader(bytes.NewReader(append(header, msgData...)))
+		err = deserialized.deserializeMessage(reader, fuzzMaxFrameSize)
+		if len(msgData) > fuzzMaxFrameSize {
+			if !errors.Is(err, MESSAGE_TOO_LARGE) {
+				t.Fatalf("deserialize oversized message = %v; want %v", err, MESSAGE_TOO_LARGE)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("deserialize = %v; want nil", err)
+		}
+		if deserialized.MsgType != msgType || !bytes.Equal(deserialized.MsgData, msgData) {
+			t.Fatalf("deserialized message = %+v; want type %d with data %q", deserialized, msgType, msgData)
+		}
+		deserialized.Release()
+	})
+}
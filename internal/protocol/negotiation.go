@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"encoding/json"
+	"slices"
+
+	"github.com/yusuf-musleh/mmar/constants"
+)
+
+// Before creating or reclaiming a tunnel, mmar client sends a HELLO message advertising
+// the protocol versions and features it supports. mmar server replies with HELLO_ACK,
+// settling on the highest version both sides support (or 0 if there is none) and the
+// features both sides support. The message data of both is JSON encoded.
+type Hello struct {
+	Versions []int    `json:"versions"`
+	Features []string `json:"features"`
+}
+
+type HelloAck struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+}
+
+func (h Hello) MsgData() ([]byte, error) {
+	return json.Marshal(h)
+}
+
+func ParseHello(msgData []byte) (Hello, error) {
+	var h Hello
+	err := json.Unmarshal(msgData, &h)
+	return h, err
+}
+
+func (ack HelloAck) MsgData() ([]byte, error) {
+	return json.Marshal(ack)
+}
+
+func ParseHelloAck(msgData []byte) (HelloAck, error) {
+	var ack HelloAck
+	err := json.Unmarshal(msgData, &ack)
+	return ack, err
+}
+
+// Settle on the highest protocol version and the features supported by both sides
+func (h Hello) Negotiate(versions []int, features []string) HelloAck {
+	ack := HelloAck{Features: []string{}}
+	for _, version := range h.Versions {
+		if version > ack.Version && slices.Contains(versions, version) {
+			ack.Version = version
+		}
+	}
+	for _, feature := range h.Features {
+		if slices.Contains(features, feature) && !slices.Contains(ack.Features, feature) {
+			ack.Features = append(ack.Features, feature)
+		}
+	}
+	return ack
+}
+
+// Protocol versions messages can be received with, clients predating negotiation
+// use the legacy version without sending HELLO
+func isSupportedVersion(version uint8) bool {
+	return version == constants.TUNNEL_MESSAGE_PROTOCOL_VERSION ||
+		version == constants.LEGACY_TUNNEL_MESSAGE_PROTOCOL_VERSION
+}
+
+// Check if a feature was negotiated for the tunnel
+func (t *Tunnel) Supports(feature string) bool {
+	return slices.Contains(t.Features, feature)
+}
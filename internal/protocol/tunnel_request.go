@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/yusuf-musleh/mmar/constants"
+)
+
+var INVALID_TUNNEL_REQUEST = errors.New("Invalid Tunnel Request in Tunnel Message")
+
+// Limits mmar client requests for its tunnel, mmar server never applies ones higher than
+// its own. A zero value means no preference, so the server's limit applies. Timeouts
+// are in seconds.
+type TunnelLimits struct {
+	MaxRequestBodySize int64 `json:"maxRequestBodySize,omitempty"`
+	// Time mmar server waits for each chunk of request bodies
+	RequestBodyReadTimeout int64 `json:"requestBodyReadTimeout,omitempty"`
+	// Time mmar client waits for localhost to respond to forwarded requests
+	DestRequestTimeout int64 `json:"destRequestTimeout,omitempty"`
+	// Time mmar server and mmar client wait without receiving anything, before sending
+	// a heartbeat to check the connection is still alive
+	HeartbeatTimeout       int64 `json:"heartbeatTimeout,omitempty"`
+	ClientHeartbeatTimeout int64 `json:"clientHeartbeatTimeout,omitempty"`
+}
+
+// Data of CREATE_TUNNEL and RECLAIM_TUNNEL messages, JSON encoded. The payload version
+// is only bumped for changes older mmar servers cannot safely ignore, new optional
+// fields are added without bumping it.
+type TunnelRequest struct {
+	Version    int    `json:"version"`
+	Subdomain  string `json:"subdomain,omitempty"`
+	AuthToken  string `json:"authToken,omitempty"`
+	TunnelType string `json:"tunnelType,omitempty"`
+	// Public port to reclaim for TCP/UDP tunnels
+	Port          int               `json:"port,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Limits        TunnelLimits      `json:"limits"`
+	ClientVersion string            `json:"clientVersion,omitempty"`
+	// Token issued when the tunnel was created, to reclaim its reserved subdomain
+	ResumeToken string `json:"resumeToken,omitempty"`
+}
+
+func (tr TunnelRequest) MsgData() ([]byte, error) {
+	return json.Marshal(tr)
+}
+
+func ParseTunnelRequest(msgData []byte) (TunnelRequest, error) {
+	var tr TunnelRequest
+	if err := json.Unmarshal(msgData, &tr); err != nil {
+		return TunnelRequest{}, errors.Join(INVALID_TUNNEL_REQUEST, err)
+	}
+	if tr.Version < 1 || tr.Version > constants.TUNNEL_REQUEST_PAYLOAD_VERSION {
+		return TunnelRequest{}, INVALID_TUNNEL_REQUEST
+	}
+	if tr.TunnelType == "" {
+		tr.TunnelType = constants.TUNNEL_TYPE_HTTP
+	}
+	return tr, nil
+}
+
+// Data of TUNNEL_CREATED messages, JSON encoded. The resume token is kept secret by
+// mmar client, as it is the only way to reclaim the subdomain while it is reserved.
+type TunnelCreated struct {
+	Subdomain   string `json:"subdomain"`
+	Port        int    `json:"port,omitempty"`
+	ResumeToken string `json:"resumeToken,omitempty"`
+	// Limits mmar server applies to the tunnel, for mmar client to honor
+	Limits TunnelLimits `json:"limits"`
+}
+
+func (tc TunnelCreated) MsgData() ([]byte, error) {
+	return json.Marshal(tc)
+}
+
+func ParseTunnelCreated(msgData []byte) (TunnelCreated, error) {
+	var tc TunnelCreated
+	err := json.Unmarshal(msgData, &tc)
+	return tc, err
+}
+
+// mmar clients predating negotiation send the subdomain and auth token delimited
+// by "|", in the format: "subdomain|authToken"
+func ParseLegacyTunnelRequest(msgData []byte) TunnelRequest {
+	subdomain, authToken, _ := strings.Cut(string(msgData), "|")
+	return TunnelRequest{
+		Version:    constants.TUNNEL_REQUEST_PAYLOAD_VERSION,
+		Subdomain:  subdomain,
+		AuthToken:  authToken,
+		TunnelType: constants.TUNNEL_TYPE_HTTP,
+	}
+}
@@ -0,0 +1,214 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yusuf-musleh/mmar/constants"
+)
+
+var OUTGOING_QUEUE_TIMEDOUT = errors.New("Timed out waiting for room in the outgoing queue")
+var TUNNEL_CONNECTION_CLOSED = errors.New("Tunnel connection closed")
+var OUTGOING_QUEUE_FULL = errors.New("Outgoing queue is full")
+
+// Message waiting in the outgoing queue, along with where to report once it is written.
+// Its header and data are written at once without being joined, with a vectored write
+// where the connection supports it.
+type outgoingMessage struct {
+	header []byte
+	data   []byte
+	// Backing array of the buffers written, which are consumed as they are written
+	parts   [2][]byte
+	buffers net.Buffers
+	written chan error
+	// Posted messages have no sender waiting on them, the writer releases them instead
+	posted bool
+}
+
+// Outgoing messages are pooled, along with the buffers their headers are serialized into
+var outgoingMessagePool = sync.Pool{
+	New: func() any {
+		return &outgoingMessage{
+			header:  make([]byte, 0, constants.MESSAGE_HEADER_BUFF_SIZE),
+			written: make(chan error, 1),
+		}
+	},
+}
+
+// Messages are written to the tunnel connection by a single goroutine, so concurrent
+// senders never interleave their writes. It drains two queues bounded to
+// OUTGOING_QUEUE_SIZE messages each, control messages (negotiation, heartbeats, window
+// updates, errors) always go ahead of bulk data, so they are not held back behind large
+// bodies. Senders wait until their message is written, so the messages of each sender
+// are written in the order they are sent regardless of their priority. Replies posted from
+// the loops reading the connection are the exception, nothing waits on them.
+type tunnelWriter struct {
+	conn    net.Conn
+	control chan *outgoingMessage
+	bulk    chan *outgoingMessage
+	// Closed once the writer stops, after err is set
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+	// Closed once the writer goroutine returned, so it no longer uses any message
+	done chan struct{}
+}
+
+func newTunnelWriter(conn net.Conn) *tunnelWriter {
+	w := &tunnelWriter{
+		conn:    conn,
+		control: make(chan *outgoingMessage, constants.OUTGOING_QUEUE_SIZE),
+		bulk:    make(chan *outgoingMessage, constants.OUTGOING_QUEUE_SIZE),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Messages carrying the data of requests, responses and streams
+func isBulkMessage(msgType uint8) bool {
+	switch msgType {
+	case REQUEST, RESPONSE, REQUEST_BODY_CHUNK, RESPONSE_BODY_CHUNK, STREAM_DATA, UDP_DATAGRAM:
+		return true
+	}
+	return false
+}
+
+func (w *tunnelWriter) run() {
+	defer close(w.done)
+	for {
+		var msg *outgoingMessage
+		// Only pick up bulk data once there are no control messages waiting
+		select {
+		case msg = <-w.control:
+		default:
+			select {
+			case msg = <-w.control:
+			case msg = <-w.bulk:
+			case <-w.closed:
+				return
+			}
+		}
+
+		// Do not wait forever on a peer that stopped reading
+		w.conn.SetWriteDeadline(time.Now().Add(constants.TUNNEL_WRITE_TIMEOUT * time.Second))
+		msg.parts = [2][]byte{msg.header, msg.data}
+		msg.buffers = msg.parts[:]
+		_, err := msg.buffers.WriteTo(w.conn)
+		if msg.posted {
+			w.release(msg)
+		} else {
+			msg.written <- err
+		}
+		if err != nil {
+			// The message might have been partially written, so nothing else can be
+			// written to the connection after it
+			w.close(err)
+			w.conn.Close()
+			return
+		}
+	}
+}
+
+// Queue the message and wait until it is written, timing out if the queue stays full for
+// too long. The header is serialized into a pooled buffer, and the data is written as is,
+// it is no longer used once this returns.
+func (w *tunnelWriter) send(tunnelMsg TunnelMessage, version uint8) error {
+	msg := outgoingMessagePool.Get().(*outgoingMessage)
+	header, err := tunnelMsg.serializeHeader(msg.header[:0], version)
+	if err != nil {
+		w.release(msg)
+		return err
+	}
+	msg.header, msg.data = header, tunnelMsg.MsgData
+
+	queue := w.control
+	if isBulkMessage(tunnelMsg.MsgType) {
+		queue = w.bulk
+	}
+
+	if err := w.enqueue(queue, msg); err != nil {
+		w.release(msg)
+		return err
+	}
+
+	select {
+	case err := <-msg.written:
+		w.release(msg)
+		return err
+	case <-w.done:
+		// The message might have been written right before the writer stopped, otherwise
+		// it is left in the queue, so it is not reused
+		select {
+		case err := <-msg.written:
+			w.release(msg)
+			return err
+		default:
+			return w.err
+		}
+	}
+}
+
+// Queue the control message without waiting for it to be written, failing right away if
+// the queue is full. Meant for replies sent from the loop reading the connection, which
+// must never wait on the peer, so its data must not be reused afterwards.
+func (w *tunnelWriter) post(tunnelMsg TunnelMessage, version uint8) error {
+	msg := outgoingMessagePool.Get().(*outgoingMessage)
+	header, err := tunnelMsg.serializeHeader(msg.header[:0], version)
+	if err != nil {
+		w.release(msg)
+		return err
+	}
+	msg.header, msg.data, msg.posted = header, tunnelMsg.MsgData, true
+
+	select {
+	case <-w.closed:
+		w.release(msg)
+		return w.err
+	case w.control <- msg:
+		return nil
+	default:
+		w.release(msg)
+		return OUTGOING_QUEUE_FULL
+	}
+}
+
+func (w *tunnelWriter) enqueue(queue chan *outgoingMessage, msg *outgoingMessage) error {
+	// Only set up the timeout once the queue is full
+	select {
+	case <-w.closed:
+		return w.err
+	case queue <- msg:
+		return nil
+	default:
+	}
+
+	queueTimeout := time.NewTimer(constants.OUTGOING_QUEUE_TIMEOUT * time.Second)
+	defer queueTimeout.Stop()
+	select {
+	case queue <- msg:
+		return nil
+	case <-w.closed:
+		return w.err
+	case <-queueTimeout.C:
+		return OUTGOING_QUEUE_TIMEDOUT
+	}
+}
+
+// Return the message to the pool once the writer is done with it, without holding on to
+// the data it was sent with
+func (w *tunnelWriter) release(msg *outgoingMessage) {
+	msg.data, msg.parts, msg.buffers, msg.posted = nil, [2][]byte{}, nil, false
+	outgoingMessagePool.Put(msg)
+}
+
+// Stop the writer, messages still queued are not written
+func (w *tunnelWriter) close(err error) {
+	w.closeOnce.Do(func() {
+		w.err = err
+		close(w.closed)
+	})
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/yusuf-musleh/mmar/constants"
+	"github.com/yusuf-musleh/mmar/internal/auth"
+	"github.com/yusuf-musleh/mmar/internal/logger"
+	"github.com/yusuf-musleh/mmar/internal/protocol"
+	"github.com/yusuf-musleh/mmar/internal/utils"
+)
+
+// Path the admin API is served under on the stats subdomain
+const ADMIN_API_PATH = "/admin/"
+
+// Reason tunnels closed by admins are closed for, as labeled in the metrics
+const CLOSE_REASON_ADMIN = "admin"
+
+// Reason sent to mmar clients of tunnels closed for their API key being revoked
+const KEY_REVOKED_CLOSE_REASON = "API key was revoked"
+
+// Subdomain reserved by an admin, no mmar client can create a tunnel with it
+type adminReservation struct {
+	reservedOn time.Time
+	note       string
+}
+
+// Reservation of a subdomain as listed by the admin API, either by an admin or for the
+// mmar client of a disconnected tunnel to reclaim
+type reservationEntry struct {
+	Subdomain  string `json:"subdomain"`
+	Type       string `json:"type"`
+	Note       string `json:"note,omitempty"`
+	ReservedOn string `json:"reservedOn,omitempty"`
+	ExpiresOn  string `json:"expiresOn,omitempty"`
+}
+
+// Details of a tunnel as inspected through the admin API
+type tunnelDetails struct {
+	tunnelStatsEntry
+	Features    []string              `json:"features"`
+	Limits      protocol.TunnelLimits `json:"limits"`
+	Reclaimable bool                  `json:"reclaimable"`
+}
+
+// Serves the admin API behind the same Basic Authentication as the stats, to manage
+// tunnels, API keys and reserved subdomains while mmar server is running
+func (ms *MmarServer) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if !authorizedAdmin(w, r) {
+		return
+	}
+	// Anyone knows the default credentials, so they are only allowed to look around
+	if r.Method != http.MethodGet && !utils.CredentialsConfigured() {
+		respondWithAdminErr(w, http.StatusForbidden, "changes require USERNAME_HASH and PASSWORD_HASH to be set")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/tunnels", ms.handleServerStats)
+	mux.HandleFunc("GET /admin/tunnels/{id}", ms.handleAdminGetTunnel)
+	mux.HandleFunc("DELETE /admin/tunnels/{id}", ms.handleAdminCloseTunnel)
+	mux.HandleFunc("GET /admin/keys", ms.handleAdminListKeys)
+	mux.HandleFunc("POST /admin/keys", ms.handleAdminAddKey)
+	mux.HandleFunc("PATCH /admin/keys/{key}", ms.handleAdminSetKeyLimit)
+	mux.HandleFunc("DELETE /admin/keys/{key}", ms.handleAdminRevokeKey)
+	mux.HandleFunc("GET /admin/reservations", ms.handleAdminListReservations)
+	mux.HandleFunc("PUT /admin/reservations/{subdomain}", ms.handleAdminReserveSubdomain)
+	mux.HandleFunc("DELETE /admin/reservations/{subdomain}", ms.handleAdminReleaseSubdomain)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		respondWithAdminErr(w, http.StatusNotFound, "not found")
+	})
+	mux.ServeHTTP(w, r)
+}
+
+func respondWithJSON(w http.ResponseWriter, statusCode int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to marshal admin API response: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+func respondWithAdminErr(w http.ResponseWriter, statusCode int, message string) {
+	respondWithJSON(w, statusCode, map[string]string{"error": message})
+}
+
+// Decode the JSON body of an admin API request, an empty body leaves v as it is
+func decodeAdminRequest(r *http.Request, v any) error {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, constants.ADMIN_MAX_REQUEST_BODY_SIZE))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+	return nil
+}
+
+func (ms *MmarServer) handleAdminGetTunnel(w http.ResponseWriter, r *http.Request) {
+	ct, ok := ms.tunnels.lookup(r.PathValue("id"))
+	if !ok {
+		respondWithAdminErr(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, tunnelDetails{
+		tunnelStatsEntry: newTunnelStatsEntry(ct),
+		Features:         append([]string{}, ct.Features...),
+		Limits:           ct.limits,
+		Reclaimable:      ct.resumeToken != "",
+	})
+}
+
+func (ms *MmarServer) handleAdminCloseTunnel(w http.ResponseWriter, r *http.Request) {
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = constants.TUNNEL_CLOSED_ERR_TEXT
+	}
+	if !ms.forceCloseClientTunnel(r.PathValue("id"), reason) {
+		respondWithAdminErr(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Close a tunnel on behalf of an admin, letting its mmar client know the reason so it
+// does not attempt to reconnect. Returns false if there is no such tunnel.
+func (ms *MmarServer) forceCloseClientTunnel(id string, reason string) bool {
+	ct, ok := ms.tunnels.lookup(id)
+	if !ok {
+		return false
+	}
+
+	// The subdomain is not reserved for mmar client to reclaim
+	ct.resumeToken = ""
+	if !ms.removeClientTunnel(&ct, CLOSE_REASON_ADMIN) {
+		return false
+	}
+
+	logger.Log(constants.YELLOW, fmt.Sprintf("[%s] Tunnel closed by admin: %s", ct.Id, reason))
+
+	// mmar clients predating the reason being sent only notice the connection closing
+	if ct.Supports(constants.FEATURE_TUNNEL_CLOSED) {
+		closedMsg := protocol.TunnelMessage{MsgType: protocol.TUNNEL_CLOSED, MsgData: []byte(reason)}
+		if err := ct.SendMessage(closedMsg); err != nil {
+			logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send Tunnel Closed msg to client: %v", err))
+		}
+	}
+
+	go ct.close(true)
+	return true
+}
+
+// Only API keys whose tunnels can be authenticated with are managed, so there is
+// nothing to manage unless mmar server was started with an API keys file
+func (ms *MmarServer) authEnabled(w http.ResponseWriter) bool {
+	if ms.authManager == nil {
+		respondWithAdminErr(w, http.StatusNotFound, "authentication is not enabled on mmar server")
+		return false
+	}
+	return true
+}
+
+func respondWithKeyErr(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, auth.ErrKeyNotFound):
+		respondWithAdminErr(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, auth.ErrKeyExists):
+		respondWithAdminErr(w, http.StatusConflict, err.Error())
+	case errors.Is(err, auth.ErrInvalidKeyConfig):
+		respondWithAdminErr(w, http.StatusBadRequest, err.Error())
+	default:
+		logger.Log(constants.RED, fmt.Sprintf("Failed to update API keys: %v", err))
+		respondWithAdminErr(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// API keys are masked when listed, they are only revealed once added
+func (ms *MmarServer) handleAdminListKeys(w http.ResponseWriter, r *http.Request) {
+	if !ms.authEnabled(w) {
+		return
+	}
+	keys := ms.authManager.ListKeys()
+	for i := range keys {
+		keys[i].Tunnels = ms.tunnels.countByToken(keys[i].Token())
+		keys[i].Key = maskAuthToken(keys[i].Key)
+	}
+	respondWithJSON(w, http.StatusOK, keys)
+}
+
+func (ms *MmarServer) handleAdminAddKey(w http.ResponseWriter, r *http.Request) {
+	if !ms.authEnabled(w) {
+		return
+	}
+	var entry auth.ApiKeyConfig
+	if err := decodeAdminRequest(r, &entry); err != nil {
+		respondWithAdminErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	key, err := ms.authManager.AddKey(entry)
+	if err != nil {
+		respondWithKeyErr(w, err)
+		return
+	}
+	logger.Log(constants.GREEN, fmt.Sprintf("API key %s added by admin", key.Id))
+	respondWithJSON(w, http.StatusCreated, key)
+}
+
+func (ms *MmarServer) handleAdminSetKeyLimit(w http.ResponseWriter, r *http.Request) {
+	if !ms.authEnabled(w) {
+		return
+	}
+	var update struct {
+		Limit *int `json:"limit"`
+	}
+	if err := decodeAdminRequest(r, &update); err != nil {
+		respondWithAdminErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if update.Limit == nil {
+		respondWithAdminErr(w, http.StatusBadRequest, "limit is required")
+		return
+	}
+	key, err := ms.authManager.SetKeyLimit(r.PathValue("key"), *update.Limit)
+	if err != nil {
+		respondWithKeyErr(w, err)
+		return
+	}
+	logger.Log(constants.GREEN, fmt.Sprintf("API key %s limit changed by admin to %d", key.Id, key.Limit))
+	key.Tunnels = ms.tunnels.countByToken(key.Token())
+	key.Key = maskAuthToken(key.Key)
+	respondWithJSON(w, http.StatusOK, key)
+}
+
+// Revoking an API key closes all the tunnels created with it
+func (ms *MmarServer) handleAdminRevokeKey(w http.ResponseWriter, r *http.Request) {
+	if !ms.authEnabled(w) {
+		return
+	}
+	// Tunnels are only closed once the key is revoked for good
+	token, err := ms.authManager.RevokeKey(r.PathValue("key"))
+	if err != nil {
+		respondWithKeyErr(w, err)
+		return
+	}
+	tunnels := ms.tunnels.idsByToken(token)
+	for _, id := range tunnels {
+		ms.forceCloseClientTunnel(id, KEY_REVOKED_CLOSE_REASON)
+	}
+	logger.Log(constants.GREEN, fmt.Sprintf("API key %s revoked by admin, closed %d tunnels", auth.Fingerprint(token), len(tunnels)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ms *MmarServer) handleAdminListReservations(w http.ResponseWriter, r *http.Request) {
+	ms.mu.Lock()
+	entries := []reservationEntry{}
+	for subdomain, res := range ms.adminReservations {
+		entries = append(entries, reservationEntry{
+			Subdomain:  subdomain,
+			Type:       "admin",
+			Note:       res.note,
+			ReservedOn: res.reservedOn.Format(time.RFC3339),
+		})
+	}
+	now := time.Now()
+	for subdomain, res := range ms.reservations {
+		if now.After(res.expiresOn) {
+			continue
+		}
+		entries = append(entries, reservationEntry{
+			Subdomain: subdomain,
+			Type:      "reclaim",
+			ExpiresOn: res.expiresOn.Format(time.RFC3339),
+		})
+	}
+	ms.mu.Unlock()
+
+	slices.SortFunc(entries, func(a, b reservationEntry) int {
+		return strings.Compare(a.Subdomain, b.Subdomain)
+	})
+	respondWithJSON(w, http.StatusOK, entries)
+}
+
+// Reserve a subdomain so no mmar client can create a tunnel with it, reserving it again
+// only updates its note
+func (ms *MmarServer) handleAdminReserveSubdomain(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Note string `json:"note"`
+	}
+	if err := decodeAdminRequest(r, &body); err != nil {
+		respondWithAdminErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	subdomain := strings.ToLower(r.PathValue("subdomain"))
+
+	ms.mu.Lock()
+	if res, ok := ms.adminReservations[subdomain]; ok {
+		res.note = body.Note
+		entry := reservationEntry{subdomain, "admin", res.note, res.reservedOn.Format(time.RFC3339), ""}
+		ms.mu.Unlock()
+		respondWithJSON(w, http.StatusOK, entry)
+		return
+	}
+	if !ms.isValidSubdomainName(subdomain) {
+		ms.mu.Unlock()
+		respondWithAdminErr(w, http.StatusBadRequest, "invalid subdomain name")
+		return
+	}
+	if _, exists := ms.tunnels.lookup(subdomain); exists {
+		ms.mu.Unlock()
+		respondWithAdminErr(w, http.StatusConflict, "subdomain is used by a tunnel, close it first")
+		return
+	}
+	res := &adminReservation{reservedOn: time.Now(), note: body.Note}
+	ms.adminReservations[subdomain] = res
+	// mmar client of a disconnected tunnel can no longer reclaim it
+	ms.releaseReservation(subdomain)
+	ms.mu.Unlock()
+
+	logger.Log(constants.GREEN, fmt.Sprintf("Subdomain %s reserved by admin", subdomain))
+	respondWithJSON(w, http.StatusCreated, reservationEntry{subdomain, "admin", res.note, res.reservedOn.Format(time.RFC3339), ""})
+}
+
+// Release a subdomain reserved by an admin, or for a disconnected tunnel to be reclaimed
+func (ms *MmarServer) handleAdminReleaseSubdomain(w http.ResponseWriter, r *http.Request) {
+	subdomain := strings.ToLower(r.PathValue("subdomain"))
+
+	ms.mu.Lock()
+	_, adminReserved := ms.adminReservations[subdomain]
+	_, reclaimReserved := ms.reservations[subdomain]
+	delete(ms.adminReservations, subdomain)
+	ms.releaseReservation(subdomain)
+	ms.mu.Unlock()
+
+	if !adminReserved && !reclaimReserved {
+		respondWithAdminErr(w, http.StatusNotFound, "subdomain is not reserved")
+		return
+	}
+	logger.Log(constants.GREEN, fmt.Sprintf("Subdomain %s released by admin", subdomain))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yusuf-musleh/mmar/constants"
+	"github.com/yusuf-musleh/mmar/internal/logger"
+)
+
+// Subdomains mmar clients cannot use for their tunnels unless configured otherwise
+var DEFAULT_RESERVED_SUBDOMAINS = []string{"admin", "stats", "www", "api", "app"}
+
+// Options of the server config file, JSON encoded. Options left out keep the values
+// passed in through command flags, environment variables or their defaults.
+type ConfigFile struct {
+	ListenAddress      *string          `json:"listenAddress"`
+	HttpPort           *string          `json:"httpPort"`
+	TcpPort            *string          `json:"tcpPort"`
+	TcpTunnelPorts     *string          `json:"tcpTunnelPorts"`
+	UdpTunnelPorts     *string          `json:"udpTunnelPorts"`
+	ErrorPagesDir      *string          `json:"errorPagesDir"`
+	ReservedSubdomains []string         `json:"reservedSubdomains"`
+	Tls                ConfigFileTls    `json:"tls"`
+	Auth               ConfigFileAuth   `json:"auth"`
+	Limits             ConfigFileLimits `json:"limits"`
+}
+
+type ConfigFileTls struct {
+	Cert              *string `json:"cert"`
+	Key               *string `json:"key"`
+	ClientCa          *string `json:"clientCa"`
+	RequireClientCert *bool   `json:"requireClientCert"`
+}
+
+type ConfigFileAuth struct {
+	ApiKeysFile *string `json:"apiKeysFile"`
+}
+
+// Timeouts and grace periods are in seconds
+type ConfigFileLimits struct {
+	MaxTunnelsPerIP        *int64 `json:"maxTunnelsPerIp"`
+	MaxRequestBodySize     *int64 `json:"maxRequestBodySize"`
+	RequestBodyReadTimeout *int64 `json:"requestBodyReadTimeout"`
+	DestRequestTimeout     *int64 `json:"destRequestTimeout"`
+	HeartbeatTimeout       *int64 `json:"heartbeatTimeout"`
+	ClientHeartbeatTimeout *int64 `json:"clientHeartbeatTimeout"`
+	ReclaimGracePeriod     *int64 `json:"reclaimGracePeriod"`
+	MaxFrameSize           *int64 `json:"maxFrameSize"`
+	MaxUdpSessions         *int64 `json:"maxUdpSessions"`
+}
+
+// Settings of mmar server that can be changed while it is running, by reloading its
+// config file. Tunnels keep the limits they were created with.
+type serverSettings struct {
+	maxTunnelsPerIP        int
+	maxRequestBodySize     int64
+	requestBodyReadTimeout time.Duration
+	destRequestTimeout     time.Duration
+	heartbeatTimeout       time.Duration
+	clientHeartbeatTimeout time.Duration
+	reclaimGracePeriod     time.Duration
+	// Largest message mmar clients can send, applied to connections made after it changes
+	maxFrameSize       int
+	maxUdpSessions     int
+	reservedSubdomains []string
+	// Custom templates to render error pages with, nil if not provided
+	errorPages *template.Template
+}
+
+// Read the config file, overriding the options passed in with the ones it sets
+func LoadConfigFile(configFile string, config ConfigOptions) (ConfigOptions, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return config, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	// Reject unknown options, so typos are not silently ignored
+	var fileConfig ConfigFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&fileConfig); err != nil {
+		return config, fmt.Errorf("failed to parse config file: %v", err)
+	}
+
+	overrideString(&config.ListenAddress, fileConfig.ListenAddress)
+	overrideString(&config.HttpPort, fileConfig.HttpPort)
+	overrideString(&config.TcpPort, fileConfig.TcpPort)
+	overrideString(&config.TcpTunnelPorts, fileConfig.TcpTunnelPorts)
+	overrideString(&config.UdpTunnelPorts, fileConfig.UdpTunnelPorts)
+	overrideString(&config.ErrorPagesDir, fileConfig.ErrorPagesDir)
+	overrideString(&config.TlsCertFile, fileConfig.Tls.Cert)
+	overrideString(&config.TlsKeyFile, fileConfig.Tls.Key)
+	overrideString(&config.TlsClientCaFile, fileConfig.Tls.ClientCa)
+	overrideString(&config.ApiKeysFile, fileConfig.Auth.ApiKeysFile)
+	overrideNumber(&config.MaxTunnelsPerIP, fileConfig.Limits.MaxTunnelsPerIP)
+	overrideNumber(&config.MaxRequestBodySize, fileConfig.Limits.MaxRequestBodySize)
+	overrideNumber(&config.RequestBodyReadTimeout, fileConfig.Limits.RequestBodyReadTimeout)
+	overrideNumber(&config.DestRequestTimeout, fileConfig.Limits.DestRequestTimeout)
+	overrideNumber(&config.HeartbeatTimeout, fileConfig.Limits.HeartbeatTimeout)
+	overrideNumber(&config.ClientHeartbeatTimeout, fileConfig.Limits.ClientHeartbeatTimeout)
+	overrideNumber(&config.ReclaimGracePeriod, fileConfig.Limits.ReclaimGracePeriod)
+	overrideNumber(&config.MaxFrameSize, fileConfig.Limits.MaxFrameSize)
+	overrideNumber(&config.MaxUdpSessions, fileConfig.Limits.MaxUdpSessions)
+	if fileConfig.Tls.RequireClientCert != nil {
+		config.TlsRequireClientCert = *fileConfig.Tls.RequireClientCert
+	}
+	if fileConfig.ReservedSubdomains != nil {
+		config.ReservedSubdomains = fileConfig.ReservedSubdomains
+	}
+
+	return config, nil
+}
+
+func overrideString(option *string, value *string) {
+	if value != nil {
+		*option = *value
+	}
+}
+
+func overrideNumber(option *string, value *int64) {
+	if value != nil {
+		*option = strconv.FormatInt(*value, 10)
+	}
+}
+
+// Parse the settings from the config options, falling back to the defaults for the
+// ones not provided
+func newServerSettings(config ConfigOptions) (serverSettings, error) {
+	maxTunnelsPerIP, err := parseLimit(config.MaxTunnelsPerIP, constants.MAX_TUNNELS_PER_IP, 1, "max tunnels per IP")
+	if err != nil {
+		return serverSettings{}, err
+	}
+	maxRequestBodySize, err := parseLimit(config.MaxRequestBodySize, constants.MAX_REQ_BODY_SIZE, 1, "max request body size")
+	if err != nil {
+		return serverSettings{}, err
+	}
+	requestBodyReadTimeout, err := parseLimit(config.RequestBodyReadTimeout, constants.REQ_BODY_READ_CHUNK_TIMEOUT, 1, "request body read timeout")
+	if err != nil {
+		return serverSettings{}, err
+	}
+	destRequestTimeout, err := parseLimit(config.DestRequestTimeout, constants.DEST_REQUEST_TIMEOUT, 1, "destination request timeout")
+	if err != nil {
+		return serverSettings{}, err
+	}
+	heartbeatTimeout, err := parseLimit(config.HeartbeatTimeout, constants.HEARTBEAT_FROM_SERVER_TIMEOUT, 1, "heartbeat timeout")
+	if err != nil {
+		return serverSettings{}, err
+	}
+	clientHeartbeatTimeout, err := parseLimit(config.ClientHeartbeatTimeout, constants.HEARTBEAT_FROM_CLIENT_TIMEOUT, 1, "client heartbeat timeout")
+	if err != nil {
+		return serverSettings{}, err
+	}
+	reclaimGracePeriod, err := parseLimit(config.ReclaimGracePeriod, constants.RECLAIM_GRACE_PERIOD, 0, "reclaim grace period")
+	if err != nil {
+		return serverSettings{}, err
+	}
+	// Messages must at least fit a chunk of a body or a UDP datagram
+	maxFrameSize, err := parseLimit(config.MaxFrameSize, constants.MAX_FRAME_SIZE, constants.MIN_FRAME_SIZE, "max frame size")
+	if err != nil {
+		return serverSettings{}, err
+	}
+	maxUdpSessions, err := parseLimit(config.MaxUdpSessions, constants.MAX_UDP_SESSIONS, 1, "max UDP sessions")
+	if err != nil {
+		return serverSettings{}, err
+	}
+
+	reservedSubdomains := DEFAULT_RESERVED_SUBDOMAINS
+	if config.ReservedSubdomains != nil {
+		reservedSubdomains = []string{}
+		for _, subdomain := range config.ReservedSubdomains {
+			reservedSubdomains = append(reservedSubdomains, strings.ToLower(strings.TrimSpace(subdomain)))
+		}
+	}
+	// The stats subdomain is always served by mmar server itself
+	if !slices.Contains(reservedSubdomains, "stats") {
+		reservedSubdomains = append(reservedSubdomains, "stats")
+	}
+
+	var errorPages *template.Template
+	if config.ErrorPagesDir != "" {
+		errorPages, err = loadErrorPages(config.ErrorPagesDir)
+		if err != nil {
+			return serverSettings{}, fmt.Errorf("failed to load error pages: %v", err)
+		}
+	}
+
+	return serverSettings{
+		int(maxTunnelsPerIP),
+		maxRequestBodySize,
+		time.Duration(requestBodyReadTimeout) * time.Second,
+		time.Duration(destRequestTimeout) * time.Second,
+		time.Duration(heartbeatTimeout) * time.Second,
+		time.Duration(clientHeartbeatTimeout) * time.Second,
+		time.Duration(reclaimGracePeriod) * time.Second,
+		int(maxFrameSize),
+		int(maxUdpSessions),
+		reservedSubdomains,
+		errorPages,
+	}, nil
+}
+
+func parseLimit(value string, defaultValue int64, min int64, name string) (int64, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed < min {
+		return 0, fmt.Errorf("invalid %s \"%s\", must be a number of at least %d", name, value, min)
+	}
+	return parsed, nil
+}
+
+// Settings currently applied by mmar server
+func (ms *MmarServer) currentSettings() serverSettings {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.settings
+}
+
+// Reload the config file and API keys, applying the new settings without dropping any
+// tunnels. Options that can only be applied on startup are kept as they were.
+func (ms *MmarServer) reloadConfig() {
+	config := ms.config
+	if config.ConfigFile != "" {
+		var err error
+		config, err = LoadConfigFile(config.ConfigFile, ms.flagsConfig)
+		if err != nil {
+			logger.Log(constants.RED, fmt.Sprintf("Failed to reload config, keeping the current one: %v", err))
+			return
+		}
+	}
+
+	settings, err := newServerSettings(config)
+	if err != nil {
+		logger.Log(constants.RED, fmt.Sprintf("Failed to reload config, keeping the current one: %v", err))
+		return
+	}
+
+	restartOnlyChanges := []struct {
+		option  string
+		changed bool
+	}{
+		{"listener addresses", config.ListenAddress != ms.config.ListenAddress ||
+			config.HttpPort != ms.config.HttpPort || config.TcpPort != ms.config.TcpPort},
+		{"TCP/UDP tunnel ports", config.TcpTunnelPorts != ms.config.TcpTunnelPorts ||
+			config.UdpTunnelPorts != ms.config.UdpTunnelPorts},
+		{"TLS", config.TlsCertFile != ms.config.TlsCertFile || config.TlsKeyFile != ms.config.TlsKeyFile ||
+			config.TlsClientCaFile != ms.config.TlsClientCaFile || config.TlsRequireClientCert != ms.config.TlsRequireClientCert},
+		{"API keys file", config.ApiKeysFile != ms.config.ApiKeysFile},
+	}
+	for _, change := range restartOnlyChanges {
+		if change.changed {
+			logger.Log(constants.YELLOW, fmt.Sprintf("Changes to %s are only applied once mmar server restarts", change.option))
+		}
+	}
+
+	ms.mu.Lock()
+	ms.settings = settings
+	ms.mu.Unlock()
+
+	if ms.authManager != nil {
+		if err := ms.authManager.ReloadApiKeys(); err != nil {
+			logger.Log(constants.RED, fmt.Sprintf("Failed to reload API keys, keeping the current ones: %v", err))
+		}
+	}
+
+	logger.Log(constants.GREEN, "Config reloaded successfully")
+}
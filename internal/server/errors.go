@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yusuf-musleh/mmar/constants"
+	"github.com/yusuf-musleh/mmar/internal/logger"
+	"github.com/yusuf-musleh/mmar/internal/protocol"
+)
+
+// Error end-users get when their request cannot be tunneled, the code identifies it
+// regardless of the message
+type tunnelError struct {
+	statusCode int
+	code       string
+	message    string
+}
+
+// Tunnel errors mmar client reports, and ones of end-users' requests that failed
+var (
+	TUNNEL_NOT_FOUND       = tunnelError{http.StatusNotFound, constants.ERR_CODE_TUNNEL_NOT_FOUND, constants.CLIENT_DISCONNECT_ERR_TEXT}
+	TUNNEL_NOT_HTTP        = tunnelError{http.StatusNotFound, constants.ERR_CODE_TUNNEL_NOT_HTTP, constants.TUNNEL_NOT_HTTP_ERR_TEXT}
+	LOCALHOST_NOT_RUNNING  = tunnelError{http.StatusBadGateway, constants.ERR_CODE_LOCALHOST_NOT_RUNNING, constants.LOCALHOST_NOT_RUNNING_ERR_TEXT}
+	DEST_REQUEST_TIMEDOUT  = tunnelError{http.StatusGatewayTimeout, constants.ERR_CODE_DEST_REQUEST_TIMEDOUT, constants.DEST_REQUEST_TIMEDOUT_ERR_TEXT}
+	INVALID_RESP_FROM_DEST = tunnelError{http.StatusBadGateway, constants.ERR_CODE_INVALID_RESP_FROM_DEST, constants.READ_RESP_BODY_ERR_TEXT}
+	UNKNOWN_TUNNEL_ERR     = tunnelError{http.StatusBadGateway, constants.ERR_CODE_TUNNEL_ERROR, constants.TUNNEL_ERR_TEXT}
+	tunnelErrorsByErrState = map[uint8]tunnelError{
+		protocol.CLIENT_DISCONNECT:      TUNNEL_NOT_FOUND,
+		protocol.LOCALHOST_NOT_RUNNING:  LOCALHOST_NOT_RUNNING,
+		protocol.DEST_REQUEST_TIMEDOUT:  DEST_REQUEST_TIMEDOUT,
+		protocol.INVALID_RESP_FROM_DEST: INVALID_RESP_FROM_DEST,
+	}
+	tunnelErrorsByCause = map[error]tunnelError{
+		READ_BODY_CHUNK_TIMEOUT_ERR:              {http.StatusRequestTimeout, constants.ERR_CODE_REQUEST_BODY_TIMEDOUT, READ_BODY_CHUNK_TIMEOUT_ERR.Error()},
+		READ_BODY_CHUNK_ERR:                      {http.StatusBadRequest, constants.ERR_CODE_INVALID_REQUEST_BODY, READ_BODY_CHUNK_ERR.Error()},
+		MAX_REQ_BODY_SIZE_ERR:                    {http.StatusRequestEntityTooLarge, constants.ERR_CODE_REQUEST_TOO_LARGE, MAX_REQ_BODY_SIZE_ERR.Error()},
+		CLIENT_DISCONNECTED_ERR:                  {http.StatusBadGateway, constants.ERR_CODE_TUNNEL_DISCONNECTED, CLIENT_DISCONNECTED_ERR.Error()},
+		READ_RESP_BODY_ERR:                       INVALID_RESP_FROM_DEST,
+		FAILED_TO_FORWARD_TO_MMAR_CLIENT_ERR:     {http.StatusServiceUnavailable, constants.ERR_CODE_TUNNEL_UNAVAILABLE, FAILED_TO_FORWARD_TO_MMAR_CLIENT_ERR.Error()},
+		FAILED_TO_READ_RESP_FROM_MMAR_CLIENT_ERR: {http.StatusBadGateway, constants.ERR_CODE_INVALID_RESP_FROM_CLIENT, FAILED_TO_READ_RESP_FROM_MMAR_CLIENT_ERR.Error()},
+		RECONNECT_QUEUE_FULL_ERR:                 {http.StatusServiceUnavailable, constants.ERR_CODE_RECONNECT_QUEUE_FULL, RECONNECT_QUEUE_FULL_ERR.Error()},
+		RECONNECT_TIMEDOUT_ERR:                   {http.StatusBadGateway, constants.ERR_CODE_RECONNECT_TIMEDOUT, RECONNECT_TIMEDOUT_ERR.Error()},
+	}
+)
+
+// Content types error responses can be rendered as, the first is preferred when the
+// end-user accepts any of them equally
+var ERROR_CONTENT_TYPES = []string{"text/plain", "application/json", "text/html"}
+
+// Error response rendered to end-users, its fields are also the variables available
+// to custom error page templates
+type errorResponse struct {
+	Status    int       `json:"status"`
+	Code      string    `json:"code"`
+	Message   string    `json:"message"`
+	RequestId string    `json:"requestId"`
+	Subdomain string    `json:"-"`
+	Timestamp time.Time `json:"-"`
+}
+
+func (e errorResponse) StatusText() string {
+	return http.StatusText(e.Status)
+}
+
+var errorPageTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} {{.StatusText}} | mmar</title>
+</head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+<p><small>Error code: {{.Code}} &middot; Request ID: {{.RequestId}}</small></p>
+</body>
+</html>
+`))
+
+// Details of the end-user's request that error responses are rendered with
+type errorContext struct {
+	requestId  string
+	subdomain  string
+	receivedOn time.Time
+	errorPages *template.Template
+}
+
+type errorContextKey struct{}
+
+// Attach an ID to the end-user's request, included in error responses so they can be
+// traced back to it, along with the error pages to render them with
+func withErrorContext(r *http.Request, subdomain string, errorPages *template.Template) *http.Request {
+	errCtx := errorContext{GenerateRequestId(), subdomain, time.Now(), errorPages}
+	return r.WithContext(context.WithValue(r.Context(), errorContextKey{}, errCtx))
+}
+
+func requestErrorContext(r *http.Request) errorContext {
+	errCtx, _ := r.Context().Value(errorContextKey{}).(errorContext)
+	return errCtx
+}
+
+// Load the custom error page templates from the directory, each named after the error
+// code it renders, eg: localhost_not_running.html, with default.html for the others
+func loadErrorPages(dir string) (*template.Template, error) {
+	return template.ParseGlob(filepath.Join(dir, "*.html"))
+}
+
+// Render the error page from the custom templates if any matches the error, falling
+// back to the built-in one
+func renderErrorPage(errorPages *template.Template, errResp errorResponse) []byte {
+	var buf bytes.Buffer
+	if errorPages != nil {
+		for _, name := range []string{errResp.Code + ".html", constants.DEFAULT_ERROR_PAGE} {
+			page := errorPages.Lookup(name)
+			if page == nil {
+				continue
+			}
+			if err := page.Execute(&buf, errResp); err != nil {
+				logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to render error page %s: %v", name, err))
+				buf.Reset()
+				break
+			}
+			return buf.Bytes()
+		}
+	}
+	errorPageTemplate.Execute(&buf, errResp)
+	return buf.Bytes()
+}
+
+// Respond to the end-user with the tunnel error, rendered as HTML, JSON or plain text
+// depending on their Accept header
+func respondWithTunnelErr(tunnelErr tunnelError, w http.ResponseWriter, r *http.Request) {
+	errCtx := requestErrorContext(r)
+	errResp := errorResponse{
+		tunnelErr.statusCode,
+		tunnelErr.code,
+		tunnelErr.message,
+		errCtx.requestId,
+		errCtx.subdomain,
+		errCtx.receivedOn,
+	}
+
+	var body []byte
+	var contentType string
+	switch negotiateContentType(r.Header.Get("Accept"), ERROR_CONTENT_TYPES) {
+	case "application/json":
+		body, _ = json.Marshal(errResp)
+		contentType = "application/json"
+	case "text/html":
+		body = renderErrorPage(errCtx.errorPages, errResp)
+		contentType = "text/html; charset=utf-8"
+	default:
+		body = fmt.Appendf(nil, "%s\n\nError code: %s\nRequest ID: %s\n", errResp.Message, errResp.Code, errResp.RequestId)
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(tunnelErr.statusCode)
+	w.Write(body)
+}
+
+// Pick the offered content type the Accept header prefers, each offer gets the quality
+// of the most specific media range matching it
+func negotiateContentType(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	best, bestQuality := offers[0], 0.0
+	for _, offer := range offers {
+		offerType, _, _ := strings.Cut(offer, "/")
+		quality, specificity := 0.0, -1
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+			if err != nil {
+				continue
+			}
+
+			rangeSpecificity := -1
+			switch {
+			case mediaType == offer:
+				rangeSpecificity = 2
+			case mediaType == offerType+"/*":
+				rangeSpecificity = 1
+			case mediaType == "*/*":
+				rangeSpecificity = 0
+			}
+			if rangeSpecificity <= specificity {
+				continue
+			}
+
+			specificity, quality = rangeSpecificity, 1.0
+			if q, ok := params["q"]; ok {
+				if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+					quality = parsed
+				}
+			}
+		}
+
+		if quality > bestQuality {
+			best, bestQuality = offer, quality
+		}
+	}
+	return best
+}
@@ -4,8 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"encoding/binary"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"html"
@@ -16,8 +15,11 @@ import (
 	"os"
 	"os/signal"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/yusuf-musleh/mmar/constants"
@@ -30,29 +32,69 @@ import (
 var CLIENT_MAX_TUNNELS_REACHED = errors.New("Client reached max tunnels limit")
 
 type ConfigOptions struct {
-	HttpPort    string
-	TcpPort     string
-	ApiKeysFile string
+	HttpPort             string
+	TcpPort              string
+	ApiKeysFile          string
+	TcpTunnelPorts       string
+	UdpTunnelPorts       string
+	TlsCertFile          string
+	TlsKeyFile           string
+	TlsClientCaFile      string
+	TlsRequireClientCert bool
+	ReclaimGracePeriod   string
+	ErrorPagesDir        string
+	ConfigFile           string
+	// Address to listen on for HTTP requests and mmar clients, all interfaces if empty
+	ListenAddress          string
+	MaxTunnelsPerIP        string
+	MaxRequestBodySize     string
+	RequestBodyReadTimeout string
+	DestRequestTimeout     string
+	HeartbeatTimeout       string
+	ClientHeartbeatTimeout string
+	MaxFrameSize           string
+	MaxUdpSessions         string
+	ReservedSubdomains     []string
 }
 
 type MmarServer struct {
-	mu           sync.Mutex
-	clients      map[string]ClientTunnel
-	tunnelsPerIP map[string][]string
-	authManager  *auth.AuthManager
+	// Serializes creating tunnels, reserving subdomains and changing settings
+	mu sync.Mutex
+	// Tunnels open, looked up without holding the lock
+	tunnels        *tunnelRegistry
+	authManager    *auth.AuthManager
+	tcpTunnelPorts *PortRange
+	udpTunnelPorts *PortRange
+	// Subdomains of disconnected tunnels, reserved for their mmar clients to reclaim
+	reservations map[string]*reservation
+	// Subdomains reserved by admins through the admin API, until they release them
+	adminReservations map[string]*adminReservation
+	settings          serverSettings
+	// Config options mmar server started with, and the ones passed in through command
+	// flags that the config file is reloaded on top of
+	config      ConfigOptions
+	flagsConfig ConfigOptions
 }
 
 type IncomingRequest struct {
 	responseChannel chan OutgoingResponse
-	responseWriter  http.ResponseWriter
-	request         *http.Request
-	cancel          context.CancelCauseFunc
-	ctx             context.Context
+	// Response body (or stream data) received from mmar client
+	responseBody *protocol.StreamBuffer
+	// Window for sending the request body (or stream data) to mmar client
+	sendWindow *protocol.SendWindow
+	request    *http.Request
+	cancel     context.CancelCauseFunc
+	ctx        context.Context
 }
 
 type OutgoingResponse struct {
 	statusCode int
-	body       []byte
+	header     http.Header
+	// Complete response body, sent along with the response by mmar clients that do not
+	// support streaming it
+	body []byte
+	// Error to respond to the end-user with, instead of a response from the local server
+	tunnelErr *tunnelError
 }
 
 type RequestId uint32
@@ -61,9 +103,22 @@ type RequestId uint32
 type ClientTunnel struct {
 	protocol.Tunnel
 	incomingChannel  chan IncomingRequest
-	outgoingChannel  chan protocol.TunnelMessage
 	inflightRequests *sync.Map
 	authToken        string
+	tunnelType       string
+	labels           map[string]string
+	clientVersion    string
+	// Limits applied to the tunnel, as requested by mmar client within mmar server's own
+	limits      protocol.TunnelLimits
+	listener    net.Listener
+	packetConn  net.PacketConn
+	udpSessions *sync.Map
+	// Number of UDP sessions open, new source addresses are dropped once it reaches the max
+	udpSessionsOpen *atomic.Int64
+	maxUdpSessions  int
+	resumeToken     string
+	// Usage of the tunnel, shared by all copies of it
+	stats *tunnelStats
 }
 
 func (ct *ClientTunnel) drainChannels() {
@@ -80,19 +135,6 @@ incomingDrainerLoop:
 			break incomingDrainerLoop
 		}
 	}
-
-	// Draining all outgoing requests from tunnel
-OutgoingDrainerLoop:
-	for {
-		select {
-		case <-ct.outgoingChannel:
-			// Just draining, do nothing
-		default:
-			// Close the TunneledResponses channel
-			close(ct.outgoingChannel)
-			break OutgoingDrainerLoop
-		}
-	}
 }
 
 func (ct *ClientTunnel) close(graceful bool) {
@@ -105,6 +147,14 @@ func (ct *ClientTunnel) close(graceful bool) {
 		),
 	)
 
+	// Stop accepting new connections or datagrams on the public port for TCP/UDP tunnels
+	if ct.listener != nil {
+		ct.listener.Close()
+	}
+	if ct.packetConn != nil {
+		ct.packetConn.Close()
+	}
+
 	// Drain channels before closing them to prevent panics if there are blocked writes
 	ct.drainChannels()
 
@@ -114,7 +164,15 @@ func (ct *ClientTunnel) close(graceful bool) {
 		<-gracefulCloseTimer.C
 	}
 
-	ct.Conn.Close()
+	// Cancel any requests still inflight, since they will not receive the rest of their response
+	ct.inflightRequests.Range(func(reqId, inflight any) bool {
+		if inflightRequest, ok := inflight.(IncomingRequest); ok {
+			inflightRequest.cancel(CLIENT_DISCONNECTED_ERR)
+		}
+		return true
+	})
+
+	ct.Tunnel.Close()
 	logger.Log(
 		constants.DEFAULT_COLOR,
 		fmt.Sprintf(
@@ -125,6 +183,41 @@ func (ct *ClientTunnel) close(graceful bool) {
 	)
 }
 
+// Add an inflight request (or stream) to the client tunnel, its response body is buffered
+// as it is received from mmar client, granting it more room to send as it is consumed
+func (ct *ClientTunnel) newIncomingRequest(
+	ctx context.Context,
+	cancel context.CancelCauseFunc,
+	reqId RequestId,
+	r *http.Request,
+) IncomingRequest {
+	responseBody := protocol.NewStreamBuffer(func(increment int) {
+		windowUpdateMsg := protocol.TunnelMessage{
+			MsgType: protocol.WINDOW_UPDATE,
+			MsgData: protocol.WindowUpdateMsgData(uint32(reqId), increment),
+		}
+		if err := ct.SendMessage(windowUpdateMsg); err != nil {
+			logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send Window Update msg to client: %v", err))
+		}
+	})
+
+	// Stop waiting on the response body once the request is canceled
+	context.AfterFunc(ctx, func() {
+		responseBody.CloseWithError(context.Cause(ctx))
+	})
+
+	incomingReq := IncomingRequest{
+		responseChannel: make(chan OutgoingResponse, 1),
+		responseBody:    responseBody,
+		sendWindow:      protocol.NewSendWindow(),
+		request:         r,
+		cancel:          cancel,
+		ctx:             ctx,
+	}
+	ct.inflightRequests.Store(reqId, incomingReq)
+	return incomingReq
+}
+
 // Generate unique request id for incoming request for client
 func (ct *ClientTunnel) GenerateUniqueRequestID() RequestId {
 	var generatedReqId RequestId
@@ -135,117 +228,201 @@ func (ct *ClientTunnel) GenerateUniqueRequestID() RequestId {
 	return generatedReqId
 }
 
-// Serves simple stats for mmar server behind Basic Authentication
-func (ms *MmarServer) handleServerStats(w http.ResponseWriter, r *http.Request) {
-	// Check Basic Authentication
-	username, password, ok := r.BasicAuth()
-	if !ok || !utils.ValidCredentials(username, password) {
-		w.Header().Add("WWW-Authenticate", "Basic realm=\"stats\"")
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+// Send a message to mmar client, recording the data sent through the tunnel
+func (ct *ClientTunnel) SendMessage(tunnelMsg protocol.TunnelMessage) error {
+	if err := ct.Tunnel.SendMessage(tunnelMsg); err != nil {
+		return err
 	}
-
-	stats := map[string]any{}
-
-	// Add total connected clients count
-	stats["connectedClientsCount"] = len(ms.clients)
-
-	// Add list of connected clients, including only relevant fields
-	clientStats := []map[string]string{}
-	for _, val := range ms.clients {
-		client := map[string]string{
-			"id":        val.Id,
-			"createdOn": val.CreatedOn.Format(time.RFC3339),
-		}
-		clientStats = append(clientStats, client)
-	}
-	stats["connectedClients"] = clientStats
-
-	// Marshal the result
-	marshalledStats, err := json.Marshal(stats)
-
-	if err != nil {
-		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to marshal server stats: %v", err))
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(marshalledStats)
+	ct.recordBytes("in", len(tunnelMsg.MsgData))
+	return nil
 }
 
 func (ms *MmarServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Extract subdomain to retrieve related client tunnel
 	subdomain := utils.ExtractSubdomain(r.Host)
+	r = withErrorContext(r, subdomain, ms.currentSettings().errorPages)
 
-	// Handle stats subdomain
+	// Handle stats subdomain, serving the metrics and admin API as well
 	if subdomain == "stats" {
+		if r.URL.Path == "/metrics" {
+			ms.handleMetrics(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, ADMIN_API_PATH) {
+			ms.handleAdmin(w, r)
+			return
+		}
 		ms.handleServerStats(w, r)
 		return
 	}
 
-	clientTunnel, clientExists := ms.clients[subdomain]
+	clientTunnel, clientExists := ms.tunnels.lookup(subdomain)
 
 	if !clientExists {
-		protocol.RespondTunnelErr(protocol.CLIENT_DISCONNECT, w)
+		// Hold the request if the mmar client is expected to reconnect and reclaim the subdomain
+		reclaimedTunnel, err := ms.awaitReclaim(r, subdomain)
+		if errors.Is(err, SUBDOMAIN_NOT_RESERVED_ERR) {
+			respondWithTunnelErr(TUNNEL_NOT_FOUND, w, r)
+			return
+		} else if err != nil {
+			handleCancel(err, w, r)
+			return
+		}
+		clientTunnel = reclaimedTunnel
+	}
+
+	// Only HTTP tunnels are reachable through their subdomain
+	if clientTunnel.tunnelType != constants.TUNNEL_TYPE_HTTP {
+		respondWithTunnelErr(TUNNEL_NOT_HTTP, w, r)
 		return
 	}
 
-	// Create channel to receive serialized request
-	serializedReqChannel := make(chan []byte)
+	// Record the status and duration of the request once responded to
+	receivedOn := time.Now()
+	wrw := logger.NewWrappedResponseWriter(w)
+	w = wrw
+	defer func() {
+		clientTunnel.recordHttpRequest(wrw.StatusCode(), time.Since(receivedOn))
+	}()
+
+	// Reject request early if it already declares a body larger than allowed
+	if r.ContentLength > clientTunnel.limits.MaxRequestBodySize {
+		handleCancel(MAX_REQ_BODY_SIZE_ERR, w, r)
+		return
+	}
 
 	ctx, cancel := context.WithCancelCause(r.Context())
 
-	// Writing request to buffer to forward it
-	go serializeRequest(ctx, r, cancel, serializedReqChannel)
+	// Add request to client's inflight requests
+	reqId := clientTunnel.GenerateUniqueRequestID()
+	incomingReq := clientTunnel.newIncomingRequest(ctx, cancel, reqId, r)
+
+	// If the request is still inflight when we are done with it, the response was not
+	// completely received, so we let the mmar client know to stop forwarding it
+	defer func() {
+		_, inflight := clientTunnel.inflightRequests.LoadAndDelete(reqId)
+		if inflight && clientTunnel.Supports(constants.FEATURE_STREAMING) {
+			cancelMsg := protocol.TunnelMessage{
+				MsgType: protocol.REQUEST_CANCELED,
+				MsgData: protocol.RequestIdMsgData(uint32(reqId), nil),
+			}
+			if err := clientTunnel.SendMessage(cancelMsg); err != nil {
+				logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send Request Canceled msg to client: %v", err))
+			}
+		}
+	}()
 
-	select {
-	case <-ctx.Done():
-		// We could not serialize request, so we cancelled it
-		handleCancel(context.Cause(ctx), w)
-		return
-	case serializedRequest := <-serializedReqChannel:
-		// Request serialized, we can proceed to tunnel it
-
-		// Create response channel to receive response for tunneled request
-		respChannel := make(chan OutgoingResponse)
-
-		// Add request to client's inflight requests
-		reqId := clientTunnel.GenerateUniqueRequestID()
-		incomingReq := IncomingRequest{
-			responseChannel: respChannel,
-			responseWriter:  w,
-			request:         r,
-			cancel:          cancel,
-			ctx:             ctx,
-		}
-		clientTunnel.inflightRequests.Store(reqId, incomingReq)
-
-		// Construct Request message data
-		reqIdBuff := make([]byte, constants.REQUEST_ID_BUFF_SIZE)
-		binary.LittleEndian.PutUint32(reqIdBuff, uint32(reqId))
-		reqMsgData := append(reqIdBuff, serializedRequest...)
-
-		// Tunnel the request to mmar client
-		reqMessage := protocol.TunnelMessage{MsgType: protocol.REQUEST, MsgData: reqMsgData}
+	// mmar clients that cannot stream upgraded connections get the request without the
+	// upgrade, so the local server responds to it as a regular request
+	if !clientTunnel.Supports(constants.FEATURE_WEBSOCKET) {
+		r.Header.Del("Upgrade")
+		r.Header.Del("Connection")
+	}
+
+	if !clientTunnel.Supports(constants.FEATURE_STREAMING) {
+		// mmar clients that do not support streaming expect the whole request at once
+		if err := clientTunnel.sendBufferedRequest(incomingReq, reqId); err != nil {
+			handleCancel(err, w, r)
+			return
+		}
+	} else {
+		// Tunnel the request line and headers to mmar client
+		reqMessage := protocol.TunnelMessage{
+			MsgType: protocol.REQUEST,
+			MsgData: serializeRequest(reqId, r, nil),
+		}
 		if err := clientTunnel.SendMessage(reqMessage); err != nil {
 			logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send Request msg to client: %v", err))
-			cancel(FAILED_TO_FORWARD_TO_MMAR_CLIENT_ERR)
+			handleCancel(FAILED_TO_FORWARD_TO_MMAR_CLIENT_ERR, w, r)
+			return
 		}
 
+		// Stream the request body to mmar client as it is being read
+		bodyStreamed := make(chan struct{})
+		go clientTunnel.streamRequestBody(incomingReq, reqId, bodyStreamed)
+
+		// Wait for the request body to be completely tunneled before responding, so
+		// errors while reading it are reported back to the end-user
 		select {
-		case <-ctx.Done(): // Request is canceled or Tunnel is closed if context is canceled
-			handleCancel(context.Cause(ctx), w)
-			clientTunnel.inflightRequests.Delete(reqId)
+		case <-ctx.Done():
+			// We could not stream request body, so we cancelled it
+			handleCancel(context.Cause(ctx), w, r)
 			return
-		case resp := <-respChannel: // Await response for tunneled request
-			// Add header to close the connection
-			w.Header().Set("Connection", "close")
+		case <-bodyStreamed:
+			// Request body streamed, we can proceed to await the response
+		}
+	}
+
+	var resp OutgoingResponse
+	select {
+	case <-ctx.Done(): // Request is canceled or Tunnel is closed if context is canceled
+		handleCancel(context.Cause(ctx), w, r)
+		return
+	case resp = <-incomingReq.responseChannel: // Await response for tunneled request
+	}
 
-			// Write response headers with response status code to original client
-			w.WriteHeader(resp.statusCode)
+	// mmar client could not get a response from the local server
+	if resp.tunnelErr != nil {
+		respondWithTunnelErr(*resp.tunnelErr, w, r)
+		return
+	}
+
+	// Local server agreed to switch protocols, so the connection becomes a raw stream
+	if resp.statusCode == http.StatusSwitchingProtocols {
+		clientTunnel.handleUpgradedConnection(incomingReq, w, reqId, resp)
+		return
+	}
+
+	// Set headers for response
+	for hKey, hVal := range resp.header {
+		w.Header().Set(hKey, hVal[0])
+		// Add remaining values for header if more than than one exists
+		for i := 1; i < len(hVal); i++ {
+			w.Header().Add(hKey, hVal[i])
+		}
+	}
+
+	// Add header to close the connection
+	w.Header().Set("Connection", "close")
+
+	// Write response headers with response status code to original client
+	w.WriteHeader(resp.statusCode)
+
+	// The whole response body was received along with the response
+	if resp.body != nil {
+		w.Write(resp.body)
+		return
+	}
+
+	// Flush each chunk of streaming responses rather than buffering them, so they are
+	// received as soon as possible (eg: Server-Sent Events, long-polling)
+	flusher, canFlush := w.(http.Flusher)
+	flushChunks := canFlush && isStreamingResponse(resp.header)
+	if flushChunks {
+		flusher.Flush()
+	}
+
+	// Stream the response body to original client as chunks arrive
+	buf := make([]byte, constants.BODY_CHUNK_SIZE)
+	for {
+		n, readErr := incomingReq.responseBody.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if flushChunks {
+				flusher.Flush()
+			}
+		}
 
-			// Write the response body to original client
-			w.Write(resp.body)
+		if readErr != nil {
+			if !errors.Is(readErr, io.EOF) && !errors.Is(readErr, context.Canceled) {
+				// Response was interrupted midway, abort the connection so the
+				// original client does not treat the partial response as complete
+				panic(http.ErrAbortHandler)
+			}
+			// Response body completely sent, or request canceled
+			return
 		}
 	}
 }
@@ -256,9 +433,11 @@ func (ms *MmarServer) isValidSubdomainName(name string) bool {
 		return false
 	}
 
-	// reserved subdomains
-	reservedSubdomains := []string{"admin", "stats", "www", "api", "app"}
-	if slices.Contains(reservedSubdomains, strings.ToLower(name)) {
+	// reserved subdomains, either configured or reserved by an admin
+	if slices.Contains(ms.settings.reservedSubdomains, strings.ToLower(name)) {
+		return false
+	}
+	if _, reserved := ms.adminReservations[strings.ToLower(name)]; reserved {
 		return false
 	}
 
@@ -280,11 +459,17 @@ func (ms *MmarServer) isValidSubdomainName(name string) bool {
 	return true
 }
 
-func (ms *MmarServer) GenerateUniqueSubdomain() string {
-	reservedSubdomains := []string{"", "admin", "stats"}
+// Check if the subdomain is used by a tunnel, or reserved for one to be reclaimed
+func (ms *MmarServer) subdomainTaken(subdomain string) bool {
+	_, exists := ms.tunnels.lookup(subdomain)
+	return exists || ms.subdomainReserved(subdomain, "")
+}
 
+func (ms *MmarServer) GenerateUniqueSubdomain() string {
 	generatedSubdomain := ""
-	for _, exists := ms.clients[generatedSubdomain]; exists || slices.Contains(reservedSubdomains, generatedSubdomain); {
+	for generatedSubdomain == "" || ms.subdomainTaken(generatedSubdomain) ||
+		slices.Contains(ms.settings.reservedSubdomains, generatedSubdomain) ||
+		ms.adminReservations[generatedSubdomain] != nil {
 		generatedSubdomain = GenerateRandomID()
 	}
 
@@ -292,50 +477,75 @@ func (ms *MmarServer) GenerateUniqueSubdomain() string {
 }
 
 func (ms *MmarServer) TunnelLimitedIP(ip string) bool {
-	tunnels, tunnelsExist := ms.tunnelsPerIP[ip]
-
-	// Initialize tunnels list for IP
-	if !tunnelsExist {
-		ms.tunnelsPerIP[ip] = []string{}
-	}
-
-	return len(tunnels) >= constants.MAX_TUNNELS_PER_IP
+	return ms.tunnels.countByIP(ip) >= ms.settings.maxTunnelsPerIP
 }
 
-func (ms *MmarServer) newClientTunnel(tunnel protocol.Tunnel, subdomain string, authToken string) (*ClientTunnel, error) {
+func (ms *MmarServer) newClientTunnel(tunnel protocol.Tunnel, tunnelReq protocol.TunnelRequest) (*ClientTunnel, error) {
+	subdomain, authToken, tunnelType := tunnelReq.Subdomain, tunnelReq.AuthToken, tunnelReq.TunnelType
+
 	sendErrorAndCloseWrite := func(msgType uint8, errorText string) error {
 		errorMsg := protocol.TunnelMessage{MsgType: msgType}
 		if err := tunnel.SendMessage(errorMsg); err != nil {
 			logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send error msg to client: %v", err))
 		}
 		// Close write side to signal end of data, but allow client to read the message
-		if tcpConn, ok := tunnel.Conn.(*net.TCPConn); ok {
-			_ = tcpConn.CloseWrite()
-		}
+		closeWrite(tunnel.Conn)
 		return errors.New(errorText)
 	}
-	// Validate authentication token
 	if ms.authManager != nil {
-		valid, _, err := ms.authManager.ValidateToken(authToken)
-		if !valid {
-			if errors.Is(err, auth.ErrAuthTokenRequired) {
-				return nil, sendErrorAndCloseWrite(protocol.AUTH_TOKEN_REQUIRED, "authentication token required")
+		// Authenticate by the identity of the client certificate if one was presented, its
+		// tunnels are then tracked against the identity's limit instead of an API key's
+		if clientCert := verifiedClientCert(tunnel.Conn); clientCert != nil {
+			identityToken, _, err := ms.authManager.ValidateCertificate(clientCert)
+			if err != nil {
+				authFailures.Inc(AUTH_FAILURE_CLIENT_CERT_INVALID)
+				return nil, sendErrorAndCloseWrite(protocol.CLIENT_CERT_INVALID, "client certificate does not match any identity")
+			}
+			authToken = identityToken
+		} else {
+			// Validate authentication token
+			valid, _, err := ms.authManager.ValidateToken(authToken)
+			if !valid {
+				if errors.Is(err, auth.ErrAuthTokenRequired) {
+					authFailures.Inc(AUTH_FAILURE_TOKEN_REQUIRED)
+					return nil, sendErrorAndCloseWrite(protocol.AUTH_TOKEN_REQUIRED, "authentication token required")
+				}
+				authFailures.Inc(AUTH_FAILURE_TOKEN_INVALID)
+				return nil, sendErrorAndCloseWrite(protocol.AUTH_TOKEN_INVALID, "invalid authentication token")
 			}
-			return nil, sendErrorAndCloseWrite(protocol.AUTH_TOKEN_INVALID, "invalid authentication token")
-		}
-
-		// Check tunnel limit for this token
-		if ms.authManager.CheckTunnelLimit(authToken) {
-			return nil, sendErrorAndCloseWrite(protocol.AUTH_TOKEN_LIMIT_EXCEEDED, "tunnel limit exceeded for authentication token")
 		}
 	} else if authToken != "" {
 		// If auth manager is not configured but token is provided, reject
+		authFailures.Inc(AUTH_FAILURE_AUTH_NOT_CONFIGURED)
 		return nil, sendErrorAndCloseWrite(protocol.AUTH_TOKEN_INVALID, "authentication not configured on server")
 	}
 
+	// Validate tunnel type is supported by the server
+	switch tunnelType {
+	case constants.TUNNEL_TYPE_HTTP:
+	case constants.TUNNEL_TYPE_TCP:
+		if ms.tcpTunnelPorts == nil {
+			return nil, sendErrorAndCloseWrite(protocol.TUNNEL_TYPE_UNSUPPORTED, "tcp tunnels not enabled on server")
+		}
+	case constants.TUNNEL_TYPE_UDP:
+		if ms.udpTunnelPorts == nil {
+			return nil, sendErrorAndCloseWrite(protocol.TUNNEL_TYPE_UNSUPPORTED, "udp tunnels not enabled on server")
+		}
+	default:
+		return nil, sendErrorAndCloseWrite(protocol.TUNNEL_TYPE_UNSUPPORTED, "unsupported tunnel type")
+	}
+
 	// Acquire lock to create new client tunnel data
 	ms.mu.Lock()
 
+	// Check tunnel limit for this token, while holding the lock so tunnels created at
+	// the same time cannot exceed it
+	if ms.authManager != nil && ms.tunnels.countByToken(authToken) >= ms.authManager.GetTokenLimit(authToken) {
+		ms.mu.Unlock()
+		authFailures.Inc(AUTH_FAILURE_LIMIT_EXCEEDED)
+		return nil, sendErrorAndCloseWrite(protocol.AUTH_TOKEN_LIMIT_EXCEEDED, "tunnel limit exceeded for authentication token")
+	}
+
 	var uniqueSubdomain string
 	var msgType uint8
 	if subdomain != "" {
@@ -345,8 +555,8 @@ func (ms *MmarServer) newClientTunnel(tunnel protocol.Tunnel, subdomain string,
 			return nil, sendErrorAndCloseWrite(protocol.INVALID_SUBDOMAIN_NAME, "invalid subdomain name")
 		}
 
-		// Check if subdomain is already taken
-		if _, exists := ms.clients[subdomain]; exists {
+		// Check if subdomain is already taken, or reserved for another mmar client to reclaim
+		if _, exists := ms.tunnels.lookup(subdomain); exists || ms.subdomainReserved(subdomain, tunnelReq.ResumeToken) {
 			ms.mu.Unlock()
 			return nil, sendErrorAndCloseWrite(protocol.SUBDOMAIN_ALREADY_TAKEN, "subdomain already taken")
 		}
@@ -361,9 +571,8 @@ func (ms *MmarServer) newClientTunnel(tunnel protocol.Tunnel, subdomain string,
 
 	tunnel.Id = uniqueSubdomain
 
-	// Create channels to tunnel requests to and recieve responses from
+	// Create channel to tunnel requests to
 	incomingChannel := make(chan IncomingRequest)
-	outgoingChannel := make(chan protocol.TunnelMessage)
 
 	// Initialize inflight requests map for client tunnel
 	var inflightRequests sync.Map
@@ -372,182 +581,474 @@ func (ms *MmarServer) newClientTunnel(tunnel protocol.Tunnel, subdomain string,
 	clientTunnel := ClientTunnel{
 		tunnel,
 		incomingChannel,
-		outgoingChannel,
 		&inflightRequests,
 		authToken,
+		tunnelType,
+		tunnelReq.Labels,
+		tunnelReq.ClientVersion,
+		tunnelLimits(tunnelReq.Limits, ms.settings),
+		nil,
+		nil,
+		&sync.Map{},
+		&atomic.Int64{},
+		ms.settings.maxUdpSessions,
+		"",
+		&tunnelStats{},
+	}
+
+	// Issue a resume token to reclaim the subdomain with, mmar clients predating
+	// negotiation cannot present one
+	if tunnel.Version != constants.LEGACY_TUNNEL_MESSAGE_PROTOCOL_VERSION {
+		clientTunnel.resumeToken = GenerateResumeToken()
 	}
 
 	// Check if IP reached max tunnel limit
-	clientIP := utils.ExtractIP(tunnel.Conn.RemoteAddr().String())
-	limitedIP := ms.TunnelLimitedIP(clientIP)
+	limitedIP := ms.TunnelLimitedIP(clientTunnel.clientIP())
 	// If so, send limit message to client and close client tunnel
 	if limitedIP {
-		limitMessage := protocol.TunnelMessage{MsgType: protocol.CLIENT_TUNNEL_LIMIT}
-		if err := clientTunnel.SendMessage(limitMessage); err != nil {
+		ipLimitRejections.Inc()
+		limitMessage := protocol.TunnelMessage{
+			MsgType: protocol.CLIENT_TUNNEL_LIMIT,
+			MsgData: []byte(strconv.Itoa(ms.settings.maxTunnelsPerIP)),
+		}
+		if err := tunnel.SendMessage(limitMessage); err != nil {
 			logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send Tunnel Limit msg to client: %v", err))
 		}
 		// Close write side to signal end of data, but allow client to read the message
-		if tcpConn, ok := tunnel.Conn.(*net.TCPConn); ok {
-			tcpConn.CloseWrite()
-		}
+		closeWrite(tunnel.Conn)
 		clientTunnel.close(false)
 		// Release lock once errored
 		ms.mu.Unlock()
 		return nil, CLIENT_MAX_TUNNELS_REACHED
 	}
 
-	// Add client tunnel to clients
-	ms.clients[uniqueSubdomain] = clientTunnel
-
-	// Associate tunnel with client IP
-	ms.tunnelsPerIP[clientIP] = append(ms.tunnelsPerIP[clientIP], uniqueSubdomain)
-
-	// Associate tunnel with auth token if auth manager is configured
-	if ms.authManager != nil && authToken != "" {
-		ms.authManager.AddTunnel(authToken, uniqueSubdomain)
+	// Allocate a public port to accept connections or datagrams on for TCP/UDP tunnels
+	switch tunnelType {
+	case constants.TUNNEL_TYPE_TCP:
+		listener, err := ms.tcpTunnelPorts.listen(tunnelReq.Port)
+		if err != nil {
+			ms.mu.Unlock()
+			return nil, sendErrorAndCloseWrite(protocol.TUNNEL_PORTS_EXHAUSTED, "no tcp tunnel ports available")
+		}
+		clientTunnel.listener = listener
+	case constants.TUNNEL_TYPE_UDP:
+		packetConn, err := ms.udpTunnelPorts.listenPacket(tunnelReq.Port)
+		if err != nil {
+			ms.mu.Unlock()
+			return nil, sendErrorAndCloseWrite(protocol.TUNNEL_PORTS_EXHAUSTED, "no udp tunnel ports available")
+		}
+		clientTunnel.packetConn = packetConn
 	}
 
+	// Add client tunnel to the registry, indexed by its client IP and auth token. It no
+	// longer needs to be reserved if it was reclaimed.
+	ms.tunnels.insert(clientTunnel)
+	ms.releaseReservation(uniqueSubdomain)
+
 	// Release lock once created
 	ms.mu.Unlock()
 
-	// Send unique subdomain to client
-	connMessage := protocol.TunnelMessage{MsgType: msgType, MsgData: []byte(uniqueSubdomain)}
+	// Send unique subdomain to client, along with the public port for TCP/UDP tunnels
+	// and the resume token
+	tunnelCreatedData, err := protocol.TunnelCreated{
+		Subdomain:   uniqueSubdomain,
+		Port:        clientTunnel.publicPort(),
+		ResumeToken: clientTunnel.resumeToken,
+		Limits:      clientTunnel.limits,
+	}.MsgData()
+	if err != nil {
+		return nil, err
+	}
+	// mmar clients predating negotiation only expect the subdomain
+	if tunnel.Version == constants.LEGACY_TUNNEL_MESSAGE_PROTOCOL_VERSION {
+		tunnelCreatedData = []byte(uniqueSubdomain)
+	}
+	connMessage := protocol.TunnelMessage{MsgType: msgType, MsgData: tunnelCreatedData}
 	if err := clientTunnel.SendMessage(connMessage); err != nil {
 		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send unique subdomain msg to client: %v", err))
 		return nil, err
 	}
 
+	tunnelsCreated.Inc(tunnelType)
+
+	if clientTunnel.listener != nil {
+		go clientTunnel.acceptTcpConnections()
+	}
+	if clientTunnel.packetConn != nil {
+		go clientTunnel.acceptUdpDatagrams()
+	}
+
 	return &clientTunnel, nil
 }
 
 func (ms *MmarServer) handleTcpConnection(conn net.Conn) {
-	tunnel := protocol.Tunnel{
-		Conn:      conn,
-		CreatedOn: time.Now(),
-		Reader:    bufio.NewReader(conn),
+	// Complete the TLS handshake upfront, so connections that fail it are not processed
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), constants.TLS_HANDSHAKE_TIMEOUT*time.Second)
+		defer cancel()
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("TLS handshake with %s failed: %v", conn.RemoteAddr().String(), err))
+			conn.Close()
+			return
+		}
 	}
 
+	tunnel := protocol.NewTunnel(conn)
+	tunnel.MaxFrameSize = ms.currentSettings().maxFrameSize
+
 	// Process Tunnel Messages coming from mmar client
 	go ms.processTunnelMessages(tunnel)
 }
 
 func (ms *MmarServer) closeTunnel(t *protocol.Tunnel) {
-	t.Conn.Close()
+	t.Close()
 }
 
-func (ms *MmarServer) closeClientTunnel(ct *ClientTunnel) {
-	// Remove Client Tunnel from clients
-	delete(ms.clients, ct.Id)
-
-	// Remove Client Tunnel from client IP
-	clientIP := utils.ExtractIP(ct.Conn.RemoteAddr().String())
-	tunnels := ms.tunnelsPerIP[clientIP]
-	index := slices.Index(tunnels, ct.Id)
-	if index != -1 {
-		tunnels = slices.Delete(tunnels, index, index+1)
-		ms.tunnelsPerIP[clientIP] = tunnels
-	}
-
-	// Remove Client Tunnel from auth manager
-	if ms.authManager != nil && ct.authToken != "" {
-		ms.authManager.RemoveTunnel(ct.authToken, ct.Id)
+func (ms *MmarServer) closeClientTunnel(ct *ClientTunnel, reason string) {
+	if !ms.removeClientTunnel(ct, reason) {
+		return
 	}
 
 	// Gracefully close the Client Tunnel
 	ct.close(true)
 }
 
-func (ms *MmarServer) closeClientTunnelOrConn(ct *ClientTunnel, t protocol.Tunnel) {
+// Remove the tunnel from mmar server so it no longer receives requests, returns false
+// if it was already removed
+func (ms *MmarServer) removeClientTunnel(ct *ClientTunnel, reason string) bool {
+	ms.mu.Lock()
+
+	// The tunnel might have already been closed, and its subdomain reclaimed since
+	if !ms.tunnels.remove(ct) {
+		ms.mu.Unlock()
+		return false
+	}
+
+	// Reserve its subdomain for the mmar client to reclaim
+	ms.reserveSubdomain(ct)
+	ms.mu.Unlock()
+
+	tunnelsClosed.Inc(reason)
+	deleteTunnelMetrics(ct.Id)
+	return true
+}
+
+func (ms *MmarServer) closeClientTunnelOrConn(ct *ClientTunnel, t protocol.Tunnel, reason string) {
 
 	// If client has not reserved subdomain, just close the tcp connection
-	if !ct.ReservedSubdomain() {
+	if ct == nil || !ct.ReservedSubdomain() {
 		ms.closeTunnel(&t)
 		return
 	}
 
-	ms.closeClientTunnel(ct)
+	ms.closeClientTunnel(ct, reason)
 }
 
-func (ms *MmarServer) handleResponseMessages(ct *ClientTunnel, tunnelMsg protocol.TunnelMessage) {
-	respReader := bufio.NewReader(bytes.NewReader(tunnelMsg.MsgData))
+// Hijack the end-user's connection after it switched protocols (eg: websockets) and
+// stream raw data in both directions through the tunnel until either side closes
+func (ct *ClientTunnel) handleUpgradedConnection(
+	incomingReq IncomingRequest,
+	w http.ResponseWriter,
+	reqId RequestId,
+	resp OutgoingResponse,
+) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("[%s] Connection does not support switching protocols", ct.Tunnel.Id))
+		handleCancel(FAILED_TO_READ_RESP_FROM_MMAR_CLIENT_ERR, w, incomingReq.request)
+		return
+	}
 
-	// Extract RequestId
-	reqIdBuff := make([]byte, constants.REQUEST_ID_BUFF_SIZE)
-	_, err := io.ReadFull(respReader, reqIdBuff)
+	conn, bufrw, err := hijacker.Hijack()
 	if err != nil {
-		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("[%s] - Failed to parse RequestId for response: %v\n", ct.Tunnel.Id, err))
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("[%s] Failed to hijack connection: %v", ct.Tunnel.Id, err))
+		handleCancel(FAILED_TO_READ_RESP_FROM_MMAR_CLIENT_ERR, w, incomingReq.request)
+		return
+	}
+	defer conn.Close()
+
+	// Write the switching protocols response to the end-user
+	fmt.Fprintf(bufrw, "HTTP/1.1 %d %s\r\n", resp.statusCode, http.StatusText(resp.statusCode))
+	resp.header.Write(bufrw)
+	bufrw.WriteString("\r\n")
+	if err := bufrw.Flush(); err != nil {
 		return
 	}
 
-	// Get Inflight Request and remove it from inflight requests
-	reqId := RequestId(binary.LittleEndian.Uint32(reqIdBuff))
-	inflight, loaded := ct.inflightRequests.LoadAndDelete(reqId)
+	ct.streamConnection(incomingReq, conn, bufrw, reqId)
+}
+
+// Stream raw data of an end-user's connection in both directions through the tunnel,
+// until either the end-user or mmar client closes it
+func (ct *ClientTunnel) streamConnection(
+	incomingStream IncomingRequest,
+	conn net.Conn,
+	connReader io.Reader,
+	streamId RequestId,
+) {
+	// Stream data coming from the end-user to mmar client
+	endUserStreamDone := make(chan struct{})
+	go func() {
+		defer close(endUserStreamDone)
+		buf := protocol.NewRequestIdBuffer(uint32(streamId))
+		defer buf.Release()
+		for {
+			n, readErr := connReader.Read(buf.Data())
+			if n > 0 {
+				// Wait for mmar client to have room for more stream data
+				if err := incomingStream.sendWindow.Acquire(incomingStream.ctx, n); err != nil {
+					break
+				}
+				dataMsg := protocol.TunnelMessage{
+					MsgType: protocol.STREAM_DATA,
+					MsgData: buf.MsgData(n),
+				}
+				if err := ct.SendMessage(dataMsg); err != nil {
+					logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send Stream Data msg to client: %v", err))
+					break
+				}
+			}
+			if readErr != nil {
+				break
+			}
+		}
+
+		// If the stream is still open, the end-user closed it first, so let mmar client know
+		if _, open := ct.inflightRequests.LoadAndDelete(streamId); open {
+			closeMsg := protocol.TunnelMessage{
+				MsgType: protocol.STREAM_CLOSE,
+				MsgData: protocol.RequestIdMsgData(uint32(streamId), nil),
+			}
+			if err := ct.SendMessage(closeMsg); err != nil {
+				logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send Stream Close msg to client: %v", err))
+			}
+		}
+		incomingStream.cancel(nil)
+	}()
+
+	// Stream data coming from mmar client to the end-user, until mmar client closes the
+	// stream or it is canceled
+	io.Copy(conn, incomingStream.responseBody)
+
+	// Closing the connection stops reading from the end-user as well
+	conn.Close()
+	<-endUserStreamDone
+}
+
+// Retrieve inflight request a message from mmar client is keyed by
+func (ct *ClientTunnel) inflightRequestFromMsg(tunnelMsg protocol.TunnelMessage, remove bool) (IncomingRequest, []byte, bool) {
+	// Extract RequestId
+	id, data, err := protocol.ExtractRequestId(tunnelMsg.MsgData)
+	if err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("[%s] Failed to parse RequestId for response: %v", ct.Tunnel.Id, err))
+		return IncomingRequest{}, nil, false
+	}
+
+	reqId := RequestId(id)
+	var inflight any
+	var loaded bool
+	if remove {
+		inflight, loaded = ct.inflightRequests.LoadAndDelete(reqId)
+	} else {
+		inflight, loaded = ct.inflightRequests.Load(reqId)
+	}
 	if !loaded {
 		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("[%s] Failed to identify inflight request: %v", ct.Tunnel.Id, reqId))
-		return
+		return IncomingRequest{}, nil, false
 	}
 
 	inflightRequest, ok := inflight.(IncomingRequest)
 	if !ok {
 		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("[%s] Failed to parse inflight request: %v", ct.Tunnel.Id, reqId))
-		return
+		return IncomingRequest{}, nil, false
 	}
 
-	// Read response for forwarded request
-	resp, respErr := http.ReadResponse(respReader, inflightRequest.request)
+	return inflightRequest, data, true
+}
+
+func (ms *MmarServer) handleResponseMessages(ct *ClientTunnel, tunnelMsg protocol.TunnelMessage) {
+	// mmar clients that do not support streaming send the whole response at once, so it
+	// is no longer inflight
+	streaming := ct.Supports(constants.FEATURE_STREAMING)
+	inflightRequest, respData, ok := ct.inflightRequestFromMsg(tunnelMsg, !streaming)
+	if !ok {
+		return
+	}
 
+	// Read response line and headers for forwarded request, the body follows in chunks
+	resp, respErr := http.ReadResponse(bufio.NewReader(bytes.NewReader(respData)), inflightRequest.request)
+	var body []byte
+	if respErr == nil && !streaming {
+		body, respErr = io.ReadAll(resp.Body)
+	}
 	if respErr != nil {
-		if errors.Is(respErr, io.ErrUnexpectedEOF) || errors.Is(respErr, net.ErrClosed) {
-			inflightRequest.cancel(CLIENT_DISCONNECTED_ERR)
-			ms.closeClientTunnel(ct)
-			return
-		}
 		failedReq := fmt.Sprintf("%s - %s%s", inflightRequest.request.Method, html.EscapeString(inflightRequest.request.URL.Path), inflightRequest.request.URL.RawQuery)
 		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to return response: %v\n\n for req: %v", respErr, failedReq))
 		inflightRequest.cancel(FAILED_TO_READ_RESP_FROM_MMAR_CLIENT_ERR)
 		return
 	}
 
-	respBody, respBodyErr := io.ReadAll(resp.Body)
-	if respBodyErr != nil {
-		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to parse response body: %v\n\n", respBodyErr))
+	select {
+	case inflightRequest.responseChannel <- OutgoingResponse{statusCode: resp.StatusCode, header: resp.Header, body: body}:
+		// Send response data back
+	default:
+		// Response was already sent for request, ignore duplicate
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("[%s] Received duplicate response for request", ct.Tunnel.Id))
+	}
+}
+
+func (ms *MmarServer) handleResponseBodyChunk(ct *ClientTunnel, tunnelMsg protocol.TunnelMessage) {
+	inflightRequest, chunk, ok := ct.inflightRequestFromMsg(tunnelMsg, false)
+	if !ok {
+		tunnelMsg.Release()
+		return
+	}
+
+	// Buffer response body chunk until it is written to the end-user, errors occur if the
+	// request is already canceled, so the chunk is not needed, or if mmar client sent more
+	// than it was allowed to
+	if err := inflightRequest.responseBody.Write(chunk, tunnelMsg.Release); errors.Is(err, protocol.STREAM_WINDOW_EXCEEDED) {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("[%s] Failed to buffer response body: %v", ct.Tunnel.Id, err))
 		inflightRequest.cancel(READ_RESP_BODY_ERR)
+	}
+}
+
+func (ms *MmarServer) handleResponseBodyEnd(ct *ClientTunnel, tunnelMsg protocol.TunnelMessage) {
+	// Response is complete, so it is no longer inflight
+	inflightRequest, _, ok := ct.inflightRequestFromMsg(tunnelMsg, true)
+	if !ok {
 		return
 	}
+	inflightRequest.responseBody.Close()
+}
 
-	defer resp.Body.Close()
+func (ms *MmarServer) handleResponseBodyAbort(ct *ClientTunnel, tunnelMsg protocol.TunnelMessage) {
+	inflightRequest, _, ok := ct.inflightRequestFromMsg(tunnelMsg, true)
+	if !ok {
+		return
+	}
+	inflightRequest.cancel(READ_RESP_BODY_ERR)
+}
 
-	// Set headers for response
-	for hKey, hVal := range resp.Header {
-		inflightRequest.responseWriter.Header().Set(hKey, hVal[0])
-		// Add remaining values for header if more than than one exists
-		for i := 1; i < len(hVal); i++ {
-			inflightRequest.responseWriter.Header().Add(hKey, hVal[i])
-		}
+// Respond to an inflight request with the tunnel error mmar client reported
+func (ms *MmarServer) respondWithTunnelErrState(ct *ClientTunnel, tunnelMsg protocol.TunnelMessage, errState uint8) {
+	inflightRequest, _, ok := ct.inflightRequestFromMsg(tunnelMsg, true)
+	if !ok {
+		return
+	}
+
+	tunnelErr, ok := tunnelErrorsByErrState[errState]
+	if !ok {
+		tunnelErr = UNKNOWN_TUNNEL_ERR
 	}
 
 	select {
 	case <-inflightRequest.ctx.Done():
 		// Request is canceled, do nothing
+	case inflightRequest.responseChannel <- OutgoingResponse{statusCode: tunnelErr.statusCode, tunnelErr: &tunnelErr}:
+		// Send tunnel error back
+	}
+}
+
+// Grant more room to send on a stream, once mmar client consumed its data
+func (ms *MmarServer) handleWindowUpdate(ct *ClientTunnel, tunnelMsg protocol.TunnelMessage) {
+	reqId, increment, err := protocol.ExtractWindowUpdate(tunnelMsg.MsgData)
+	if err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("[%s] Failed to parse Window Update: %v", ct.Tunnel.Id, err))
 		return
-	case inflightRequest.responseChannel <- OutgoingResponse{statusCode: resp.StatusCode, body: respBody}:
-		// Send response data back
 	}
+
+	// The stream might have already completed, in which case the update is not needed
+	inflight, ok := ct.inflightRequests.Load(RequestId(reqId))
+	if !ok {
+		return
+	}
+	inflight.(IncomingRequest).sendWindow.Update(increment)
+}
+
+// Features supported by mmar server, advertised to mmar clients during negotiation
+func (ms *MmarServer) features() []string {
+	features := []string{constants.FEATURE_STREAMING, constants.FEATURE_WEBSOCKET, constants.FEATURE_TUNNEL_CLOSED}
+	if ms.tcpTunnelPorts != nil {
+		features = append(features, constants.FEATURE_TCP_TUNNELS)
+	}
+	if ms.udpTunnelPorts != nil {
+		features = append(features, constants.FEATURE_UDP_TUNNELS)
+	}
+	return features
+}
+
+// Settle on the protocol version and features to use with mmar client, returns false
+// if they cannot be agreed on
+func (ms *MmarServer) handleHello(t *protocol.Tunnel, tunnelMsg protocol.TunnelMessage) bool {
+	hello, err := protocol.ParseHello(tunnelMsg.MsgData)
+	if err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to parse Hello msg from client: %v", err))
+		return false
+	}
+
+	ack := hello.Negotiate([]int{constants.TUNNEL_MESSAGE_PROTOCOL_VERSION}, ms.features())
+	ackData, err := ack.MsgData()
+	if err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to serialize Hello Ack msg: %v", err))
+		return false
+	}
+	ackMsg := protocol.TunnelMessage{MsgType: protocol.HELLO_ACK, MsgData: ackData}
+	if err := t.SendMessage(ackMsg); err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send Hello Ack msg to client: %v", err))
+		return false
+	}
+
+	// mmar client is informed there is no common version with a version of 0
+	if ack.Version == 0 {
+		logger.Log(
+			constants.DEFAULT_COLOR,
+			fmt.Sprintf("No common protocol version with client %s: %v", t.Conn.RemoteAddr().String(), hello.Versions),
+		)
+		return false
+	}
+
+	t.Version = uint8(ack.Version)
+	t.Features = ack.Features
+	return true
+}
+
+// Whether the message is about a request (or stream) of a ClientTunnel, so it cannot be
+// handled before the tunnel is created
+func isClientTunnelMessage(msgType uint8) bool {
+	switch msgType {
+	case protocol.RESPONSE,
+		protocol.RESPONSE_BODY_CHUNK, protocol.STREAM_DATA, protocol.UDP_DATAGRAM,
+		protocol.RESPONSE_BODY_END, protocol.STREAM_CLOSE, protocol.UDP_SESSION_CLOSE,
+		protocol.RESPONSE_BODY_ABORT, protocol.WINDOW_UPDATE,
+		protocol.LOCALHOST_NOT_RUNNING, protocol.DEST_REQUEST_TIMEDOUT, protocol.INVALID_RESP_FROM_DEST:
+		return true
+	}
+	return false
 }
 
 func (ms *MmarServer) processTunnelMessages(t protocol.Tunnel) {
 	var ct *ClientTunnel
+	heartbeatTimeout := ms.currentSettings().heartbeatTimeout
+	// Unix time in nanoseconds the heartbeat awaiting an ack was sent at, 0 if none is
+	var heartbeatSentOn atomic.Int64
 	for {
+		// Once created, the tunnel's own heartbeat timeout applies
+		if ct != nil {
+			heartbeatTimeout = time.Duration(ct.limits.HeartbeatTimeout) * time.Second
+		}
+
 		// Send heartbeat if nothing has been read for a while
 		receiveMessageTimeout := time.AfterFunc(
-			constants.HEARTBEAT_FROM_SERVER_TIMEOUT*time.Second,
+			heartbeatTimeout,
 			func() {
 				heartbeatMsg := protocol.TunnelMessage{MsgType: protocol.HEARTBEAT_FROM_SERVER}
 				if err := t.SendMessage(heartbeatMsg); err != nil {
 					logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send heartbeat: %v", err))
-					ms.closeClientTunnelOrConn(ct, t)
+					ms.closeClientTunnelOrConn(ct, t, CLOSE_REASON_CONNECTION_LOST)
 					return
 				}
+				heartbeatSentOn.Store(time.Now().UnixNano())
 				// Set a read timeout, if no response to heartbeat is received within that period,
 				// that means the client has disconnected
 				readDeadline := time.Now().Add((constants.READ_DEADLINE * time.Second))
@@ -564,33 +1065,71 @@ func (ms *MmarServer) processTunnelMessages(t protocol.Tunnel) {
 		if err != nil {
 			logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Receive Message from client tunnel errored: %v", err))
 			if utils.NetworkError(err) {
-				// If error with connection, stop processing messages
-				ms.closeClientTunnelOrConn(ct, t)
+				// If error with connection, stop processing messages. The read deadline is
+				// only exceeded when a heartbeat was not responded to in time.
+				reason := CLOSE_REASON_CONNECTION_LOST
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					reason = CLOSE_REASON_HEARTBEAT_TIMEOUT
+				}
+				ms.closeClientTunnelOrConn(ct, t, reason)
+				return
+			}
+			// The rest of a malformed message is left unread, so nothing after it can be read
+			var protocolErr *protocol.ProtocolError
+			if errors.As(err, &protocolErr) {
+				ms.closeClientTunnelOrConn(ct, t, CLOSE_REASON_PROTOCOL_ERROR)
+				return
+			}
+			continue
+		}
+
+		if ct != nil {
+			ct.recordBytes("out", len(tunnelMsg.MsgData))
+		}
+
+		// mmar clients predating negotiation do not send HELLO, so keep using the protocol
+		// version they speak, without any of the features added since
+		if t.Version == 0 && tunnelMsg.MsgType != protocol.HELLO {
+			t.Version = tunnelMsg.Version
+		}
+
+		// Messages about requests (or streams) are only expected once a tunnel is created,
+		// they are skipped otherwise, unless the other side keeps sending them
+		if ct == nil && isClientTunnelMessage(tunnelMsg.MsgType) {
+			tunnelMsg.Release()
+			if err := t.RecordMalformedMessage(); err != nil {
+				logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Receive Message from client tunnel errored: %v", err))
+				ms.closeClientTunnelOrConn(ct, t, CLOSE_REASON_PROTOCOL_ERROR)
 				return
 			}
 			continue
 		}
 
 		switch tunnelMsg.MsgType {
+		case protocol.HELLO:
+			// The tunnel is already created with the protocol it negotiated
+			if ct != nil {
+				continue
+			}
+			if !ms.handleHello(&t, tunnelMsg) {
+				ms.closeTunnel(&t)
+				return
+			}
 		case protocol.CREATE_TUNNEL:
 			// mmar client requesting new tunnel
-			msgData := string(tunnelMsg.MsgData)
-			var customName, authToken string
-
-			// Parse message data: "customName|authToken"
-			if msgData != "" {
-				parts := strings.Split(msgData, "|")
-				if len(parts) >= 1 {
-					customName = parts[0]
-				}
-				if len(parts) >= 2 {
-					authToken = parts[1]
-				}
+			tunnelReq, err := parseTunnelRequest(t, tunnelMsg)
+			if err != nil {
+				logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to parse Create Tunnel msg from client: %v", err))
+				ms.closeTunnel(&t)
+				return
 			}
+			// Only reclaiming tunnels can request a specific public port
+			tunnelReq.Port = 0
 
-			ct, err = ms.newClientTunnel(t, customName, authToken)
+			ct, err = ms.newClientTunnel(t, tunnelReq)
 			if err != nil {
 				logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to create ClientTunnel: %v", err))
+				ms.closeTunnel(&t)
 				return
 			}
 
@@ -604,31 +1143,26 @@ func (ms *MmarServer) processTunnelMessages(t protocol.Tunnel) {
 			)
 		case protocol.RECLAIM_TUNNEL:
 			// mmar client reclaiming a previously created tunnel
-			msgData := string(tunnelMsg.MsgData)
-			var existingId, authToken string
-
-			// Parse message data: "subdomain|authToken"
-			if msgData != "" {
-				parts := strings.Split(msgData, "|")
-				if len(parts) >= 1 {
-					existingId = parts[0]
-				}
-				if len(parts) >= 2 {
-					authToken = parts[1]
-				}
+			tunnelReq, err := parseTunnelRequest(t, tunnelMsg)
+			if err != nil {
+				logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to parse Reclaim Tunnel msg from client: %v", err))
+				ms.closeTunnel(&t)
+				return
 			}
+			existingId := tunnelReq.Subdomain
 
 			// Check if the subdomain has already been taken
-			_, ok := ms.clients[existingId]
+			_, ok := ms.tunnels.lookup(existingId)
 			if ok {
 				// if so, close the tunnel, so the user can create a new one
-				ms.closeClientTunnelOrConn(ct, t)
+				ms.closeClientTunnelOrConn(ct, t, CLOSE_REASON_RECLAIM_CONFLICT)
 				return
 			}
 
-			ct, err = ms.newClientTunnel(t, existingId, authToken)
+			ct, err = ms.newClientTunnel(t, tunnelReq)
 			if err != nil {
 				logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to reclaim ClientTunnel: %v", err))
+				ms.closeTunnel(&t)
 				return
 			}
 
@@ -641,58 +1175,69 @@ func (ms *MmarServer) processTunnelMessages(t protocol.Tunnel) {
 				),
 			)
 		case protocol.RESPONSE:
-			go ms.handleResponseMessages(ct, tunnelMsg)
+			ms.handleResponseMessages(ct, tunnelMsg)
+		case protocol.RESPONSE_BODY_CHUNK, protocol.STREAM_DATA, protocol.UDP_DATAGRAM:
+			ms.handleResponseBodyChunk(ct, tunnelMsg)
+		case protocol.RESPONSE_BODY_END, protocol.STREAM_CLOSE, protocol.UDP_SESSION_CLOSE:
+			ms.handleResponseBodyEnd(ct, tunnelMsg)
+		case protocol.RESPONSE_BODY_ABORT:
+			ms.handleResponseBodyAbort(ct, tunnelMsg)
+		case protocol.WINDOW_UPDATE:
+			ms.handleWindowUpdate(ct, tunnelMsg)
 		case protocol.LOCALHOST_NOT_RUNNING:
-			// Create a response for Tunnel connected but localhost not running
-			errState := protocol.TunnelErrState(protocol.LOCALHOST_NOT_RUNNING)
-			responseBuff := createSerializedServerResp("200 OK", http.StatusOK, errState)
-			notRunningMsg := protocol.TunnelMessage{
-				MsgType: protocol.RESPONSE,
-				MsgData: append(tunnelMsg.MsgData, responseBuff.Bytes()...),
-			}
-			go ms.handleResponseMessages(ct, notRunningMsg)
+			// Respond with a tunnel error for Tunnel connected but localhost not running
+			go ms.respondWithTunnelErrState(ct, tunnelMsg, protocol.LOCALHOST_NOT_RUNNING)
 		case protocol.DEST_REQUEST_TIMEDOUT:
-			// Create a response for Tunnel connected but localhost took too long to respond
-			errState := protocol.TunnelErrState(protocol.DEST_REQUEST_TIMEDOUT)
-			responseBuff := createSerializedServerResp("200 OK", http.StatusOK, errState)
-			destTimedoutMsg := protocol.TunnelMessage{
-				MsgType: protocol.RESPONSE,
-				MsgData: append(tunnelMsg.MsgData, responseBuff.Bytes()...),
-			}
-			go ms.handleResponseMessages(ct, destTimedoutMsg)
+			// Respond with a tunnel error for Tunnel connected but localhost took too long to respond
+			go ms.respondWithTunnelErrState(ct, tunnelMsg, protocol.DEST_REQUEST_TIMEDOUT)
 		case protocol.CLIENT_DISCONNECT:
-			ms.closeClientTunnelOrConn(ct, t)
+			// mmar client shut down, so there is no need to reserve its subdomain
+			if ct != nil {
+				ct.resumeToken = ""
+			}
+			ms.closeClientTunnelOrConn(ct, t, CLOSE_REASON_CLIENT_SHUTDOWN)
 			return
 		case protocol.HEARTBEAT_FROM_CLIENT:
+			// Skip the ack if the outgoing queue is full, the client gives up on the tunnel
+			// if it stays that way
 			heartbeatAckMsg := protocol.TunnelMessage{MsgType: protocol.HEARTBEAT_ACK}
-			if err := t.SendMessage(heartbeatAckMsg); err != nil {
+			if err := t.PostMessage(heartbeatAckMsg); err != nil && !errors.Is(err, protocol.OUTGOING_QUEUE_FULL) {
 				logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to heartbeat ack to client: %v", err))
-				ms.closeClientTunnelOrConn(ct, t)
+				ms.closeClientTunnelOrConn(ct, t, CLOSE_REASON_CONNECTION_LOST)
 				return
 			}
 		case protocol.HEARTBEAT_ACK:
 			// Got a heartbeat ack, that means the connection is healthy,
-			// we do not need to perform any action
+			// we only record how long it took
+			ct.recordHeartbeatAck(heartbeatSentOn.Swap(0))
 		case protocol.INVALID_RESP_FROM_DEST:
-			// Create a response for receiving invalid response from destination server
-			errState := protocol.TunnelErrState(protocol.INVALID_RESP_FROM_DEST)
-			responseBuff := createSerializedServerResp("500 Internal Server Error", http.StatusInternalServerError, errState)
-			invalidRespFromDestMsg := protocol.TunnelMessage{
-				MsgType: protocol.RESPONSE,
-				MsgData: append(tunnelMsg.MsgData, responseBuff.Bytes()...),
-			}
-			go ms.handleResponseMessages(ct, invalidRespFromDestMsg)
+			// Respond with a tunnel error for receiving invalid response from destination server
+			go ms.respondWithTunnelErrState(ct, tunnelMsg, protocol.INVALID_RESP_FROM_DEST)
 		}
 	}
 }
 
 func Run(config ConfigOptions) {
+	// Options set in the config file override the ones passed in through command flags
+	flagsConfig := config
+	if config.ConfigFile != "" {
+		var err error
+		config, err = LoadConfigFile(config.ConfigFile, flagsConfig)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	}
+
 	logger.LogStartMmarServer(config.TcpPort, config.HttpPort)
 
 	// Channel handler for interrupt signal
 	sigInt := make(chan os.Signal, 1)
 	signal.Notify(sigInt, os.Interrupt)
 
+	// Channel handler for hangup signal, to reload the config
+	sigHup := make(chan os.Signal, 1)
+	signal.Notify(sigHup, syscall.SIGHUP)
+
 	mux := http.NewServeMux()
 
 	// Initialize Auth Manager if API keys file is provided
@@ -705,23 +1250,102 @@ func Run(config ConfigOptions) {
 			logger.Log(constants.YELLOW, "Server will start without authentication")
 		} else {
 			logger.Log(constants.GREEN, fmt.Sprintf("Authentication enabled with API keys file: %s", config.ApiKeysFile))
+			if !utils.CredentialsConfigured() {
+				logger.Log(constants.YELLOW, "API keys cannot be changed through the admin API until USERNAME_HASH and PASSWORD_HASH are set")
+			}
+		}
+	}
+
+	// Parse range of public ports for TCP tunnels if provided, otherwise they are disabled
+	var tcpTunnelPorts *PortRange
+	if config.TcpTunnelPorts != "" {
+		var err error
+		tcpTunnelPorts, err = ParsePortRange(config.TcpTunnelPorts, config.ListenAddress)
+		if err != nil {
+			log.Fatalf("Failed to parse TCP tunnel ports: %v", err)
+		}
+		logger.Log(constants.GREEN, fmt.Sprintf("TCP tunnels enabled on ports: %s", tcpTunnelPorts))
+	}
+
+	// Parse range of public ports for UDP tunnels if provided, otherwise they are disabled
+	var udpTunnelPorts *PortRange
+	if config.UdpTunnelPorts != "" {
+		var err error
+		udpTunnelPorts, err = ParsePortRange(config.UdpTunnelPorts, config.ListenAddress)
+		if err != nil {
+			log.Fatalf("Failed to parse UDP tunnel ports: %v", err)
 		}
+		logger.Log(constants.GREEN, fmt.Sprintf("UDP tunnels enabled on ports: %s", udpTunnelPorts))
+	}
+
+	// Parse limits and settings that can be reloaded, along with custom error pages if
+	// provided, otherwise the built-in ones are used
+	settings, err := newServerSettings(config)
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	if config.ErrorPagesDir != "" {
+		logger.Log(constants.GREEN, fmt.Sprintf("Custom error pages loaded from: %s", config.ErrorPagesDir))
 	}
 
 	// Initialize Mmar Server
 	mmarServer := MmarServer{
-		clients:      map[string]ClientTunnel{},
-		tunnelsPerIP: map[string][]string{},
-		authManager:  authManager,
+		tunnels:           newTunnelRegistry(),
+		authManager:       authManager,
+		tcpTunnelPorts:    tcpTunnelPorts,
+		udpTunnelPorts:    udpTunnelPorts,
+		reservations:      map[string]*reservation{},
+		adminReservations: map[string]*adminReservation{},
+		settings:          settings,
+		config:            config,
+		flagsConfig:       flagsConfig,
 	}
 	mux.Handle("/", logger.LoggerMiddleware(&mmarServer))
 
+	// Encrypt connections from mmar clients with TLS if a certificate is provided
+	var tlsConfig *tls.Config
+	if config.TlsCertFile != "" || config.TlsKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.TlsCertFile, config.TlsKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		logger.Log(constants.GREEN, fmt.Sprintf("TLS enabled with certificate: %s", config.TlsCertFile))
+
+		// Client certificates are optional unless required, so clients can still
+		// authenticate with API keys
+		if config.TlsClientCaFile != "" {
+			clientCAs, err := loadCertPool(config.TlsClientCaFile)
+			if err != nil {
+				log.Fatalf("Failed to load TLS client CA certificates: %v", err)
+			}
+			tlsConfig.ClientCAs = clientCAs
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			if config.TlsRequireClientCert {
+				tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			logger.Log(constants.GREEN, fmt.Sprintf("TLS client certificates verified against: %s", config.TlsClientCaFile))
+		}
+	}
+	if tlsConfig == nil && (config.TlsClientCaFile != "" || config.TlsRequireClientCert) {
+		log.Fatalf("Verifying TLS client certificates requires --tls-cert and --tls-key")
+	}
+	if config.TlsRequireClientCert && config.TlsClientCaFile == "" {
+		log.Fatalf("Requiring TLS client certificates requires --tls-client-ca")
+	}
+
 	go func() {
-		ln, err := net.Listen("tcp", fmt.Sprintf(":%s", config.TcpPort))
+		ln, err := net.Listen("tcp", net.JoinHostPort(config.ListenAddress, config.TcpPort))
 		if err != nil {
 			log.Fatalf("Failed to start TCP server: %v", err)
 			return
 		}
+		if tlsConfig != nil {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
 		logger.Log(
 			constants.DEFAULT_COLOR,
 			fmt.Sprintf(
@@ -748,12 +1372,21 @@ func Run(config ConfigOptions) {
 				config.HttpPort,
 			),
 		)
-		if err := http.ListenAndServe(fmt.Sprintf(":%s", config.HttpPort), mux); err != nil && err != http.ErrServerClosed {
+		if err := http.ListenAndServe(net.JoinHostPort(config.ListenAddress, config.HttpPort), mux); err != nil && err != http.ErrServerClosed {
 			fmt.Fprintf(os.Stderr, "Error listening and serving: %s\n", err)
 		}
 	}()
 
-	// Wait for an interrupt signal, if received, terminate gracefully
-	<-sigInt
-	log.Printf("Gracefully shutting down server...")
+	// Reload the config on hangup signals, until an interrupt signal is received to
+	// terminate gracefully
+	for {
+		select {
+		case <-sigHup:
+			logger.Log(constants.DEFAULT_COLOR, "Reloading config...")
+			mmarServer.reloadConfig()
+		case <-sigInt:
+			log.Printf("Gracefully shutting down server...")
+			return
+		}
+	}
 }
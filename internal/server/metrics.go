@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/yusuf-musleh/mmar/constants"
+	"github.com/yusuf-musleh/mmar/internal/logger"
+	"github.com/yusuf-musleh/mmar/internal/metrics"
+	"github.com/yusuf-musleh/mmar/internal/utils"
+)
+
+// Reasons tunnels are closed for, as labeled in the metrics
+const (
+	CLOSE_REASON_CLIENT_SHUTDOWN   = "client_shutdown"
+	CLOSE_REASON_CONNECTION_LOST   = "connection_lost"
+	CLOSE_REASON_HEARTBEAT_TIMEOUT = "heartbeat_timeout"
+	CLOSE_REASON_RECLAIM_CONFLICT  = "reclaim_conflict"
+	CLOSE_REASON_PROTOCOL_ERROR    = "protocol_error"
+)
+
+// Reasons mmar clients failed to authenticate for, as labeled in the metrics
+const (
+	AUTH_FAILURE_TOKEN_REQUIRED      = "token_required"
+	AUTH_FAILURE_TOKEN_INVALID       = "token_invalid"
+	AUTH_FAILURE_LIMIT_EXCEEDED      = "limit_exceeded"
+	AUTH_FAILURE_CLIENT_CERT_INVALID = "client_cert_invalid"
+	AUTH_FAILURE_AUTH_NOT_CONFIGURED = "auth_not_configured"
+)
+
+// Metrics of mmar server exposed on the stats subdomain, the ones labeled by tunnel are
+// removed once the tunnel is closed
+var (
+	metricsRegistry = metrics.NewRegistry()
+	activeTunnels   = metricsRegistry.NewGauge(
+		"mmar_active_tunnels",
+		"Number of tunnels currently open.",
+		"type",
+	)
+	tunnelsCreated = metricsRegistry.NewCounter(
+		"mmar_tunnels_created_total",
+		"Number of tunnels created, including reclaimed ones.",
+		"type",
+	)
+	tunnelsClosed = metricsRegistry.NewCounter(
+		"mmar_tunnels_closed_total",
+		"Number of tunnels closed, by the reason they were closed for.",
+		"reason",
+	)
+	httpRequests = metricsRegistry.NewCounter(
+		"mmar_http_requests_total",
+		"Number of requests tunneled, by tunnel and status class of their response.",
+		"tunnel", "status_class",
+	)
+	httpRequestDuration = metricsRegistry.NewHistogram(
+		"mmar_http_request_duration_seconds",
+		"Time taken to respond to requests tunneled, by tunnel.",
+		metrics.DEFAULT_BUCKETS,
+		"tunnel",
+	)
+	tunnelBytes = metricsRegistry.NewCounter(
+		"mmar_tunnel_bytes_total",
+		"Bytes of message data exchanged with mmar clients, by tunnel and direction, in towards mmar client or out from it.",
+		"tunnel", "direction",
+	)
+	heartbeatRtt = metricsRegistry.NewHistogram(
+		"mmar_heartbeat_rtt_seconds",
+		"Round-trip time of heartbeats sent to mmar clients.",
+		metrics.DEFAULT_BUCKETS,
+	)
+	authFailures = metricsRegistry.NewCounter(
+		"mmar_auth_failures_total",
+		"Number of mmar clients that failed to authenticate, by reason.",
+		"reason",
+	)
+	ipLimitRejections = metricsRegistry.NewCounter(
+		"mmar_ip_limit_rejections_total",
+		"Number of tunnels rejected for reaching the maximum number of tunnels per IP.",
+	)
+)
+
+// Record a request tunneled through the tunnel, along with the time taken to respond to it
+func (ct *ClientTunnel) recordHttpRequest(statusCode int, duration time.Duration) {
+	httpRequests.Inc(ct.Id, fmt.Sprintf("%dxx", statusCode/100))
+	httpRequestDuration.Observe(duration.Seconds(), ct.Id)
+	ct.stats.recordRequest(statusCode, duration)
+}
+
+// Record the message data exchanged with mmar client of the tunnel
+func (ct *ClientTunnel) recordBytes(direction string, n int) {
+	if ct.Id == "" || n == 0 {
+		return
+	}
+	tunnelBytes.Add(float64(n), ct.Id, direction)
+	ct.stats.recordBytes(direction, n)
+}
+
+// Remove the metrics labeled by a tunnel once it is closed
+func deleteTunnelMetrics(tunnelId string) {
+	httpRequests.DeleteLabel("tunnel", tunnelId)
+	httpRequestDuration.DeleteLabel("tunnel", tunnelId)
+	tunnelBytes.DeleteLabel("tunnel", tunnelId)
+}
+
+// Serves metrics of mmar server in the Prometheus text exposition format, behind the
+// same Basic Authentication as the stats
+func (ms *MmarServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !authorizedAdmin(w, r) {
+		return
+	}
+
+	// Active tunnels are counted when scraped, so they always match the tunnels open
+	tunnelsByType := map[string]int{
+		constants.TUNNEL_TYPE_HTTP: 0,
+		constants.TUNNEL_TYPE_TCP:  0,
+		constants.TUNNEL_TYPE_UDP:  0,
+	}
+	for _, ct := range ms.tunnels.all() {
+		tunnelsByType[ct.tunnelType]++
+	}
+	for tunnelType, count := range tunnelsByType {
+		activeTunnels.Set(float64(count), tunnelType)
+	}
+
+	w.Header().Set("Content-Type", metrics.CONTENT_TYPE)
+	w.WriteHeader(http.StatusOK)
+	if _, err := metricsRegistry.WriteTo(w); err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to write metrics: %v", err))
+	}
+}
+
+// Check the request has valid Basic Authentication credentials for the stats and
+// metrics, otherwise it is responded to as unauthorized
+func authorizedAdmin(w http.ResponseWriter, r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok || !utils.ValidCredentials(username, password) {
+		w.Header().Add("WWW-Authenticate", "Basic realm=\"stats\"")
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// Record the round-trip time of a heartbeat once its ack is received, sentOn is the
+// Unix time in nanoseconds it was sent at, 0 if none is awaiting an ack. The tunnel is
+// nil if mmar client has not created one yet.
+func (ct *ClientTunnel) recordHeartbeatAck(sentOn int64) {
+	if sentOn == 0 {
+		return
+	}
+	rtt := time.Since(time.Unix(0, sentOn))
+	heartbeatRtt.Observe(rtt.Seconds())
+	if ct != nil {
+		ct.stats.lastHeartbeatRtt.Store(int64(rtt))
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/yusuf-musleh/mmar/internal/utils"
+)
+
+// Tunnels open on mmar server by their subdomain, indexed by the IP of their mmar client
+// and the API key (or client certificate identity) they were created with. It is safe
+// for concurrent use, tunnels are looked up while serving requests as others are
+// created and closed.
+type tunnelRegistry struct {
+	mu      sync.RWMutex
+	tunnels map[string]ClientTunnel
+	byIP    map[string][]string
+	byToken map[string][]string
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+	return &tunnelRegistry{
+		tunnels: map[string]ClientTunnel{},
+		byIP:    map[string][]string{},
+		byToken: map[string][]string{},
+	}
+}
+
+// IP of the mmar client of the tunnel
+func (ct *ClientTunnel) clientIP() string {
+	return utils.ExtractIP(ct.Conn.RemoteAddr().String())
+}
+
+func (tr *tunnelRegistry) lookup(id string) (ClientTunnel, bool) {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	ct, ok := tr.tunnels[id]
+	return ct, ok
+}
+
+// Add the tunnel, returns false if there is already one with its subdomain
+func (tr *tunnelRegistry) insert(ct ClientTunnel) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if _, exists := tr.tunnels[ct.Id]; exists {
+		return false
+	}
+	tr.tunnels[ct.Id] = ct
+	ip := ct.clientIP()
+	tr.byIP[ip] = append(tr.byIP[ip], ct.Id)
+	if ct.authToken != "" {
+		tr.byToken[ct.authToken] = append(tr.byToken[ct.authToken], ct.Id)
+	}
+	return true
+}
+
+// Remove the tunnel, returns false if it was already removed. Another tunnel might have
+// reclaimed its subdomain since, so it is only removed if it is on the same connection.
+func (tr *tunnelRegistry) remove(ct *ClientTunnel) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if existing, ok := tr.tunnels[ct.Id]; !ok || existing.Conn != ct.Conn {
+		return false
+	}
+	delete(tr.tunnels, ct.Id)
+	removeFromIndex(tr.byIP, ct.clientIP(), ct.Id)
+	if ct.authToken != "" {
+		removeFromIndex(tr.byToken, ct.authToken, ct.Id)
+	}
+	return true
+}
+
+// Remove the tunnel from the ones indexed under the key, dropping the key once it has
+// none left so the indexes do not grow with every IP ever seen
+func removeFromIndex(index map[string][]string, key string, id string) {
+	ids := slices.DeleteFunc(index[key], func(existing string) bool { return existing == id })
+	if len(ids) == 0 {
+		delete(index, key)
+		return
+	}
+	index[key] = ids
+}
+
+// Copy of all the tunnels, to iterate over without holding the lock
+func (tr *tunnelRegistry) all() []ClientTunnel {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+
+	tunnels := make([]ClientTunnel, 0, len(tr.tunnels))
+	for _, ct := range tr.tunnels {
+		tunnels = append(tunnels, ct)
+	}
+	return tunnels
+}
+
+func (tr *tunnelRegistry) countByIP(ip string) int {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	return len(tr.byIP[ip])
+}
+
+func (tr *tunnelRegistry) countByToken(token string) int {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	return len(tr.byToken[token])
+}
+
+// Subdomains of the tunnels created with the API key (or identity) token
+func (tr *tunnelRegistry) idsByToken(token string) []string {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	return slices.Clone(tr.byToken[token])
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/yusuf-musleh/mmar/constants"
+)
+
+var SUBDOMAIN_NOT_RESERVED_ERR = errors.New("Subdomain is not reserved")
+var RECONNECT_QUEUE_FULL_ERR = errors.New(constants.RECONNECT_QUEUE_FULL_ERR_TEXT)
+var RECONNECT_TIMEDOUT_ERR = errors.New(constants.RECONNECT_TIMEDOUT_ERR_TEXT)
+
+// Subdomain of a disconnected tunnel, reserved for the mmar client that held it to
+// reclaim with its resume token until the grace period ends. Requests to HTTP tunnels
+// are held in the meantime, and forwarded once the subdomain is reclaimed.
+type reservation struct {
+	resumeToken string
+	tunnelType  string
+	expiresOn   time.Time
+	// Closed once the subdomain is reclaimed
+	reclaimed      chan struct{}
+	queuedRequests int
+	queuedBytes    int64
+}
+
+// Reserve the subdomain of a tunnel that disconnected without shutting down, so only
+// the mmar client holding its resume token can reclaim it. Callers must hold the lock.
+func (ms *MmarServer) reserveSubdomain(ct *ClientTunnel) {
+	// mmar clients predating negotiation are not issued resume tokens
+	if ct.resumeToken == "" || ms.settings.reclaimGracePeriod <= 0 {
+		return
+	}
+
+	// Clean up reservations that were never reclaimed
+	now := time.Now()
+	for subdomain, r := range ms.reservations {
+		if now.After(r.expiresOn) {
+			delete(ms.reservations, subdomain)
+		}
+	}
+
+	ms.reservations[ct.Id] = &reservation{
+		resumeToken: ct.resumeToken,
+		tunnelType:  ct.tunnelType,
+		expiresOn:   now.Add(ms.settings.reclaimGracePeriod),
+		reclaimed:   make(chan struct{}),
+	}
+}
+
+// Check if the subdomain is reserved for another mmar client than the one presenting
+// the resume token. Callers must hold the lock.
+func (ms *MmarServer) subdomainReserved(subdomain string, resumeToken string) bool {
+	r, ok := ms.reservations[subdomain]
+	if !ok {
+		return false
+	}
+	if time.Now().After(r.expiresOn) {
+		delete(ms.reservations, subdomain)
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.resumeToken), []byte(resumeToken)) != 1
+}
+
+// Release the reservation of a reclaimed subdomain, forwarding the requests held for
+// it. Callers must hold the lock.
+func (ms *MmarServer) releaseReservation(subdomain string) {
+	if r, ok := ms.reservations[subdomain]; ok {
+		close(r.reclaimed)
+		delete(ms.reservations, subdomain)
+	}
+}
+
+// Hold the end-user's request while the subdomain is reserved, until the mmar client
+// reclaims it or the grace period ends, returning the reclaimed client tunnel
+func (ms *MmarServer) awaitReclaim(r *http.Request, subdomain string) (ClientTunnel, error) {
+	ms.mu.Lock()
+	res, reserved := ms.reservations[subdomain]
+	ms.mu.Unlock()
+	if !reserved || res.tunnelType != constants.TUNNEL_TYPE_HTTP {
+		return ClientTunnel{}, SUBDOMAIN_NOT_RESERVED_ERR
+	}
+
+	// The request body is held in memory until it can be forwarded
+	body, err := io.ReadAll(io.LimitReader(r.Body, constants.MAX_RECONNECT_QUEUED_BYTES+1))
+	if err != nil {
+		return ClientTunnel{}, READ_BODY_CHUNK_ERR
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	ms.mu.Lock()
+	if res.queuedRequests >= constants.MAX_RECONNECT_QUEUED_REQUESTS ||
+		res.queuedBytes+int64(len(body)) > constants.MAX_RECONNECT_QUEUED_BYTES {
+		ms.mu.Unlock()
+		return ClientTunnel{}, RECONNECT_QUEUE_FULL_ERR
+	}
+	res.queuedRequests++
+	res.queuedBytes += int64(len(body))
+	ms.mu.Unlock()
+
+	defer func() {
+		ms.mu.Lock()
+		res.queuedRequests--
+		res.queuedBytes -= int64(len(body))
+		ms.mu.Unlock()
+	}()
+
+	gracePeriod := time.NewTimer(time.Until(res.expiresOn))
+	defer gracePeriod.Stop()
+
+	select {
+	case <-r.Context().Done():
+		return ClientTunnel{}, context.Canceled
+	case <-gracePeriod.C:
+		return ClientTunnel{}, RECONNECT_TIMEDOUT_ERR
+	case <-res.reclaimed:
+	}
+
+	clientTunnel, ok := ms.tunnels.lookup(subdomain)
+	if !ok {
+		return ClientTunnel{}, RECONNECT_TIMEDOUT_ERR
+	}
+	return clientTunnel, nil
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yusuf-musleh/mmar/constants"
+	"github.com/yusuf-musleh/mmar/internal/auth"
+	"github.com/yusuf-musleh/mmar/internal/logger"
+	"github.com/yusuf-musleh/mmar/internal/utils"
+)
+
+// Usage of a tunnel, updated as requests are tunneled through it
+type tunnelStats struct {
+	requests atomic.Int64
+	// Requests responded to with a 5xx status, either by mmar server or the local server
+	errors   atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	// Unix time in nanoseconds of the last request
+	lastRequestOn    atomic.Int64
+	lastHeartbeatRtt atomic.Int64
+
+	// Latencies of the most recent requests, overwritten in a ring once full
+	mu             sync.Mutex
+	latencies      []time.Duration
+	nextLatencyIdx int
+}
+
+func (ts *tunnelStats) recordRequest(statusCode int, duration time.Duration) {
+	ts.requests.Add(1)
+	if statusCode >= 500 {
+		ts.errors.Add(1)
+	}
+	ts.lastRequestOn.Store(time.Now().UnixNano())
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(ts.latencies) < constants.STATS_LATENCY_SAMPLES {
+		ts.latencies = append(ts.latencies, duration)
+		return
+	}
+	ts.latencies[ts.nextLatencyIdx] = duration
+	ts.nextLatencyIdx = (ts.nextLatencyIdx + 1) % constants.STATS_LATENCY_SAMPLES
+}
+
+func (ts *tunnelStats) recordBytes(direction string, n int) {
+	if direction == "in" {
+		ts.bytesIn.Add(int64(n))
+	} else {
+		ts.bytesOut.Add(int64(n))
+	}
+}
+
+// Latency percentiles of the most recent requests, using the nearest rank
+func (ts *tunnelStats) latencyPercentiles(percentiles ...float64) []time.Duration {
+	ts.mu.Lock()
+	latencies := slices.Clone(ts.latencies)
+	ts.mu.Unlock()
+
+	slices.Sort(latencies)
+	results := make([]time.Duration, len(percentiles))
+	if len(latencies) == 0 {
+		return results
+	}
+	for i, p := range percentiles {
+		rank := int(math.Ceil(p*float64(len(latencies)))) - 1
+		results[i] = latencies[max(rank, 0)]
+	}
+	return results
+}
+
+// Stats of a tunnel as listed by the stats API
+type tunnelStatsEntry struct {
+	Id                 string            `json:"id"`
+	Type               string            `json:"type"`
+	ProtocolVersion    string            `json:"protocolVersion"`
+	CreatedOn          string            `json:"createdOn"`
+	Port               string            `json:"port,omitempty"`
+	Labels             map[string]string `json:"labels,omitempty"`
+	ClientVersion      string            `json:"clientVersion,omitempty"`
+	RemoteIp           string            `json:"remoteIp"`
+	Identity           string            `json:"identity,omitempty"`
+	Requests           int64             `json:"requests"`
+	Errors             int64             `json:"errors"`
+	BytesIn            int64             `json:"bytesIn"`
+	BytesOut           int64             `json:"bytesOut"`
+	LastRequestOn      string            `json:"lastRequestOn,omitempty"`
+	InflightRequests   int               `json:"inflightRequests"`
+	LatencyP50Ms       float64           `json:"latencyP50Ms"`
+	LatencyP95Ms       float64           `json:"latencyP95Ms"`
+	LastHeartbeatRttMs float64           `json:"lastHeartbeatRttMs,omitempty"`
+
+	// Unformatted times to sort by
+	createdOn     time.Time
+	lastRequestOn time.Time
+}
+
+func newTunnelStatsEntry(ct ClientTunnel) tunnelStatsEntry {
+	entry := tunnelStatsEntry{
+		Id:              ct.Id,
+		Type:            ct.tunnelType,
+		ProtocolVersion: strconv.Itoa(int(ct.Version)),
+		CreatedOn:       ct.CreatedOn.Format(time.RFC3339),
+		Labels:          ct.labels,
+		ClientVersion:   ct.clientVersion,
+		RemoteIp:        utils.ExtractIP(ct.Conn.RemoteAddr().String()),
+		Identity:        maskAuthToken(ct.authToken),
+		Requests:        ct.stats.requests.Load(),
+		Errors:          ct.stats.errors.Load(),
+		BytesIn:         ct.stats.bytesIn.Load(),
+		BytesOut:        ct.stats.bytesOut.Load(),
+		createdOn:       ct.CreatedOn,
+	}
+	if port := ct.publicPort(); port != 0 {
+		entry.Port = strconv.Itoa(port)
+	}
+	if lastRequestOn := ct.stats.lastRequestOn.Load(); lastRequestOn != 0 {
+		entry.lastRequestOn = time.Unix(0, lastRequestOn)
+		entry.LastRequestOn = entry.lastRequestOn.Format(time.RFC3339)
+	}
+	ct.inflightRequests.Range(func(_, _ any) bool {
+		entry.InflightRequests++
+		return true
+	})
+	latencies := ct.stats.latencyPercentiles(0.5, 0.95)
+	entry.LatencyP50Ms = durationMs(latencies[0])
+	entry.LatencyP95Ms = durationMs(latencies[1])
+	entry.LastHeartbeatRttMs = durationMs(time.Duration(ct.stats.lastHeartbeatRtt.Load()))
+	return entry
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Mask an API key so tunnels created with it can be told apart without revealing it,
+// client certificate identities are not secret so they are listed as they are
+func maskAuthToken(token string) string {
+	if token == "" || strings.HasPrefix(token, auth.CERT_IDENTITY_PREFIX) {
+		return token
+	}
+	if len(token) < constants.MASKED_TOKEN_MIN_LENGTH {
+		return "****"
+	}
+	return token[:constants.MASKED_TOKEN_VISIBLE_CHARS] + "****"
+}
+
+// Fields tunnels can be sorted by in the stats, prefixed with "-" to sort descending
+var statsSortFields = map[string]func(a, b tunnelStatsEntry) int{
+	"id":        func(a, b tunnelStatsEntry) int { return strings.Compare(a.Id, b.Id) },
+	"createdOn": func(a, b tunnelStatsEntry) int { return a.createdOn.Compare(b.createdOn) },
+	"requests":  func(a, b tunnelStatsEntry) int { return cmp.Compare(a.Requests, b.Requests) },
+	"errors":    func(a, b tunnelStatsEntry) int { return cmp.Compare(a.Errors, b.Errors) },
+	"bytes": func(a, b tunnelStatsEntry) int {
+		return cmp.Compare(a.BytesIn+a.BytesOut, b.BytesIn+b.BytesOut)
+	},
+	"lastRequestOn": func(a, b tunnelStatsEntry) int { return a.lastRequestOn.Compare(b.lastRequestOn) },
+	"inflight":      func(a, b tunnelStatsEntry) int { return cmp.Compare(a.InflightRequests, b.InflightRequests) },
+	"latencyP95":    func(a, b tunnelStatsEntry) int { return cmp.Compare(a.LatencyP95Ms, b.LatencyP95Ms) },
+}
+
+// Filters, sort order and page of tunnels requested from the stats, through the query string
+type statsQuery struct {
+	id     string
+	types  []string
+	ip     string
+	labels map[string]string
+	sortBy string
+	desc   bool
+	limit  int
+	offset int
+}
+
+func parseStatsQuery(query url.Values) (statsQuery, error) {
+	sq := statsQuery{
+		id:     strings.ToLower(query.Get("id")),
+		types:  query["type"],
+		ip:     query.Get("ip"),
+		labels: map[string]string{},
+		sortBy: "createdOn",
+		limit:  constants.STATS_DEFAULT_PAGE_SIZE,
+	}
+
+	for _, label := range query["label"] {
+		key, value, found := strings.Cut(label, "=")
+		if !found {
+			return sq, fmt.Errorf("invalid label filter \"%s\", expected key=value", label)
+		}
+		sq.labels[key] = value
+	}
+
+	if sort := query.Get("sort"); sort != "" {
+		sq.sortBy, sq.desc = strings.CutPrefix(sort, "-")
+		if _, ok := statsSortFields[sq.sortBy]; !ok {
+			return sq, fmt.Errorf("invalid sort field \"%s\"", sq.sortBy)
+		}
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 || parsed > constants.STATS_MAX_PAGE_SIZE {
+			return sq, fmt.Errorf("invalid limit \"%s\", must be between 1 and %d", limit, constants.STATS_MAX_PAGE_SIZE)
+		}
+		sq.limit = parsed
+	}
+
+	if offset := query.Get("offset"); offset != "" {
+		parsed, err := strconv.Atoi(offset)
+		if err != nil || parsed < 0 {
+			return sq, fmt.Errorf("invalid offset \"%s\", must be a positive number", offset)
+		}
+		sq.offset = parsed
+	}
+
+	return sq, nil
+}
+
+func (sq statsQuery) matches(entry tunnelStatsEntry) bool {
+	if sq.id != "" && !strings.Contains(entry.Id, sq.id) {
+		return false
+	}
+	if len(sq.types) > 0 && !slices.Contains(sq.types, entry.Type) {
+		return false
+	}
+	if sq.ip != "" && entry.RemoteIp != sq.ip {
+		return false
+	}
+	for key, value := range sq.labels {
+		if entry.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter, sort and paginate the tunnels, returning the page along with the number of
+// tunnels matching the filters
+func (sq statsQuery) apply(entries []tunnelStatsEntry) ([]tunnelStatsEntry, int) {
+	matching := slices.DeleteFunc(entries, func(entry tunnelStatsEntry) bool {
+		return !sq.matches(entry)
+	})
+
+	compare := statsSortFields[sq.sortBy]
+	slices.SortStableFunc(matching, func(a, b tunnelStatsEntry) int {
+		result := compare(a, b)
+		if result == 0 {
+			// Keep the order of tunnels with the same value consistent across pages
+			result = strings.Compare(a.Id, b.Id)
+		}
+		if sq.desc {
+			return -result
+		}
+		return result
+	})
+
+	start := min(sq.offset, len(matching))
+	end := min(start+sq.limit, len(matching))
+	return matching[start:end], len(matching)
+}
+
+// Serves stats of the tunnels of mmar server behind Basic Authentication, they can be
+// filtered, sorted and paginated through the query string
+func (ms *MmarServer) handleServerStats(w http.ResponseWriter, r *http.Request) {
+	if !authorizedAdmin(w, r) {
+		return
+	}
+
+	sq, err := parseStatsQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	clientTunnels := ms.tunnels.all()
+
+	entries := make([]tunnelStatsEntry, 0, len(clientTunnels))
+	for _, ct := range clientTunnels {
+		entries = append(entries, newTunnelStatsEntry(ct))
+	}
+	page, matchingCount := sq.apply(entries)
+
+	stats := map[string]any{
+		"connectedClientsCount": len(clientTunnels),
+		"matchingClientsCount":  matchingCount,
+		"offset":                sq.offset,
+		"limit":                 sq.limit,
+		"connectedClients":      page,
+	}
+
+	// Marshal the result
+	marshalledStats, err := json.Marshal(stats)
+
+	if err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to marshal server stats: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(marshalledStats)
+}
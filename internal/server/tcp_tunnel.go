@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/yusuf-musleh/mmar/constants"
+	"github.com/yusuf-musleh/mmar/internal/logger"
+	"github.com/yusuf-musleh/mmar/internal/protocol"
+)
+
+var INVALID_PORT_RANGE_ERR = errors.New("Invalid port range, expected format: start-end (eg: 20000-20100)")
+var TUNNEL_PORTS_EXHAUSTED_ERR = errors.New(constants.TUNNEL_PORTS_EXHAUSTED_ERR_TEXT)
+
+// Range of public ports that can be allocated for tunnels, on the address mmar server
+// listens on
+type PortRange struct {
+	start         int
+	end           int
+	listenAddress string
+}
+
+func ParsePortRange(ports string, listenAddress string) (*PortRange, error) {
+	startStr, endStr, found := strings.Cut(ports, "-")
+	if !found {
+		return nil, INVALID_PORT_RANGE_ERR
+	}
+
+	start, startErr := strconv.Atoi(strings.TrimSpace(startStr))
+	end, endErr := strconv.Atoi(strings.TrimSpace(endStr))
+	if startErr != nil || endErr != nil || start < 1 || end > 65535 || start > end {
+		return nil, INVALID_PORT_RANGE_ERR
+	}
+
+	return &PortRange{start: start, end: end, listenAddress: listenAddress}, nil
+}
+
+func (pr *PortRange) String() string {
+	return fmt.Sprintf("%d-%d", pr.start, pr.end)
+}
+
+func (pr *PortRange) contains(port int) bool {
+	return port >= pr.start && port <= pr.end
+}
+
+func (pr *PortRange) addr(port int) string {
+	return net.JoinHostPort(pr.listenAddress, strconv.Itoa(port))
+}
+
+// Bind to the first available port in the range, trying the requested port first if
+// provided, such as when a client reclaims its tunnel after reconnecting
+func (pr *PortRange) bind(requestedPort int, bindPort func(addr string) error) error {
+	if pr.contains(requestedPort) {
+		if err := bindPort(pr.addr(requestedPort)); err == nil {
+			return nil
+		}
+	}
+
+	for port := pr.start; port <= pr.end; port++ {
+		if err := bindPort(pr.addr(port)); err == nil {
+			return nil
+		}
+	}
+
+	return TUNNEL_PORTS_EXHAUSTED_ERR
+}
+
+func (pr *PortRange) listen(requestedPort int) (net.Listener, error) {
+	var ln net.Listener
+	err := pr.bind(requestedPort, func(addr string) (err error) {
+		ln, err = net.Listen("tcp", addr)
+		return err
+	})
+	return ln, err
+}
+
+// Public port the TCP or UDP tunnel is accepting connections or datagrams on
+func (ct *ClientTunnel) publicPort() int {
+	switch {
+	case ct.listener != nil:
+		return ct.listener.Addr().(*net.TCPAddr).Port
+	case ct.packetConn != nil:
+		return ct.packetConn.LocalAddr().(*net.UDPAddr).Port
+	}
+	return 0
+}
+
+// Accept connections on the TCP tunnel's public port until the tunnel is closed
+func (ct *ClientTunnel) acceptTcpConnections() {
+	for {
+		conn, err := ct.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("[%s] Failed to accept TCP tunnel connection: %v", ct.Tunnel.Id, err))
+			continue
+		}
+		go ct.handleTcpTunnelConnection(conn)
+	}
+}
+
+// Stream a connection accepted on the TCP tunnel's public port through to mmar client,
+// which connects it to the local port
+func (ct *ClientTunnel) handleTcpTunnelConnection(conn net.Conn) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	// Add connection to client's inflight streams
+	streamId := ct.GenerateUniqueRequestID()
+	incomingStream := ct.newIncomingRequest(ctx, cancel, streamId, nil)
+
+	// Let mmar client know about the new connection, including where it came from
+	openMsg := protocol.TunnelMessage{
+		MsgType: protocol.STREAM_OPEN,
+		MsgData: protocol.RequestIdMsgData(uint32(streamId), []byte(conn.RemoteAddr().String())),
+	}
+	if err := ct.SendMessage(openMsg); err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send Stream Open msg to client: %v", err))
+		ct.inflightRequests.Delete(streamId)
+		conn.Close()
+		return
+	}
+
+	ct.streamConnection(incomingStream, conn, conn, streamId)
+}
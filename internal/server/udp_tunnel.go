@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/yusuf-musleh/mmar/constants"
+	"github.com/yusuf-musleh/mmar/internal/logger"
+	"github.com/yusuf-musleh/mmar/internal/protocol"
+)
+
+var UDP_SESSION_IDLE_ERR = errors.New("UDP session idle for too long")
+
+// Datagrams exchanged with a single source address on the UDP tunnel's public port
+type UdpSession struct {
+	id       RequestId
+	incoming IncomingRequest
+	// Reset whenever a datagram is exchanged with the source address
+	idleTimer *time.Timer
+}
+
+func (pr *PortRange) listenPacket(requestedPort int) (net.PacketConn, error) {
+	var pc net.PacketConn
+	err := pr.bind(requestedPort, func(addr string) (err error) {
+		pc, err = net.ListenPacket("udp", addr)
+		return err
+	})
+	return pc, err
+}
+
+// Receive datagrams on the UDP tunnel's public port until the tunnel is closed,
+// relaying each of them to mmar client in the session of its source address
+func (ct *ClientTunnel) acceptUdpDatagrams() {
+	buf := make([]byte, constants.MAX_UDP_DATAGRAM_SIZE)
+	for {
+		n, addr, err := ct.packetConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("[%s] Failed to read UDP tunnel datagram: %v", ct.Tunnel.Id, err))
+			continue
+		}
+
+		session, ok := ct.udpSession(addr)
+		if !ok {
+			continue
+		}
+
+		// Drop the datagram if mmar client has no room for it, like a congested network would
+		if !session.incoming.sendWindow.TryAcquire(n) {
+			continue
+		}
+
+		// The datagram is copied into the message, since the read buffer is reused
+		datagramMsg := protocol.TunnelMessage{
+			MsgType: protocol.UDP_DATAGRAM,
+			MsgData: protocol.RequestIdMsgData(uint32(session.id), buf[:n]),
+		}
+		if err := ct.SendMessage(datagramMsg); err != nil {
+			logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send UDP Datagram msg to client: %v", err))
+			continue
+		}
+
+		// Keep the session alive
+		session.idleTimer.Reset(constants.UDP_SESSION_IDLE_TIMEOUT * time.Second)
+	}
+}
+
+// Retrieve the session of a source address, starting a new one if it does not exist
+func (ct *ClientTunnel) udpSession(addr net.Addr) (*UdpSession, bool) {
+	if existing, ok := ct.udpSessions.Load(addr.String()); ok {
+		return existing.(*UdpSession), true
+	}
+
+	// Drop datagrams from new source addresses until one of the open sessions closes, so
+	// a flood of spoofed addresses cannot make the tunnel keep an unbounded number of them
+	if ct.udpSessionsOpen.Load() >= int64(ct.maxUdpSessions) {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	// Add session to client's inflight streams, closing it once idle for too long
+	sessionId := ct.GenerateUniqueRequestID()
+	session := &UdpSession{
+		id:       sessionId,
+		incoming: ct.newIncomingRequest(ctx, cancel, sessionId, nil),
+		idleTimer: time.AfterFunc(
+			constants.UDP_SESSION_IDLE_TIMEOUT*time.Second,
+			func() { cancel(UDP_SESSION_IDLE_ERR) },
+		),
+	}
+	ct.udpSessions.Store(addr.String(), session)
+	ct.udpSessionsOpen.Add(1)
+
+	// Let mmar client know about the new session, including where it came from
+	openMsg := protocol.TunnelMessage{
+		MsgType: protocol.UDP_SESSION_OPEN,
+		MsgData: protocol.RequestIdMsgData(uint32(session.id), []byte(addr.String())),
+	}
+	if err := ct.SendMessage(openMsg); err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send UDP Session Open msg to client: %v", err))
+		ct.inflightRequests.Delete(session.id)
+		ct.udpSessions.Delete(addr.String())
+		ct.udpSessionsOpen.Add(-1)
+		session.idleTimer.Stop()
+		cancel(nil)
+		return nil, false
+	}
+
+	go ct.relayUdpSession(addr, session)
+	return session, true
+}
+
+// Send datagrams coming from mmar client back to the source address of the session,
+// until either side closes it or it has been idle for too long
+func (ct *ClientTunnel) relayUdpSession(addr net.Addr, session *UdpSession) {
+	defer session.idleTimer.Stop()
+
+	buf := make([]byte, constants.MAX_UDP_DATAGRAM_SIZE)
+	for {
+		n, readErr := session.incoming.responseBody.Read(buf)
+		if readErr != nil {
+			break
+		}
+		if _, err := ct.packetConn.WriteTo(buf[:n], addr); err != nil {
+			logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("[%s] Failed to write UDP tunnel datagram: %v", ct.Tunnel.Id, err))
+		}
+		session.idleTimer.Reset(constants.UDP_SESSION_IDLE_TIMEOUT * time.Second)
+	}
+
+	if ct.udpSessions.CompareAndDelete(addr.String(), session) {
+		ct.udpSessionsOpen.Add(-1)
+	}
+
+	// If the session is still open and the tunnel is not closing, it ended on this side
+	// (eg: idle for too long), so let mmar client know
+	ctx := session.incoming.ctx
+	_, open := ct.inflightRequests.LoadAndDelete(session.id)
+	if open && !errors.Is(context.Cause(ctx), CLIENT_DISCONNECTED_ERR) {
+		closeMsg := protocol.TunnelMessage{
+			MsgType: protocol.UDP_SESSION_CLOSE,
+			MsgData: protocol.RequestIdMsgData(uint32(session.id), nil),
+		}
+		if err := ct.SendMessage(closeMsg); err != nil {
+			logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send UDP Session Close msg to client: %v", err))
+		}
+	}
+	session.incoming.cancel(nil)
+}
@@ -4,16 +4,24 @@ import (
 	"bytes"
 	"context"
 	cryptoRand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	mathRand "math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"time"
 
 	"github.com/yusuf-musleh/mmar/constants"
+	"github.com/yusuf-musleh/mmar/internal/logger"
+	"github.com/yusuf-musleh/mmar/internal/protocol"
 )
 
 var READ_BODY_CHUNK_ERR error = errors.New(constants.READ_BODY_CHUNK_ERR_TEXT)
@@ -24,29 +32,18 @@ var MAX_REQ_BODY_SIZE_ERR error = errors.New(constants.MAX_REQ_BODY_SIZE_ERR_TEX
 var FAILED_TO_FORWARD_TO_MMAR_CLIENT_ERR error = errors.New(constants.FAILED_TO_FORWARD_TO_MMAR_CLIENT_ERR_TEXT)
 var FAILED_TO_READ_RESP_FROM_MMAR_CLIENT_ERR error = errors.New(constants.FAILED_TO_READ_RESP_FROM_MMAR_CLIENT_ERR_TEXT)
 
-func respondWith(respText string, w http.ResponseWriter, statusCode int) {
-	w.Header().Set("Content-Length", strconv.Itoa(len(respText)))
-	w.Header().Set("Connection", "close")
-	w.WriteHeader(statusCode)
-	w.Write([]byte(respText))
-}
-
-func handleCancel(cause error, w http.ResponseWriter) {
-	switch cause {
-	case context.Canceled:
+// Respond to the end-user with the tunnel error the request was canceled with
+func handleCancel(cause error, w http.ResponseWriter, r *http.Request) {
+	if cause == context.Canceled {
 		// Cancelled, do nothing
 		return
-	case READ_BODY_CHUNK_TIMEOUT_ERR:
-		respondWith(cause.Error(), w, http.StatusRequestTimeout)
-	case READ_BODY_CHUNK_ERR, CLIENT_DISCONNECTED_ERR:
-		respondWith(cause.Error(), w, http.StatusBadRequest)
-	case READ_RESP_BODY_ERR:
-		respondWith(cause.Error(), w, http.StatusInternalServerError)
-	case MAX_REQ_BODY_SIZE_ERR:
-		respondWith(cause.Error(), w, http.StatusRequestEntityTooLarge)
-	case FAILED_TO_FORWARD_TO_MMAR_CLIENT_ERR, FAILED_TO_READ_RESP_FROM_MMAR_CLIENT_ERR:
-		respondWith(cause.Error(), w, http.StatusServiceUnavailable)
 	}
+
+	tunnelErr, ok := tunnelErrorsByCause[cause]
+	if !ok {
+		tunnelErr = UNKNOWN_TUNNEL_ERR
+	}
+	respondWithTunnelErr(tunnelErr, w, r)
 }
 
 func cancelRead(ctx context.Context, cancel context.CancelCauseFunc) {
@@ -59,83 +56,208 @@ func cancelRead(ctx context.Context, cancel context.CancelCauseFunc) {
 	cancel(READ_BODY_CHUNK_TIMEOUT_ERR)
 }
 
-// Serialize HTTP request inorder to tunnel it to mmar client
-func serializeRequest(ctx context.Context, r *http.Request, cancel context.CancelCauseFunc, serializedRequestChannel chan []byte) {
-	var requestBuff bytes.Buffer
+// Serialize HTTP request line and headers inorder to tunnel them to mmar client, keyed by
+// the RequestId. The body is then streamed separately, unless it is provided, in which
+// case it follows the headers. The buffer is sized for all of them upfront, so the body
+// is copied into it once and the message data is not copied again.
+func serializeRequest(reqId RequestId, r *http.Request, body []byte) []byte {
+	requestBuff := bytes.NewBuffer(
+		make([]byte, 0, constants.REQUEST_ID_BUFF_SIZE+constants.HTTP_HEAD_BUFF_SIZE+len(body)),
+	)
+
+	// Key the request by its RequestId
+	var reqIdBuff [constants.REQUEST_ID_BUFF_SIZE]byte
+	binary.LittleEndian.PutUint32(reqIdBuff[:], uint32(reqId))
+	requestBuff.Write(reqIdBuff[:])
 
 	// Writing & serializing the HTTP Request Line
-	requestBuff.WriteString(
-		fmt.Sprintf(
-			"%v %v %v\nHost: %v\n",
-			r.Method,
-			r.RequestURI,
-			r.Proto,
-			r.Host,
-		),
-	)
+	fmt.Fprintf(requestBuff, "%v %v %v\nHost: %v\n", r.Method, r.RequestURI, r.Proto, r.Host)
+
+	headers := r.Header.Clone()
+	if r.ContentLength >= 0 {
+		// Set actual Content-Length header
+		headers.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	} else {
+		// Length of body is unknown, so it will be forwarded in chunks
+		headers.Del("Content-Length")
+		headers.Set("Transfer-Encoding", "chunked")
+	}
+
+	// Serialize headers
+	headers.Write(requestBuff)
+
+	// Add new line
+	requestBuff.WriteByte('\n')
+
+	requestBuff.Write(body)
+	return requestBuff.Bytes()
+}
+
+// Stream HTTP request body to mmar client in chunks as it is read from the end-user
+func (ct *ClientTunnel) streamRequestBody(incomingReq IncomingRequest, reqId RequestId, bodyStreamed chan struct{}) {
+	ctx, cancel, r := incomingReq.ctx, incomingReq.cancel, incomingReq.request
 
-	// Initialize read buffer/counter
-	bufferSize := 2048
+	// Initialize read buffer/counter, chunks are read right after the RequestId, so they
+	// are sent without being copied
+	buf := protocol.NewRequestIdBuffer(uint32(reqId))
+	defer buf.Release()
 	contentLength := 0
-	buf := make([]byte, bufferSize)
-	reqBodyBytes := []byte{}
 
-	// Keep reading response until completely read
+	// Keep reading request body until completely read
 	for {
 		// Cancel request if read buffer times out
 		readBufferTimeout := time.AfterFunc(
-			constants.REQ_BODY_READ_CHUNK_TIMEOUT*time.Second,
+			time.Duration(ct.limits.RequestBodyReadTimeout)*time.Second,
 			func() { cancelRead(ctx, cancel) },
 		)
-		r, readErr := r.Body.Read(buf)
+		n, readErr := r.Body.Read(buf.Data())
 		readBufferTimeout.Stop()
-		contentLength += r
-		if contentLength > constants.MAX_REQ_BODY_SIZE {
+
+		// Request was canceled while reading, stop streaming
+		if ctx.Err() != nil {
+			return
+		}
+
+		contentLength += n
+		if int64(contentLength) > ct.limits.MaxRequestBodySize {
 			cancel(MAX_REQ_BODY_SIZE_ERR)
 			return
 		}
+
+		if n > 0 {
+			// Wait for mmar client to have room for more of the request body
+			if err := incomingReq.sendWindow.Acquire(ctx, n); err != nil {
+				return
+			}
+			chunkMsg := protocol.TunnelMessage{
+				MsgType: protocol.REQUEST_BODY_CHUNK,
+				MsgData: buf.MsgData(n),
+			}
+			if err := ct.SendMessage(chunkMsg); err != nil {
+				logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send Request Body Chunk msg to client: %v", err))
+				cancel(FAILED_TO_FORWARD_TO_MMAR_CLIENT_ERR)
+				return
+			}
+		}
+
 		if readErr != nil {
 			if errors.Is(readErr, io.EOF) {
-				reqBodyBytes = append(reqBodyBytes, buf[:r]...)
 				break
 			}
 			// Cancel request if there was an error reading
 			cancel(READ_BODY_CHUNK_ERR)
 			return
 		}
-		reqBodyBytes = append(reqBodyBytes, buf[:r]...)
 	}
 
-	// Set actual Content-Length header
-	r.Header.Set("Content-Length", strconv.Itoa(contentLength))
+	// Let mmar client know the request body is complete
+	endMsg := protocol.TunnelMessage{
+		MsgType: protocol.REQUEST_BODY_END,
+		MsgData: protocol.RequestIdMsgData(uint32(reqId), nil),
+	}
+	if err := ct.SendMessage(endMsg); err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send Request Body End msg to client: %v", err))
+		cancel(FAILED_TO_FORWARD_TO_MMAR_CLIENT_ERR)
+		return
+	}
+
+	close(bodyStreamed)
+}
 
-	// Serialize headers
-	r.Header.Clone().Write(&requestBuff)
+// Send the whole HTTP request, including its body, in a single message to mmar clients
+// that do not support streaming it
+func (ct *ClientTunnel) sendBufferedRequest(incomingReq IncomingRequest, reqId RequestId) error {
+	r := incomingReq.request
 
-	// Add new line
-	requestBuff.WriteByte('\n')
+	body, err := io.ReadAll(io.LimitReader(r.Body, ct.limits.MaxRequestBodySize+1))
+	if err != nil {
+		return READ_BODY_CHUNK_ERR
+	}
+	if int64(len(body)) > ct.limits.MaxRequestBodySize {
+		return MAX_REQ_BODY_SIZE_ERR
+	}
 
-	// Write body to buffer
-	requestBuff.Write(reqBodyBytes)
-	requestBuff.WriteByte('\n')
+	// The length of the body is now known
+	r.ContentLength = int64(len(body))
+	reqMessage := protocol.TunnelMessage{
+		MsgType: protocol.REQUEST,
+		MsgData: serializeRequest(reqId, r, body),
+	}
+	if err := ct.SendMessage(reqMessage); err != nil {
+		logger.Log(constants.DEFAULT_COLOR, fmt.Sprintf("Failed to send Request msg to client: %v", err))
+		return FAILED_TO_FORWARD_TO_MMAR_CLIENT_ERR
+	}
+	return nil
+}
+
+// Check if a response is being streamed (eg: Server-Sent Events or a body of unknown
+// length), so each chunk should reach the end-user as soon as it arrives
+func isStreamingResponse(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || header.Get("Content-Length") == ""
+}
+
+// Close the write side of a connection to mmar client, over TLS or not, so it receives
+// the end of data while still being able to read what was sent before
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
 
-	// Send serialized request through channel
-	serializedRequestChannel <- requestBuff.Bytes()
+// Leaf certificate mmar client presented over TLS, nil if it did not present one
+// verified against the client CAs
+func verifiedClientCert(conn net.Conn) *x509.Certificate {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	chains := tlsConn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	return chains[0][0]
 }
 
-// Create HTTP response sent from mmar server to the end-user client
-func createSerializedServerResp(status string, statusCode int, body string) bytes.Buffer {
-	resp := http.Response{
-		Status:     status,
-		StatusCode: statusCode,
-		Body:       io.NopCloser(bytes.NewBufferString(body)),
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	caData, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no valid CA certificates found in %s", caFile)
 	}
+	return pool, nil
+}
 
-	// Writing response to buffer to tunnel it back
-	var responseBuff bytes.Buffer
-	resp.Write(&responseBuff)
+// Parse the tunnel request mmar client sent to create or reclaim a tunnel, mmar clients
+// predating negotiation send it in their legacy format
+func parseTunnelRequest(t protocol.Tunnel, tunnelMsg protocol.TunnelMessage) (protocol.TunnelRequest, error) {
+	if t.Version == constants.LEGACY_TUNNEL_MESSAGE_PROTOCOL_VERSION {
+		return protocol.ParseLegacyTunnelRequest(tunnelMsg.MsgData), nil
+	}
+	return protocol.ParseTunnelRequest(tunnelMsg.MsgData)
+}
 
-	return responseBuff
+// Limits to apply to a tunnel, honoring the ones requested by mmar client as long as
+// they are within mmar server's
+func tunnelLimits(requested protocol.TunnelLimits, settings serverSettings) protocol.TunnelLimits {
+	return protocol.TunnelLimits{
+		MaxRequestBodySize:     lowerLimit(settings.maxRequestBodySize, requested.MaxRequestBodySize),
+		RequestBodyReadTimeout: lowerLimit(int64(settings.requestBodyReadTimeout/time.Second), requested.RequestBodyReadTimeout),
+		DestRequestTimeout:     lowerLimit(int64(settings.destRequestTimeout/time.Second), requested.DestRequestTimeout),
+		HeartbeatTimeout:       lowerLimit(int64(settings.heartbeatTimeout/time.Second), requested.HeartbeatTimeout),
+		ClientHeartbeatTimeout: lowerLimit(int64(settings.clientHeartbeatTimeout/time.Second), requested.ClientHeartbeatTimeout),
+	}
+}
+
+// Apply the limit mmar client requested, only if it is lower than mmar server's
+func lowerLimit(limit int64, requested int64) int64 {
+	if requested > 0 && requested < limit {
+		return requested
+	}
+	return limit
 }
 
 // Generate a random ID from ID_CHARSET of length ID_LENGTH
@@ -148,6 +270,20 @@ func GenerateRandomID() string {
 	return string(b)
 }
 
+// Generate an ID to trace end-users' requests by
+func GenerateRequestId() string {
+	b := make([]byte, constants.REQUEST_ID_LENGTH)
+	cryptoRand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Generate a secret token for mmar client to reclaim its tunnel's subdomain with
+func GenerateResumeToken() string {
+	b := make([]byte, constants.RESUME_TOKEN_LENGTH)
+	cryptoRand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 // Generate a random 32-bit unsigned integer
 func GenerateRandomUint32() uint32 {
 	var randomUint32 uint32
@@ -108,6 +108,13 @@ func ValidCredentials(username string, password string) bool {
 	return validUsername && validPassword
 }
 
+// Check if the Basic Auth credentials were configured, rather than falling back to the defaults
+func CredentialsConfigured() bool {
+	_, foundUsernameHash := os.LookupEnv("USERNAME_HASH")
+	_, foundPasswordHash := os.LookupEnv("PASSWORD_HASH")
+	return foundUsernameHash && foundPasswordHash
+}
+
 func NetworkError(err error) bool {
 	return errors.Is(err, io.EOF) ||
 		errors.Is(err, io.ErrUnexpectedEOF) ||
@@ -0,0 +1,87 @@
+package simulations
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/yusuf-musleh/mmar/constants"
+	"github.com/yusuf-musleh/mmar/simulations/devserver"
+)
+
+// Benchmark requests tunneled to the local dev server, with mmar client reusing its
+// connections to the local dev server and opening a new one for every request. Run with:
+//
+//	go build -o ./simulations/mmar ./cmd/mmar
+//	go test -run '^$' -bench BenchmarkTunneledRequests ./simulations
+func BenchmarkTunneledRequests(b *testing.B) {
+	benchmarkCtx, benchmarkCancel := context.WithCancel(context.Background())
+
+	localDevServer := StartLocalDevServer("http", "localhost")
+	defer localDevServer.Close()
+
+	startDnsServer()
+
+	go StartMmarServer(
+		benchmarkCtx,
+		"--http-port", BENCH_SERVER_HTTP_PORT,
+		"--tcp-port", BENCH_SERVER_TCP_PORT,
+	)
+
+	wait := time.NewTimer(2 * time.Second)
+	<-wait.C
+
+	for _, bench := range []struct {
+		name         string
+		maxIdleConns int
+	}{
+		{"reused-local-conns", constants.LOCAL_MAX_IDLE_CONNS},
+		{"new-local-conn-per-request", 0},
+	} {
+		clientUrlCh := make(chan string)
+		go StartMmarClient(benchmarkCtx, clientUrlCh, localDevServer.Port(), "", "", "", "", "",
+			"--tunnel-tcp-port", BENCH_SERVER_TCP_PORT, "--tunnel-http-port", BENCH_SERVER_HTTP_PORT,
+			"--local-max-idle-conns", strconv.Itoa(bench.maxIdleConns))
+		tunnelUrl := <-clientUrlCh
+
+		b.Run(bench.name, func(b *testing.B) {
+			benchmarkTunneledRequests(b, tunnelUrl)
+		})
+	}
+
+	// Stop benchmark
+	benchmarkCancel()
+
+	wait.Reset(6 * time.Second)
+	<-wait.C
+}
+
+func benchmarkTunneledRequests(b *testing.B, tunnelUrl string) {
+	// Keep connections to mmar server alive as well, so only the tunnel is measured
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:         initCustomDialer().DialContext,
+			MaxIdleConnsPerHost: constants.LOCAL_MAX_IDLE_CONNS,
+		},
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := client.Get(tunnelUrl + devserver.GET_SUCCESS_URL)
+			if err != nil {
+				b.Errorf("Failed to get response: %v", err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				b.Errorf("status = %v; want %v", resp.StatusCode, http.StatusOK)
+				return
+			}
+		}
+	})
+}
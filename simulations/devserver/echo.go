@@ -0,0 +1,70 @@
+package devserver
+
+import (
+	"io"
+	"log"
+	"net"
+	"strconv"
+)
+
+// Local TCP server that echoes back everything it receives, used to simulate
+// a non-HTTP service exposed through a TCP tunnel
+type EchoServer struct {
+	net.Listener
+}
+
+func NewEchoServer() *EchoServer {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		log.Fatalf("Failed to start echo server: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return &EchoServer{ln}
+}
+
+func (es *EchoServer) Port() string {
+	return strconv.Itoa(es.Addr().(*net.TCPAddr).Port)
+}
+
+// Local UDP server that echoes back every datagram it receives, used to simulate
+// a UDP service exposed through a UDP tunnel
+type UdpEchoServer struct {
+	net.PacketConn
+}
+
+func NewUdpEchoServer() *UdpEchoServer {
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		log.Fatalf("Failed to start UDP echo server: %v", err)
+	}
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return &UdpEchoServer{pc}
+}
+
+func (es *UdpEchoServer) Port() string {
+	return strconv.Itoa(es.LocalAddr().(*net.UDPAddr).Port)
+}
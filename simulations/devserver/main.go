@@ -1,12 +1,15 @@
 package devserver
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,6 +22,18 @@ const (
 	BAD_RESPONSE_URL = "/bad-resp"
 	LONG_RUNNING_URL = "/long-running"
 	CRASH_URL        = "/crash"
+	STREAM_URL       = "/stream"
+	UPGRADE_URL      = "/upgrade"
+	EVENTS_URL       = "/events"
+	EVENTS_ACK_URL   = "/events/ack"
+	LARGE_RESP_URL   = "/large-resp"
+)
+
+const (
+	STREAM_CHUNKS_COUNT = 10
+	EVENTS_COUNT        = 3
+	EVENTS_ACK_TIMEOUT  = 10 * time.Second
+	LARGE_RESP_SIZE     = 16777216 // 16mb
 )
 
 type DevServer struct {
@@ -58,6 +73,11 @@ func setupMux() *http.ServeMux {
 	mux.Handle(BAD_RESPONSE_URL, http.HandlerFunc(handleBadResp))
 	mux.Handle(LONG_RUNNING_URL, http.HandlerFunc(handleLongRunningReq))
 	mux.Handle(CRASH_URL, http.HandlerFunc(handleCrashingReq))
+	mux.Handle(STREAM_URL, http.HandlerFunc(handleStream))
+	mux.Handle(UPGRADE_URL, http.HandlerFunc(handleUpgrade))
+	mux.Handle(EVENTS_URL, http.HandlerFunc(handleEvents))
+	mux.Handle(EVENTS_ACK_URL, http.HandlerFunc(handleEventsAck))
+	mux.Handle(LARGE_RESP_URL, http.HandlerFunc(handleLargeResp))
 
 	return mux
 }
@@ -114,7 +134,9 @@ func handlePost(w http.ResponseWriter, r *http.Request) {
 	jsonDecoder := json.NewDecoder(r.Body)
 	err := jsonDecoder.Decode(&reqBody)
 	if err != nil {
-		log.Fatal("Failed to decode request body to json", err)
+		// Request body may be cut off if the request was canceled midway
+		http.Error(w, "Failed to decode request body to json", http.StatusBadRequest)
+		return
 	}
 
 	respBody, err := json.Marshal(map[string]interface{}{
@@ -147,7 +169,9 @@ func handlePostFail(w http.ResponseWriter, r *http.Request) {
 	jsonDecoder := json.NewDecoder(r.Body)
 	err := jsonDecoder.Decode(&reqBody)
 	if err != nil {
-		log.Fatal("Failed to decode request body to json", err)
+		// Request body may be cut off if the request was canceled midway
+		http.Error(w, "Failed to decode request body to json", http.StatusBadRequest)
+		return
 	}
 
 	respBody, err := json.Marshal(map[string]interface{}{
@@ -231,3 +255,129 @@ func handleLongRunningReq(w http.ResponseWriter, r *http.Request) {
 func handleCrashingReq(w http.ResponseWriter, _ *http.Request) {
 	panic("crashing devserver")
 }
+
+// Request handler that streams its response body in chunks over time
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	// Add custom header to response to confirm to confirm that they
+	// propograte when going through mmar
+	w.Header().Set("Simulation-Header", "devserver-handle-stream")
+	w.WriteHeader(http.StatusOK)
+
+	for i := range STREAM_CHUNKS_COUNT {
+		w.Write([]byte(StreamChunk(i)))
+		flusher.Flush()
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Content of each chunk streamed by the stream handler
+func StreamChunk(i int) string {
+	return "chunk " + strconv.Itoa(i) + "\n"
+}
+
+// Request handler that switches to a simple "echo" protocol, writing back
+// everything it receives until the connection is closed
+func handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "echo" {
+		http.Error(w, "Unsupported upgrade protocol", http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, "Hijacking failed", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: echo\r\n" +
+		"Simulation-Header: devserver-handle-upgrade\r\n" +
+		"\r\n")
+	buf.Flush()
+
+	io.Copy(conn, buf)
+}
+
+// Acks of the events received on each event stream, by the stream query param
+var eventStreams sync.Map
+
+// Request handler that sends Server-Sent Events, each one once the previous one is acked.
+// Events that are not flushed as they are sent are never acked, so the stream ends early.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	stream := r.URL.Query().Get("stream")
+	acks := make(chan struct{}, EVENTS_COUNT)
+	eventStreams.Store(stream, acks)
+	defer eventStreams.Delete(stream)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for i := range EVENTS_COUNT {
+		w.Write([]byte(Event(i)))
+		flusher.Flush()
+		if i == EVENTS_COUNT-1 {
+			return
+		}
+		select {
+		case <-acks:
+		case <-time.After(EVENTS_ACK_TIMEOUT):
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Request handler that acks the last event received on an event stream
+func handleEventsAck(w http.ResponseWriter, r *http.Request) {
+	acks, ok := eventStreams.Load(r.URL.Query().Get("stream"))
+	if !ok {
+		http.Error(w, "Event stream not found", http.StatusNotFound)
+		return
+	}
+	select {
+	case acks.(chan struct{}) <- struct{}{}:
+	default:
+	}
+}
+
+// Content of each event sent by the events handler
+func Event(i int) string {
+	return "data: event " + strconv.Itoa(i) + "\n\n"
+}
+
+// Request handler that responds with a large body, to simulate big downloads
+func handleLargeResp(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(LARGE_RESP_SIZE))
+	w.WriteHeader(http.StatusOK)
+
+	chunk := bytes.Repeat([]byte("a"), 32768)
+	for written := 0; written < LARGE_RESP_SIZE; written += len(chunk) {
+		if _, err := w.Write(chunk); err != nil {
+			return
+		}
+	}
+}
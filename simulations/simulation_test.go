@@ -4,27 +4,48 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/yusuf-musleh/mmar/constants"
+	"github.com/yusuf-musleh/mmar/internal/auth"
+	"github.com/yusuf-musleh/mmar/internal/protocol"
+	"github.com/yusuf-musleh/mmar/internal/utils"
 	"github.com/yusuf-musleh/mmar/simulations/devserver"
-	"github.com/yusuf-musleh/mmar/simulations/dnsserver"
 )
 
-func StartMmarServer(ctx context.Context) {
-	cmd := exec.CommandContext(ctx, "./mmar", "server")
+func StartMmarServer(ctx context.Context, extraArgs ...string) {
+	cmd := mmarServerCmd(ctx, extraArgs...)
+	err := cmd.Run()
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatal(err)
+	}
+}
+
+func mmarServerCmd(ctx context.Context, extraArgs ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "./mmar", "server", "--tcp-tunnel-ports", TCP_TUNNEL_PORTS,
+		"--udp-tunnel-ports", UDP_TUNNEL_PORTS,
+	)
+	cmd.Args = append(cmd.Args, extraArgs...)
 
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
@@ -37,10 +58,7 @@ func StartMmarServer(ctx context.Context) {
 		return cmd.Process.Signal(os.Interrupt)
 	}
 
-	err := cmd.Run()
-	if err != nil && !errors.Is(err, context.Canceled) {
-		log.Fatal(err)
-	}
+	return cmd
 }
 
 func StartMmarClient(
@@ -51,6 +69,8 @@ func StartMmarClient(
 	localDevServerProto string,
 	customDns string,
 	customCert string,
+	tunnelType string,
+	extraArgs ...string,
 ) {
 	cmd := exec.CommandContext(
 		ctx,
@@ -78,6 +98,11 @@ func StartMmarClient(
 		cmd.Args = append(cmd.Args, "--custom-cert", customCert)
 	}
 
+	if tunnelType != "" {
+		cmd.Args = append(cmd.Args, "--tunnel-type", tunnelType)
+	}
+
+	cmd.Args = append(cmd.Args, extraArgs...)
 	cmd.Args = append(cmd.Args, "")
 
 	cmd.Stdout = os.Stdout
@@ -545,18 +570,7 @@ func verifyMismatchedContentLengthRequestHandled(t *testing.T, tunnelUrl string,
 		t.Errorf("%v: Failed to get response %v", "verifyMismatchedContentLengthRequestHandled", respErr)
 	}
 
-	expectedBody := constants.READ_BODY_CHUNK_TIMEOUT_ERR_TEXT
-
-	expectedResp := expectedResponse{
-		statusCode: http.StatusRequestTimeout,
-		headers: map[string]string{
-			"Content-Length": strconv.Itoa(len(expectedBody)),
-			"Content-Type":   "text/plain; charset=utf-8",
-		},
-		textBody: expectedBody,
-	}
-
-	validateRequestResponse(t, expectedResp, resp, "verifyMismatchedContentLengthRequestHandled")
+	validateTunnelErrResponse(t, resp, http.StatusRequestTimeout, constants.ERR_CODE_REQUEST_BODY_TIMEDOUT, constants.READ_BODY_CHUNK_TIMEOUT_ERR_TEXT, "verifyMismatchedContentLengthRequestHandled")
 }
 
 // Test to verify a HTTP request with a Content-Length header but no body
@@ -578,18 +592,7 @@ func verifyContentLengthWithNoBodyRequestHandled(t *testing.T, tunnelUrl string,
 	if respErr != nil {
 		t.Errorf("%v: Failed to get response %v", "verifyContentLengthWithNoBodyRequestHandled", respErr)
 	}
-	expectedBody := constants.READ_BODY_CHUNK_TIMEOUT_ERR_TEXT
-
-	expectedResp := expectedResponse{
-		statusCode: http.StatusRequestTimeout,
-		headers: map[string]string{
-			"Content-Length": strconv.Itoa(len(expectedBody)),
-			"Content-Type":   "text/plain; charset=utf-8",
-		},
-		textBody: expectedBody,
-	}
-
-	validateRequestResponse(t, expectedResp, resp, "verifyContentLengthWithNoBodyRequestHandled")
+	validateTunnelErrResponse(t, resp, http.StatusRequestTimeout, constants.ERR_CODE_REQUEST_BODY_TIMEDOUT, constants.READ_BODY_CHUNK_TIMEOUT_ERR_TEXT, "verifyContentLengthWithNoBodyRequestHandled")
 }
 
 // Test to verify a HTTP request with a large body but still within the limit
@@ -647,50 +650,102 @@ func verifyRequestWithLargeBody(t *testing.T, client *http.Client, tunnelUrl str
 	validateRequestResponse(t, expectedResp, resp, "verifyRequestWithLargeBody")
 }
 
-// Test to verify a HTTP request with a very large body, over the 10mb limit
-func verifyRequestWithVeryLargeBody(t *testing.T, client *http.Client, tunnelUrl string, wg *sync.WaitGroup) {
+// Test to verify large bodies sent through the same tunnel at once are each tunneled
+// intact, without the messages carrying them interleaving
+func verifyConcurrentLargeBodiesIntact(t *testing.T, client *http.Client, tunnelUrl string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	var bodiesWg sync.WaitGroup
+	for i := range 8 {
+		bodiesWg.Add(1)
+		go func() {
+			defer bodiesWg.Done()
+			payload := bytes.Repeat([]byte{byte('a' + i)}, 500000)
+			serializedReqBody, _ := json.Marshal(map[string]any{"payload": payload})
+			resp, err := client.Post(tunnelUrl+devserver.POST_SUCCESS_URL, "application/json", bytes.NewBuffer(serializedReqBody))
+			if err != nil {
+				t.Errorf("%v: Failed to get response: %v", "verifyConcurrentLargeBodiesIntact", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			var respBody struct {
+				Echo struct {
+					ReqBody struct {
+						Payload []byte `json:"payload"`
+					} `json:"reqBody"`
+				} `json:"echo"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil || resp.StatusCode != http.StatusOK {
+				t.Errorf("%v: response = (%v, %v); want %v", "verifyConcurrentLargeBodiesIntact", resp.StatusCode, err, http.StatusOK)
+				return
+			}
+			if !bytes.Equal(respBody.Echo.ReqBody.Payload, payload) {
+				t.Errorf("%v: body %d was not echoed intact", "verifyConcurrentLargeBodiesIntact", i)
+			}
+		}()
+	}
+	bodiesWg.Wait()
+}
+
+// Test to verify a HTTP request with a body of unknown length is streamed through in chunks
+func verifyChunkedRequestBody(t *testing.T, client *http.Client, tunnelUrl string, wg *sync.WaitGroup) {
 	defer wg.Done()
-	hundredMb := 100000000
 	reqBody := map[string]interface{}{
 		"success": true,
-		"payload": make([]byte, hundredMb),
+		"payload": make([]byte, 999989),
 	}
 
 	serializedReqBody, _ := json.Marshal(reqBody)
-	req, reqErr := http.NewRequest("POST", tunnelUrl+devserver.POST_SUCCESS_URL, bytes.NewBuffer(serializedReqBody))
+	// Wrapping body reader so its length is unknown, forcing it to be sent in chunks
+	req, reqErr := http.NewRequest("POST", tunnelUrl+devserver.POST_SUCCESS_URL, io.MultiReader(bytes.NewReader(serializedReqBody)))
 	if reqErr != nil {
 		log.Fatalf("Failed to create new request: %v", reqErr)
 	}
 	// Adding custom header to confirm that they are propogated when going through mmar
-	req.Header.Set("Simulation-Test", "verify-very-large-post-request-success")
+	req.Header.Set("Simulation-Test", "verify-chunked-post-request-success")
 
 	resp, respErr := client.Do(req)
 	if respErr != nil {
-		// Check if connection was closed in the middle of writing, that's also valid behavior
-		if !strings.Contains(respErr.Error(), "write: connection reset by peer") {
-			t.Errorf("Failed to get response: %v", respErr)
-		}
-		return
+		t.Errorf("Failed to get response: %v", respErr)
+	}
+
+	expectedReqHeaders := map[string][]string{
+		"User-Agent":      {"Go-http-client/1.1"}, // Default header in golang client
+		"Accept-Encoding": {"gzip"},               // Default header in golang client
+		"Connection":      {"close"},
+		"Simulation-Test": {"verify-chunked-post-request-success"},
 	}
 
-	expectedBody := constants.MAX_REQ_BODY_SIZE_ERR_TEXT
+	expectedBody := map[string]interface{}{
+		"success": true,
+		"data": map[string]interface{}{
+			"posted": "data",
+		},
+		"echo": map[string]interface{}{
+			"reqHeaders": expectedReqHeaders,
+			"reqBody":    reqBody,
+		},
+	}
+	marshaledBody, _ := json.Marshal(expectedBody)
 
 	expectedResp := expectedResponse{
-		statusCode: http.StatusRequestEntityTooLarge,
+		statusCode: http.StatusOK,
 		headers: map[string]string{
-			"Content-Length": strconv.Itoa(len(expectedBody)),
-			"Content-Type":   "text/plain; charset=utf-8",
+			"Content-Length":    strconv.Itoa(len(marshaledBody)),
+			"Content-Type":      "application/json",
+			"Simulation-Header": "devserver-handle-post-success",
 		},
-		textBody: expectedBody,
+		jsonBody: expectedBody,
 	}
 
-	validateRequestResponse(t, expectedResp, resp, "verifyRequestWithVeryLargeBody")
+	validateRequestResponse(t, expectedResp, resp, "verifyChunkedRequestBody")
 }
 
-// Test to verify that mmar handles invalid response from dev server gracefully
-func verifyDevServerReturningInvalidRespHandled(t *testing.T, client *http.Client, tunnelUrl string, wg *sync.WaitGroup) {
+// Test to verify a response body streamed in chunks by the dev server is received completely
+func verifyStreamedResponseBody(t *testing.T, client *http.Client, tunnelUrl string, wg *sync.WaitGroup) {
 	defer wg.Done()
-	req, reqErr := http.NewRequest("GET", tunnelUrl+devserver.BAD_RESPONSE_URL, nil)
+	req, reqErr := http.NewRequest("GET", tunnelUrl+devserver.STREAM_URL, nil)
 	if reqErr != nil {
 		log.Fatalf("Failed to create new request: %v", reqErr)
 	}
@@ -700,21 +755,160 @@ func verifyDevServerReturningInvalidRespHandled(t *testing.T, client *http.Clien
 		t.Errorf("Failed to get response: %v", respErr)
 	}
 
-	expectedBody := constants.READ_RESP_BODY_ERR_TEXT
+	expectedBody := ""
+	for i := range devserver.STREAM_CHUNKS_COUNT {
+		expectedBody += devserver.StreamChunk(i)
+	}
 
 	expectedResp := expectedResponse{
-		statusCode: http.StatusInternalServerError,
+		statusCode: http.StatusOK,
 		headers: map[string]string{
-			"Content-Length": strconv.Itoa(len(expectedBody)),
-			"Content-Type":   "text/plain; charset=utf-8",
+			"Content-Type":      "text/plain",
+			"Simulation-Header": "devserver-handle-stream",
 		},
 		textBody: expectedBody,
 	}
 
-	validateRequestResponse(t, expectedResp, resp, "verifyDevServerReturningInvalidRespHandled")
+	validateRequestResponse(t, expectedResp, resp, "verifyStreamedResponseBody")
+}
+
+// Test to verify a large response the end-user is not reading does not block other
+// requests going through the same tunnel
+func verifyUnreadResponseDoesNotBlockTunnel(t *testing.T, client *http.Client, tunnelUrl string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	resp, respErr := client.Get(tunnelUrl + devserver.LARGE_RESP_URL)
+	if respErr != nil {
+		t.Errorf("%v: Failed to get response: %v", "verifyUnreadResponseDoesNotBlockTunnel", respErr)
+		return
+	}
+	defer resp.Body.Close()
+
+	// Leave the large response unread for a while, so it backs up through the tunnel
+	wait := time.NewTimer(2 * time.Second)
+	<-wait.C
+
+	// Other requests should still go through
+	timeoutClient := &http.Client{Transport: client.Transport, Timeout: 5 * time.Second}
+	getResp, getErr := timeoutClient.Get(tunnelUrl + devserver.GET_SUCCESS_URL)
+	if getErr != nil {
+		t.Errorf("%v: Request blocked behind unread response: %v", "verifyUnreadResponseDoesNotBlockTunnel", getErr)
+		return
+	}
+	getResp.Body.Close()
+	if getResp.StatusCode != http.StatusOK {
+		t.Errorf("%v: status code = %v; want %v", "verifyUnreadResponseDoesNotBlockTunnel", getResp.StatusCode, http.StatusOK)
+	}
+
+	// Reading the large response should resume it until it is complete
+	n, readErr := io.Copy(io.Discard, resp.Body)
+	if readErr != nil || n != devserver.LARGE_RESP_SIZE {
+		t.Errorf(
+			"%v: read %v bytes with err %v; want %v bytes",
+			"verifyUnreadResponseDoesNotBlockTunnel",
+			n,
+			readErr,
+			devserver.LARGE_RESP_SIZE,
+		)
+	}
+}
+
+// Test to verify Server-Sent Events are received as they are sent, rather than
+// once the whole response is complete
+func verifyServerSentEventsFlushed(t *testing.T, client *http.Client, tunnelUrl string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	// Event streams are told apart by the tunnel they go through
+	stream := url.QueryEscape(tunnelUrl)
+	req, reqErr := http.NewRequest("GET", tunnelUrl+devserver.EVENTS_URL+"?stream="+stream, nil)
+	if reqErr != nil {
+		log.Fatalf("Failed to create new request: %v", reqErr)
+	}
+
+	resp, respErr := client.Do(req)
+	if respErr != nil {
+		t.Errorf("Failed to get response: %v", respErr)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("%v: resp.StatusCode = %v; want %v", "verifyServerSentEventsFlushed", resp.StatusCode, http.StatusOK)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	for i := range devserver.EVENTS_COUNT {
+		event, err := reader.ReadString('\n')
+		if err != nil {
+			t.Errorf("%v: Failed to read event %v", "verifyServerSentEventsFlushed", err)
+			return
+		}
+		// Skip the blank line terminating the event
+		reader.ReadString('\n')
+
+		if event+"\n" != devserver.Event(i) {
+			t.Errorf("%v: event = %v; want %v", "verifyServerSentEventsFlushed", event, devserver.Event(i))
+		}
+
+		// The next event is only sent once this one is received, so events held back
+		// until the stream ends are never all received
+		if i == devserver.EVENTS_COUNT-1 {
+			break
+		}
+		ackResp, err := client.Get(tunnelUrl + devserver.EVENTS_ACK_URL + "?stream=" + stream)
+		if err != nil || ackResp.StatusCode != http.StatusOK {
+			t.Errorf("%v: ack event %d = (%v, %v); want %v", "verifyServerSentEventsFlushed", i, ackResp, err, http.StatusOK)
+			return
+		}
+		ackResp.Body.Close()
+	}
+}
+
+// Test to verify a HTTP request with a very large body, over the 10mb limit
+func verifyRequestWithVeryLargeBody(t *testing.T, client *http.Client, tunnelUrl string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	hundredMb := 100000000
+	reqBody := map[string]interface{}{
+		"success": true,
+		"payload": make([]byte, hundredMb),
+	}
+
+	serializedReqBody, _ := json.Marshal(reqBody)
+	req, reqErr := http.NewRequest("POST", tunnelUrl+devserver.POST_SUCCESS_URL, bytes.NewBuffer(serializedReqBody))
+	if reqErr != nil {
+		log.Fatalf("Failed to create new request: %v", reqErr)
+	}
+	// Adding custom header to confirm that they are propogated when going through mmar
+	req.Header.Set("Simulation-Test", "verify-very-large-post-request-success")
+
+	resp, respErr := client.Do(req)
+	if respErr != nil {
+		// Check if connection was closed in the middle of writing, that's also valid behavior
+		if !strings.Contains(respErr.Error(), "write: connection reset by peer") && !strings.Contains(respErr.Error(), "write: broken pipe") {
+			t.Errorf("Failed to get response: %v", respErr)
+		}
+		return
+	}
+
+	validateTunnelErrResponse(t, resp, http.StatusRequestEntityTooLarge, constants.ERR_CODE_REQUEST_TOO_LARGE, constants.MAX_REQ_BODY_SIZE_ERR_TEXT, "verifyRequestWithVeryLargeBody")
+}
+
+// Test to verify that mmar handles invalid response from dev server gracefully
+func verifyDevServerReturningInvalidRespHandled(t *testing.T, client *http.Client, tunnelUrl string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	req, reqErr := http.NewRequest("GET", tunnelUrl+devserver.BAD_RESPONSE_URL, nil)
+	if reqErr != nil {
+		log.Fatalf("Failed to create new request: %v", reqErr)
+	}
+
+	resp, respErr := client.Do(req)
+	if respErr != nil {
+		t.Errorf("Failed to get response: %v", respErr)
+	}
+
+	validateTunnelErrResponse(t, resp, http.StatusBadGateway, constants.ERR_CODE_INVALID_RESP_FROM_DEST, constants.READ_RESP_BODY_ERR_TEXT, "verifyDevServerReturningInvalidRespHandled")
 }
 
-// Test to verify that mmar timesout if devserver takes too long to respond
+// Test to verify that mmar timesout if devserver takes too long to respond, after the
+// timeout mmar server is configured with rather than the default one
 func verifyDevServerLongRunningReqHandledGradefully(t *testing.T, client *http.Client, tunnelUrl string, wg *sync.WaitGroup) {
 	defer wg.Done()
 	req, reqErr := http.NewRequest("GET", tunnelUrl+devserver.LONG_RUNNING_URL, nil)
@@ -722,23 +916,17 @@ func verifyDevServerLongRunningReqHandledGradefully(t *testing.T, client *http.C
 		log.Fatalf("Failed to create new request: %v", reqErr)
 	}
 
+	sentOn := time.Now()
 	resp, respErr := client.Do(req)
 	if respErr != nil {
 		t.Errorf("Failed to get response: %v", respErr)
 	}
 
-	expectedBody := constants.DEST_REQUEST_TIMEDOUT_ERR_TEXT
+	validateTunnelErrResponse(t, resp, http.StatusGatewayTimeout, constants.ERR_CODE_DEST_REQUEST_TIMEDOUT, constants.DEST_REQUEST_TIMEDOUT_ERR_TEXT, "verifyDevServerLongRunningReqHandledGradefully")
 
-	expectedResp := expectedResponse{
-		statusCode: http.StatusOK,
-		headers: map[string]string{
-			"Content-Length": strconv.Itoa(len(expectedBody)),
-			"Content-Type":   "text/plain; charset=utf-8",
-		},
-		textBody: expectedBody,
+	if elapsed := time.Since(sentOn); elapsed >= constants.DEST_REQUEST_TIMEOUT*time.Second {
+		t.Errorf("%v: timed out after %v; want about %vs", "verifyDevServerLongRunningReqHandledGradefully", elapsed, DEST_REQUEST_TIMEOUT)
 	}
-
-	validateRequestResponse(t, expectedResp, resp, "verifyDevServerLongRunningReqHandledGradefully")
 }
 
 // Test to verify that mmar handles crashes in the devserver gracefully
@@ -754,95 +942,1458 @@ func verifyDevServerCrashHandledGracefully(t *testing.T, client *http.Client, tu
 		t.Errorf("Failed to get response: %v", respErr)
 	}
 
-	expectedBody := constants.LOCALHOST_NOT_RUNNING_ERR_TEXT
+	validateTunnelErrResponse(t, resp, http.StatusBadGateway, constants.ERR_CODE_LOCALHOST_NOT_RUNNING, constants.LOCALHOST_NOT_RUNNING_ERR_TEXT, "verifyDevServerCrashHandledGracefully")
+}
+
+// Test to verify a connection that switches protocols streams data in both directions
+func verifyUpgradedConnectionStreams(t *testing.T, tunnelUrl string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	dialUrl := strings.Replace(tunnelUrl, "http://", "", 1)
+
+	// Write a raw HTTP request asking to switch to the "echo" protocol
+	req := "GET " + devserver.UPGRADE_URL + " HTTP/1.1\r\n" +
+		"Host: " + dialUrl + "\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: echo\r\n" +
+		"\r\n"
+
+	conn := manualHttpRequest(dialUrl, req)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	resp, respErr := http.ReadResponse(reader, nil)
+	if respErr != nil {
+		t.Errorf("%v: Failed to get response %v", "verifyUpgradedConnectionStreams", respErr)
+		return
+	}
 
 	expectedResp := expectedResponse{
-		statusCode: http.StatusOK,
+		statusCode: http.StatusSwitchingProtocols,
 		headers: map[string]string{
-			"Content-Length": strconv.Itoa(len(expectedBody)),
-			"Content-Type":   "text/plain; charset=utf-8",
+			"Upgrade":           "echo",
+			"Simulation-Header": "devserver-handle-upgrade",
 		},
-		textBody: expectedBody,
 	}
+	validateRequestResponse(t, expectedResp, resp, "verifyUpgradedConnectionStreams")
+
+	// Verify messages are echoed back through the stream
+	for i := range 3 {
+		msg := fmt.Sprintf("echo message %d\n", i)
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Errorf("%v: Failed to write to stream %v", "verifyUpgradedConnectionStreams", err)
+			return
+		}
 
-	validateRequestResponse(t, expectedResp, resp, "verifyDevServerCrashHandledGracefully")
+		echoed, err := reader.ReadString('\n')
+		if err != nil {
+			t.Errorf("%v: Failed to read from stream %v", "verifyUpgradedConnectionStreams", err)
+			return
+		}
+		if echoed != msg {
+			t.Errorf("%v: echoed = %v; want %v", "verifyUpgradedConnectionStreams", echoed, msg)
+		}
+	}
 }
 
-func TestSimulation(t *testing.T) {
-	simulationCtx, simulationCancel := context.WithCancel(context.Background())
+// Test to verify data sent over a TCP tunnel reaches the local service and its replies come back
+func verifyTcpTunnelStreams(t *testing.T, tunnelUrl string, wg *sync.WaitGroup) {
+	defer wg.Done()
 
-	// Start a local dev server with http
-	localDevServer := StartLocalDevServer("http", "localhost")
-	defer localDevServer.Close()
+	tunnelAddr := strings.TrimPrefix(tunnelUrl, "tcp://")
+	conn, err := net.DialTimeout("tcp", tunnelAddr, 5*time.Second)
+	if err != nil {
+		t.Errorf("%v: Failed to connect to TCP tunnel %v", "verifyTcpTunnelStreams", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
 
-	// Start a local dev server with https
-	localDevTLSServer := StartLocalDevServer("https", "example.com")
-	defer localDevTLSServer.Close()
+	reader := bufio.NewReader(conn)
+	for i := range 3 {
+		msg := fmt.Sprintf("tcp message %d\n", i)
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Errorf("%v: Failed to write to TCP tunnel %v", "verifyTcpTunnelStreams", err)
+			return
+		}
 
-	// Write cert to file so we are able to pass it into mmar client
-	certErr := os.WriteFile("./temp-cert", localDevTLSServer.Certificate().Raw, 0644) // 0644 is file permissions
-	if certErr != nil {
-		log.Fatal(certErr)
+		echoed, err := reader.ReadString('\n')
+		if err != nil {
+			t.Errorf("%v: Failed to read from TCP tunnel %v", "verifyTcpTunnelStreams", err)
+			return
+		}
+		if echoed != msg {
+			t.Errorf("%v: echoed = %v; want %v", "verifyTcpTunnelStreams", echoed, msg)
+		}
 	}
 
-	go dnsserver.StartDnsServer()
-
-	go StartMmarServer(simulationCtx)
-	wait := time.NewTimer(2 * time.Second)
-	<-wait.C
+	// Closing the write side should close the local connection, which closes the tunneled connection
+	conn.(*net.TCPConn).CloseWrite()
+	if _, err := reader.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("%v: read after close = %v; want %v", "verifyTcpTunnelStreams", err, io.EOF)
+	}
+}
 
-	// Start a basic mmar client
-	basicClientUrlCh := make(chan string)
-	go StartMmarClient(simulationCtx, basicClientUrlCh, localDevServer.Port(), "", "", "", "")
+// Test to verify HTTP requests to a TCP tunnel's subdomain are rejected
+func verifyTcpTunnelRejectsHttpRequests(t *testing.T, tunnelUrl string, wg *sync.WaitGroup) {
+	defer wg.Done()
 
-	// Start another basic mmar client
-	basicClientUrlCh2 := make(chan string)
-	go StartMmarClient(simulationCtx, basicClientUrlCh2, localDevServer.Port(), "", "", "", "")
+	// No subdomain is shown for TCP tunnels, so look it up from the server stats
+	connectedClients, err := connectedClientsStats()
+	if err != nil {
+		t.Errorf("%v: Failed to get server stats %v", "verifyTcpTunnelRejectsHttpRequests", err)
+		return
+	}
 
-	// Wait for all tunnel urls
-	mmarClientsCount := 2
-	tunnelUrls := []string{}
-	for range mmarClientsCount {
-		select {
-		case tunnelUrl := <-basicClientUrlCh:
-			tunnelUrls = append(tunnelUrls, tunnelUrl)
-		case tunnelUrl := <-basicClientUrlCh2:
-			tunnelUrls = append(tunnelUrls, tunnelUrl)
+	tunnelPort := tunnelUrl[strings.LastIndex(tunnelUrl, ":")+1:]
+	subdomain := ""
+	for _, client := range connectedClients {
+		if client["type"] == constants.TUNNEL_TYPE_TCP && client["port"] == tunnelPort {
+			subdomain, _ = client["id"].(string)
 		}
 	}
+	if subdomain == "" {
+		t.Errorf("%v: TCP tunnel on port %v not found in server stats", "verifyTcpTunnelRejectsHttpRequests", tunnelPort)
+		return
+	}
 
-	// Initialize http client
-	client := httpClient()
+	resp, err := httpClient().Get(fmt.Sprintf("http://%s.localhost:%s%s", subdomain, constants.SERVER_HTTP_PORT, devserver.GET_SUCCESS_URL))
+	if err != nil {
+		t.Errorf("%v: Failed to make request %v", "verifyTcpTunnelRejectsHttpRequests", err)
+		return
+	}
 
-	var wg sync.WaitGroup
+	validateTunnelErrResponse(t, resp, http.StatusNotFound, constants.ERR_CODE_TUNNEL_NOT_HTTP, constants.TUNNEL_NOT_HTTP_ERR_TEXT, "verifyTcpTunnelRejectsHttpRequests")
+}
 
-	simulationTests := []func(t *testing.T, client *http.Client, tunnelUrl string, wg *sync.WaitGroup){
-		// Perform simulated usage tests
-		verifyGetRequestSuccess,
-		verifyGetRequestFail,
-		verifyPostRequestSuccess,
-		verifyPostRequestFail,
-		verifyRedirectsHandled,
+// Test to verify datagrams sent to a UDP tunnel reach the local service and its replies
+// come back to the same source address
+func verifyUdpTunnelRelaysDatagrams(t *testing.T, tunnelUrl string, wg *sync.WaitGroup) {
+	defer wg.Done()
 
-		// Perform Invalid HTTP requests to test durability of mmar
-		verifyInvalidMethodRequestHandled,
-		verifyRequestWithLargeBody,
+	tunnelAddr := strings.TrimPrefix(tunnelUrl, "udp://")
+	conn, err := net.Dial("udp", tunnelAddr)
+	if err != nil {
+		t.Errorf("%v: Failed to connect to UDP tunnel %v", "verifyUdpTunnelRelaysDatagrams", err)
+		return
+	}
+	defer conn.Close()
 
-		// Perform edge case usage tests
-		verifyRequestWithVeryLargeBody,
-		verifyDevServerReturningInvalidRespHandled,
-		verifyDevServerLongRunningReqHandledGradefully,
-		verifyDevServerCrashHandledGracefully,
+	buf := make([]byte, 1024)
+	for i := range 3 {
+		datagram := fmt.Sprintf("udp datagram %d from %s", i, conn.LocalAddr())
+		if _, err := conn.Write([]byte(datagram)); err != nil {
+			t.Errorf("%v: Failed to write to UDP tunnel %v", "verifyUdpTunnelRelaysDatagrams", err)
+			return
+		}
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Errorf("%v: Failed to read from UDP tunnel %v", "verifyUdpTunnelRelaysDatagrams", err)
+			return
+		}
+		if string(buf[:n]) != datagram {
+			t.Errorf("%v: echoed = %v; want %v", "verifyUdpTunnelRelaysDatagrams", string(buf[:n]), datagram)
+		}
 	}
+}
 
-	// Tests that require more control hence don't use the built in go http.client
-	manualClientSimulationTests := []func(t *testing.T, tunnelUrl string, wg *sync.WaitGroup){
-		// Perform Invalid HTTP requests to test durability of mmar
-		verifyInvalidHeadersRequestHandled,
+// Test to verify UDP tunnels keep up to the max number of sessions open, dropping the
+// datagrams of new source addresses while they are all open
+func verifyUdpSessionsCapped(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	conn, reader, msgType, msgData, err := requestRawTunnel(protocol.CREATE_TUNNEL, protocol.TunnelRequest{TunnelType: constants.TUNNEL_TYPE_UDP})
+	if err != nil || msgType != protocol.TUNNEL_CREATED {
+		t.Errorf("%v: create tunnel = (%v, %v); want (%v, nil)", "verifyUdpSessionsCapped", msgType, err, protocol.TUNNEL_CREATED)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	created, err := protocol.ParseTunnelCreated(msgData)
+	if err != nil {
+		t.Errorf("%v: failed to parse tunnel created: %v", "verifyUdpSessionsCapped", err)
+		return
+	}
+
+	// Send a datagram from one more source address than the sessions the tunnel keeps open,
+	// followed by another one from the first source address, whose session is still open
+	tunnelAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(created.Port))
+	var sources []net.Conn
+	for i := range MAX_UDP_SESSIONS + 1 {
+		source, err := net.Dial("udp", tunnelAddr)
+		if err != nil {
+			t.Errorf("%v: Failed to connect to UDP tunnel %v", "verifyUdpSessionsCapped", err)
+			return
+		}
+		defer source.Close()
+		source.Write([]byte(fmt.Sprintf("datagram from source %d", i)))
+		sources = append(sources, source)
+	}
+	lastDatagram := "another datagram from source 0"
+	sources[0].Write([]byte(lastDatagram))
+
+	sessionsOpened := 0
+	for {
+		_, msgType, msgData, err := readTunnelMessage(reader)
+		if err != nil {
+			t.Errorf("%v: Failed to read tunnel message %v", "verifyUdpSessionsCapped", err)
+			return
+		}
+		if msgType == protocol.UDP_SESSION_OPEN {
+			sessionsOpened++
+		}
+		if msgType == protocol.UDP_DATAGRAM && string(msgData[constants.REQUEST_ID_BUFF_SIZE:]) == lastDatagram {
+			break
+		}
+	}
+	if sessionsOpened != MAX_UDP_SESSIONS {
+		t.Errorf("%v: sessions opened = %v; want %v", "verifyUdpSessionsCapped", sessionsOpened, MAX_UDP_SESSIONS)
+	}
+	writeTunnelMessage(conn, constants.TUNNEL_MESSAGE_PROTOCOL_VERSION, protocol.CLIENT_DISCONNECT, nil)
+}
+
+// Test to verify mmar clients predating protocol negotiation are still served, receiving
+// the whole request and sending back the whole response in single messages
+func verifyLegacyClientServed(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	conn, err := dialMmarServer()
+	if err != nil {
+		t.Errorf("%v: Failed to connect to mmar server %v", "verifyLegacyClientServed", err)
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	legacyVersion := uint8(constants.LEGACY_TUNNEL_MESSAGE_PROTOCOL_VERSION)
+	if err := writeTunnelMessage(conn, legacyVersion, protocol.CREATE_TUNNEL, nil); err != nil {
+		t.Errorf("%v: Failed to create tunnel %v", "verifyLegacyClientServed", err)
+		return
+	}
+	version, msgType, subdomain, err := readTunnelMessage(reader)
+	if err != nil || version != legacyVersion || msgType != protocol.TUNNEL_CREATED {
+		t.Errorf("%v: tunnel created msg = (%v, %v, %v); want (%v, %v, nil)", "verifyLegacyClientServed", version, msgType, err, legacyVersion, protocol.TUNNEL_CREATED)
+		return
+	}
+
+	reqBody := "legacy request body"
+	respCh := make(chan *http.Response, 1)
+	go func() {
+		resp, err := httpClient().Post(
+			fmt.Sprintf("http://%s.localhost:%s/legacy", subdomain, constants.SERVER_HTTP_PORT),
+			"text/plain",
+			strings.NewReader(reqBody),
+		)
+		if err != nil {
+			t.Errorf("%v: Failed to make request %v", "verifyLegacyClientServed", err)
+		}
+		respCh <- resp
+	}()
+
+	// The request including its body is received in a single message, with the legacy version
+	version, msgType, reqData, err := readTunnelMessage(reader)
+	if err != nil || version != legacyVersion || msgType != protocol.REQUEST {
+		t.Errorf("%v: request msg = (%v, %v, %v); want (%v, %v, nil)", "verifyLegacyClientServed", version, msgType, err, legacyVersion, protocol.REQUEST)
+		return
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(reqData[constants.REQUEST_ID_BUFF_SIZE:])))
+	if err != nil {
+		t.Errorf("%v: Failed to parse request %v", "verifyLegacyClientServed", err)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != reqBody {
+		t.Errorf("%v: request body = %v; want %v", "verifyLegacyClientServed", string(body), reqBody)
+	}
+
+	// Respond with the whole response in a single message
+	respBody := "legacy response body"
+	rawResp := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(respBody), respBody)
+	respData := append(reqData[:constants.REQUEST_ID_BUFF_SIZE:constants.REQUEST_ID_BUFF_SIZE], rawResp...)
+	if err := writeTunnelMessage(conn, legacyVersion, protocol.RESPONSE, respData); err != nil {
+		t.Errorf("%v: Failed to send response %v", "verifyLegacyClientServed", err)
+		return
+	}
+
+	resp := <-respCh
+	if resp == nil {
+		return
+	}
+	expectedResp := expectedResponse{
+		statusCode: http.StatusOK,
+		headers: map[string]string{
+			"Content-Length": strconv.Itoa(len(respBody)),
+		},
+		textBody: respBody,
+	}
+	validateRequestResponse(t, expectedResp, resp, "verifyLegacyClientServed")
+}
+
+// Test to verify mmar server lets mmar clients know when they have no protocol version
+// in common, and closes the connection
+func verifyUnsupportedProtocolVersionRejected(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	conn, err := dialMmarServer()
+	if err != nil {
+		t.Errorf("%v: Failed to connect to mmar server %v", "verifyUnsupportedProtocolVersionRejected", err)
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	hello := protocol.Hello{Versions: []int{constants.TUNNEL_MESSAGE_PROTOCOL_VERSION + 1}, Features: []string{constants.FEATURE_STREAMING}}
+	helloData, _ := hello.MsgData()
+	if err := writeTunnelMessage(conn, constants.HELLO_MESSAGE_PROTOCOL_VERSION, protocol.HELLO, helloData); err != nil {
+		t.Errorf("%v: Failed to send hello %v", "verifyUnsupportedProtocolVersionRejected", err)
+		return
+	}
+
+	_, msgType, ackData, err := readTunnelMessage(reader)
+	if err != nil || msgType != protocol.HELLO_ACK {
+		t.Errorf("%v: hello ack msg = (%v, %v); want (%v, nil)", "verifyUnsupportedProtocolVersionRejected", msgType, err, protocol.HELLO_ACK)
+		return
+	}
+	ack, err := protocol.ParseHelloAck(ackData)
+	if err != nil || ack.Version != 0 {
+		t.Errorf("%v: negotiated version = (%v, %v); want (0, nil)", "verifyUnsupportedProtocolVersionRejected", ack.Version, err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, _, err := readTunnelMessage(reader); !errors.Is(err, io.EOF) {
+		t.Errorf("%v: read after hello ack = %v; want %v", "verifyUnsupportedProtocolVersionRejected", err, io.EOF)
+	}
+}
+
+// Test to verify the labels and client version sent when creating the tunnel show up
+// in the server stats
+func verifyTunnelRequestInStats(t *testing.T, tunnelUrl string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	connectedClients, err := connectedClientsStats()
+	if err != nil {
+		t.Errorf("%v: Failed to get server stats %v", "verifyTunnelRequestInStats", err)
+		return
+	}
+
+	subdomain := utils.ExtractSubdomain(strings.TrimPrefix(tunnelUrl, "http://"))
+	for _, client := range connectedClients {
+		if client["id"] != subdomain {
+			continue
+		}
+		labels, _ := client["labels"].(map[string]any)
+		if labels["team"] != "simulations" || labels["env"] != "test" {
+			t.Errorf("%v: labels = %v; want %v", "verifyTunnelRequestInStats", client["labels"], LIMITED_CLIENT_LABELS)
+		}
+		if client["clientVersion"] != constants.MMAR_VERSION {
+			t.Errorf("%v: clientVersion = %v; want %v", "verifyTunnelRequestInStats", client["clientVersion"], constants.MMAR_VERSION)
+		}
+		if ip := net.ParseIP(fmt.Sprint(client["remoteIp"])); ip == nil || !ip.IsLoopback() {
+			t.Errorf("%v: remoteIp = %v; want a loopback IP", "verifyTunnelRequestInStats", client["remoteIp"])
+		}
+		for _, field := range []string{"requests", "errors", "bytesIn", "bytesOut", "inflightRequests", "latencyP50Ms", "latencyP95Ms"} {
+			if _, ok := client[field].(float64); !ok {
+				t.Errorf("%v: %v = %v; want a number", "verifyTunnelRequestInStats", field, client[field])
+			}
+		}
+		return
+	}
+	t.Errorf("%v: Tunnel %v not found in server stats", "verifyTunnelRequestInStats", subdomain)
+}
+
+// Test to verify the tunnels in the server stats can be filtered, sorted and paginated,
+// and their usage reflects the requests tunneled through them
+func verifyStatsFilteredAndPaginated(t *testing.T, tunnelUrl string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	subdomain := utils.ExtractSubdomain(strings.TrimPrefix(tunnelUrl, "http://"))
+	for range 3 {
+		resp, err := httpClient().Get(tunnelUrl + devserver.GET_SUCCESS_URL)
+		if err != nil {
+			t.Errorf("%v: Failed to make request %v", "verifyStatsFilteredAndPaginated", err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	stats, err := serverStats("type=http&label=team%3Dsimulations&id=" + subdomain)
+	if err != nil {
+		t.Errorf("%v: Failed to get server stats %v", "verifyStatsFilteredAndPaginated", err)
+		return
+	}
+	if stats.MatchingClientsCount != 1 || len(stats.ConnectedClients) != 1 || stats.ConnectedClients[0]["id"] != subdomain {
+		t.Errorf("%v: filtered stats = %v; want only %v", "verifyStatsFilteredAndPaginated", stats.ConnectedClients, subdomain)
+		return
+	}
+	if requests, _ := stats.ConnectedClients[0]["requests"].(float64); requests < 3 {
+		t.Errorf("%v: requests = %v; want at least 3", "verifyStatsFilteredAndPaginated", requests)
+	}
+	if _, ok := stats.ConnectedClients[0]["lastRequestOn"]; !ok {
+		t.Errorf("%v: lastRequestOn missing from %v", "verifyStatsFilteredAndPaginated", stats.ConnectedClients[0])
+	}
+
+	// Paging through the TCP and UDP tunnels sorted by id returns each of them once in
+	// order, they are only filtered by type since other tunnels come and go meanwhile
+	allStats, err := serverStats("type=tcp&type=udp&sort=id")
+	if err != nil {
+		t.Errorf("%v: Failed to get server stats %v", "verifyStatsFilteredAndPaginated", err)
+		return
+	}
+	allIds := []any{}
+	for _, client := range allStats.ConnectedClients {
+		if client["type"] == constants.TUNNEL_TYPE_HTTP {
+			t.Errorf("%v: stats filtered by type = %v; want no http tunnels", "verifyStatsFilteredAndPaginated", allStats.ConnectedClients)
+		}
+		allIds = append(allIds, client["id"])
+	}
+	pagedIds := []any{}
+	for offset := 0; offset < allStats.MatchingClientsCount; offset++ {
+		page, err := serverStats(fmt.Sprintf("type=tcp&type=udp&sort=id&limit=1&offset=%d", offset))
+		if err != nil {
+			t.Errorf("%v: Failed to get server stats %v", "verifyStatsFilteredAndPaginated", err)
+			return
+		}
+		for _, client := range page.ConnectedClients {
+			pagedIds = append(pagedIds, client["id"])
+		}
+	}
+	if len(allIds) != 2 || fmt.Sprint(pagedIds) != fmt.Sprint(allIds) {
+		t.Errorf("%v: paged ids = %v; want %v", "verifyStatsFilteredAndPaginated", pagedIds, allIds)
+	}
+
+	if _, err := serverStats("sort=unknown"); err == nil {
+		t.Errorf("%v: sorting by an unknown field succeeded; want it rejected", "verifyStatsFilteredAndPaginated")
+	}
+}
+
+// Test to verify a request body larger than the limit requested by the mmar client is
+// rejected, even though it is within the mmar server's limit
+func verifyRequestedBodySizeLimitEnforced(t *testing.T, tunnelUrl string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for _, reqBodySize := range []int{LIMITED_CLIENT_MAX_REQ_BODY_SIZE, LIMITED_CLIENT_MAX_REQ_BODY_SIZE + 1} {
+		reqBody := bytes.Repeat([]byte("a"), reqBodySize)
+		resp, err := httpClient().Post(tunnelUrl+devserver.POST_SUCCESS_URL, "text/plain", bytes.NewReader(reqBody))
+		if err != nil {
+			t.Errorf("%v: Failed to make request %v", "verifyRequestedBodySizeLimitEnforced", err)
+			return
+		}
+		resp.Body.Close()
+
+		// The body within the limit reaches the dev server, which rejects it as invalid JSON
+		tooLarge := reqBodySize > LIMITED_CLIENT_MAX_REQ_BODY_SIZE
+		if (resp.StatusCode == http.StatusRequestEntityTooLarge) != tooLarge {
+			t.Errorf("%v: status for %d bytes = %v; too large %v", "verifyRequestedBodySizeLimitEnforced", reqBodySize, resp.StatusCode, tooLarge)
+		}
+	}
+}
+
+// Test to verify the metrics are exposed in the Prometheus text format behind the stats
+// credentials, including the requests tunneled through the tunnel
+func verifyMetricsExposed(t *testing.T, tunnelUrl string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	resp, err := httpClient().Get(tunnelUrl + devserver.GET_SUCCESS_URL)
+	if err != nil {
+		t.Errorf("%v: Failed to make request %v", "verifyMetricsExposed", err)
+		return
+	}
+	resp.Body.Close()
+
+	metricsUrl := "http://stats.localhost:" + constants.SERVER_HTTP_PORT + "/metrics"
+	unauthorizedResp, err := httpClient().Get(metricsUrl)
+	if err != nil {
+		t.Errorf("%v: Failed to get metrics %v", "verifyMetricsExposed", err)
+		return
+	}
+	unauthorizedResp.Body.Close()
+	if unauthorizedResp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("%v: status without credentials = %v; want %v", "verifyMetricsExposed", unauthorizedResp.StatusCode, http.StatusUnauthorized)
+	}
+
+	metrics, err := serverMetrics()
+	if err != nil {
+		t.Errorf("%v: Failed to get metrics %v", "verifyMetricsExposed", err)
+		return
+	}
+
+	subdomain := utils.ExtractSubdomain(strings.TrimPrefix(tunnelUrl, "http://"))
+	for _, expected := range []string{
+		"# TYPE mmar_active_tunnels gauge",
+		"mmar_tunnels_created_total{type=\"http\"} ",
+		"# TYPE mmar_http_request_duration_seconds histogram",
+		fmt.Sprintf("mmar_http_requests_total{tunnel=\"%s\",status_class=\"2xx\"} ", subdomain),
+		fmt.Sprintf("mmar_http_request_duration_seconds_bucket{tunnel=\"%s\",le=\"+Inf\"} ", subdomain),
+		fmt.Sprintf("mmar_tunnel_bytes_total{tunnel=\"%s\",direction=\"in\"} ", subdomain),
+		fmt.Sprintf("mmar_tunnel_bytes_total{tunnel=\"%s\",direction=\"out\"} ", subdomain),
+		"# TYPE mmar_heartbeat_rtt_seconds histogram",
+		"# TYPE mmar_auth_failures_total counter",
+		"mmar_ip_limit_rejections_total ",
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("%v: metrics = %v; want them to contain %v", "verifyMetricsExposed", metrics, expected)
+		}
+	}
+}
+
+// Test to verify the subdomain of a disconnected tunnel stays reserved, and can only be
+// reclaimed with the resume token issued when it was created
+func verifyReclaimRequiresResumeToken(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	subdomain := "reclaim-sim"
+	conn, _, msgType, msgData, err := requestRawTunnel(protocol.CREATE_TUNNEL, protocol.TunnelRequest{Subdomain: subdomain})
+	if err != nil || msgType != protocol.TUNNEL_CREATED {
+		t.Errorf("%v: create tunnel = (%v, %v); want (%v, nil)", "verifyReclaimRequiresResumeToken", msgType, err, protocol.TUNNEL_CREATED)
+		return
+	}
+	created, err := protocol.ParseTunnelCreated(msgData)
+	if err != nil || created.Subdomain != subdomain || created.ResumeToken == "" {
+		t.Errorf("%v: tunnel created = (%v, %v); want subdomain %v with resume token", "verifyReclaimRequiresResumeToken", created, err, subdomain)
+		return
+	}
+
+	// Drop the connection without shutting down, and wait for mmar server to notice
+	conn.Close()
+	if err := waitForTunnelDropped(subdomain); err != nil {
+		t.Errorf("%v: %v", "verifyReclaimRequiresResumeToken", err)
+		return
+	}
+
+	// Neither creating a tunnel with the subdomain nor reclaiming it without the resume token succeeds
+	for _, attempt := range []struct {
+		msgType     uint8
+		resumeToken string
+	}{
+		{protocol.CREATE_TUNNEL, ""},
+		{protocol.RECLAIM_TUNNEL, ""},
+		{protocol.RECLAIM_TUNNEL, strings.Repeat("0", len(created.ResumeToken))},
+	} {
+		conn, _, msgType, _, err := requestRawTunnel(attempt.msgType, protocol.TunnelRequest{Subdomain: subdomain, ResumeToken: attempt.resumeToken})
+		if err != nil || msgType != protocol.SUBDOMAIN_ALREADY_TAKEN {
+			t.Errorf("%v: claim with %v = (%v, %v); want (%v, nil)", "verifyReclaimRequiresResumeToken", attempt, msgType, err, protocol.SUBDOMAIN_ALREADY_TAKEN)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+
+	conn, _, msgType, msgData, err = requestRawTunnel(protocol.RECLAIM_TUNNEL, protocol.TunnelRequest{Subdomain: subdomain, ResumeToken: created.ResumeToken})
+	if err != nil || msgType != protocol.TUNNEL_CREATED {
+		t.Errorf("%v: reclaim tunnel = (%v, %v); want (%v, nil)", "verifyReclaimRequiresResumeToken", msgType, err, protocol.TUNNEL_CREATED)
+		return
+	}
+	defer conn.Close()
+	reclaimed, err := protocol.ParseTunnelCreated(msgData)
+	if err != nil || reclaimed.Subdomain != subdomain || reclaimed.ResumeToken == "" {
+		t.Errorf("%v: tunnel reclaimed = (%v, %v); want subdomain %v with resume token", "verifyReclaimRequiresResumeToken", reclaimed, err, subdomain)
+	}
+	writeTunnelMessage(conn, constants.TUNNEL_MESSAGE_PROTOCOL_VERSION, protocol.CLIENT_DISCONNECT, nil)
+}
+
+// Test to verify mmar server closes the connection of mmar clients sending messages larger
+// than its max frame size, or ones it cannot parse
+func verifyMalformedMessagesRejected(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	// Oversized messages are rejected without reading their data, along with messages
+	// whose length cannot be parsed, so the connection is closed as nothing after can be read
+	malformedHeaders := map[string]string{
+		"oversized":       fmt.Sprintf("%c%c%d\n", constants.TUNNEL_MESSAGE_PROTOCOL_VERSION, protocol.RESPONSE_BODY_CHUNK, constants.MAX_FRAME_SIZE+1),
+		"negative length": fmt.Sprintf("%c%c%d\n", constants.TUNNEL_MESSAGE_PROTOCOL_VERSION, protocol.RESPONSE_BODY_CHUNK, -5),
+		"invalid type":    string([]byte{constants.TUNNEL_MESSAGE_PROTOCOL_VERSION, 255, '0', '\n'}),
+	}
+	for name, header := range malformedHeaders {
+		conn, err := dialMmarServer()
+		if err != nil {
+			t.Errorf("%v: Failed to connect to mmar server %v", "verifyMalformedMessagesRejected", err)
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		reader := bufio.NewReader(conn)
+
+		helloData, _ := protocol.Hello{Versions: []int{constants.TUNNEL_MESSAGE_PROTOCOL_VERSION}, Features: []string{}}.MsgData()
+		if err := writeTunnelMessage(conn, constants.HELLO_MESSAGE_PROTOCOL_VERSION, protocol.HELLO, helloData); err != nil {
+			t.Errorf("%v: Failed to send hello %v", "verifyMalformedMessagesRejected", err)
+			return
+		}
+		if _, msgType, _, err := readTunnelMessage(reader); err != nil || msgType != protocol.HELLO_ACK {
+			t.Errorf("%v: hello ack msg = (%v, %v); want (%v, nil)", "verifyMalformedMessagesRejected", msgType, err, protocol.HELLO_ACK)
+			return
+		}
+
+		fmt.Fprint(conn, header)
+		if _, _, _, err := readTunnelMessage(reader); !errors.Is(err, io.EOF) {
+			t.Errorf("%v: read after %v message = %v; want %v", "verifyMalformedMessagesRejected", name, err, io.EOF)
+		}
+	}
+}
+
+// Test to verify mmar server skips messages about requests received before a tunnel is
+// created, instead of handling them without a tunnel, and closes the connection of mmar
+// clients that keep sending them
+func verifyMessagesBeforeTunnelRejected(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	conn, err := dialMmarServer()
+	if err != nil {
+		t.Errorf("%v: Failed to connect to mmar server %v", "verifyMessagesBeforeTunnelRejected", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	helloData, _ := protocol.Hello{Versions: []int{constants.TUNNEL_MESSAGE_PROTOCOL_VERSION}, Features: []string{}}.MsgData()
+	if err := writeTunnelMessage(conn, constants.HELLO_MESSAGE_PROTOCOL_VERSION, protocol.HELLO, helloData); err != nil {
+		t.Errorf("%v: Failed to send hello %v", "verifyMessagesBeforeTunnelRejected", err)
+		return
+	}
+	if _, msgType, _, err := readTunnelMessage(reader); err != nil || msgType != protocol.HELLO_ACK {
+		t.Errorf("%v: hello ack msg = (%v, %v); want (%v, nil)", "verifyMessagesBeforeTunnelRejected", msgType, err, protocol.HELLO_ACK)
+		return
+	}
+
+	// The messages are skipped, so the connection can still be used
+	respData := protocol.RequestIdMsgData(1, []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+	windowUpdateData := protocol.RequestIdMsgData(1, []byte("1024"))
+	writeTunnelMessage(conn, constants.TUNNEL_MESSAGE_PROTOCOL_VERSION, protocol.RESPONSE, respData)
+	writeTunnelMessage(conn, constants.TUNNEL_MESSAGE_PROTOCOL_VERSION, protocol.WINDOW_UPDATE, windowUpdateData)
+	if err := writeTunnelMessage(conn, constants.TUNNEL_MESSAGE_PROTOCOL_VERSION, protocol.HEARTBEAT_FROM_CLIENT, nil); err != nil {
+		t.Errorf("%v: Failed to send heartbeat %v", "verifyMessagesBeforeTunnelRejected", err)
+		return
+	}
+	if _, msgType, _, err := readTunnelMessage(reader); err != nil || msgType != protocol.HEARTBEAT_ACK {
+		t.Errorf("%v: heartbeat ack msg = (%v, %v); want (%v, nil)", "verifyMessagesBeforeTunnelRejected", msgType, err, protocol.HEARTBEAT_ACK)
+		return
+	}
+
+	// Until there are too many of them
+	for i := 0; i < constants.MAX_MALFORMED_MESSAGES; i++ {
+		writeTunnelMessage(conn, constants.TUNNEL_MESSAGE_PROTOCOL_VERSION, protocol.WINDOW_UPDATE, windowUpdateData)
+	}
+	if _, _, _, err := readTunnelMessage(reader); !errors.Is(err, io.EOF) {
+		t.Errorf("%v: read after messages before tunnel = %v; want %v", "verifyMessagesBeforeTunnelRejected", err, io.EOF)
+	}
+}
+
+// Test to verify the tunnel created message carries the limits applied to the tunnel,
+// lowered to the ones the mmar client requested and capped to the server's otherwise
+func verifyTunnelCreatedIncludesLimits(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	requested := protocol.TunnelLimits{MaxRequestBodySize: LIMITED_CLIENT_MAX_REQ_BODY_SIZE, DestRequestTimeout: 100}
+	conn, _, msgType, msgData, err := requestRawTunnel(protocol.CREATE_TUNNEL, protocol.TunnelRequest{Limits: requested})
+	if err != nil || msgType != protocol.TUNNEL_CREATED {
+		t.Errorf("%v: create tunnel = (%v, %v); want (%v, nil)", "verifyTunnelCreatedIncludesLimits", msgType, err, protocol.TUNNEL_CREATED)
+		return
+	}
+	defer conn.Close()
+
+	created, err := protocol.ParseTunnelCreated(msgData)
+	if err != nil {
+		t.Errorf("%v: failed to parse tunnel created: %v", "verifyTunnelCreatedIncludesLimits", err)
+		return
+	}
+	expected := protocol.TunnelLimits{
+		MaxRequestBodySize:     LIMITED_CLIENT_MAX_REQ_BODY_SIZE,
+		RequestBodyReadTimeout: constants.REQ_BODY_READ_CHUNK_TIMEOUT,
+		DestRequestTimeout:     DEST_REQUEST_TIMEOUT,
+		HeartbeatTimeout:       constants.HEARTBEAT_FROM_SERVER_TIMEOUT,
+		ClientHeartbeatTimeout: constants.HEARTBEAT_FROM_CLIENT_TIMEOUT,
+	}
+	if created.Limits != expected {
+		t.Errorf("%v: limits = %+v; want %+v", "verifyTunnelCreatedIncludesLimits", created.Limits, expected)
+	}
+	writeTunnelMessage(conn, constants.TUNNEL_MESSAGE_PROTOCOL_VERSION, protocol.CLIENT_DISCONNECT, nil)
+}
+
+// Test to verify requests to a tunnel that is reconnecting are held, and forwarded once
+// the mmar client reclaims its subdomain
+func verifyQueuedRequestReplayedOnReclaim(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	subdomain := "replay-sim"
+	resumeToken, err := createAndDropRawTunnel(subdomain)
+	if err != nil {
+		t.Errorf("%v: Failed to create tunnel %v", "verifyQueuedRequestReplayedOnReclaim", err)
+		return
+	}
+
+	reqBody := "held request body"
+	respCh := make(chan *http.Response, 1)
+	go func() {
+		resp, err := httpClient().Post(
+			fmt.Sprintf("http://%s.localhost:%s/replay", subdomain, constants.SERVER_HTTP_PORT),
+			"text/plain",
+			strings.NewReader(reqBody),
+		)
+		if err != nil {
+			t.Errorf("%v: Failed to make request %v", "verifyQueuedRequestReplayedOnReclaim", err)
+		}
+		respCh <- resp
+	}()
+
+	// Reclaim the subdomain once the request is held
+	time.Sleep(500 * time.Millisecond)
+	conn, reader, msgType, _, err := requestRawTunnel(protocol.RECLAIM_TUNNEL, protocol.TunnelRequest{Subdomain: subdomain, ResumeToken: resumeToken})
+	if err != nil || msgType != protocol.TUNNEL_CREATED {
+		t.Errorf("%v: reclaim tunnel = (%v, %v); want (%v, nil)", "verifyQueuedRequestReplayedOnReclaim", msgType, err, protocol.TUNNEL_CREATED)
+		return
+	}
+	defer conn.Close()
+
+	_, msgType, reqData, err := readTunnelMessage(reader)
+	if err != nil || msgType != protocol.REQUEST {
+		t.Errorf("%v: request msg = (%v, %v); want (%v, nil)", "verifyQueuedRequestReplayedOnReclaim", msgType, err, protocol.REQUEST)
+		return
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(reqData[constants.REQUEST_ID_BUFF_SIZE:])))
+	if err != nil {
+		t.Errorf("%v: Failed to parse request %v", "verifyQueuedRequestReplayedOnReclaim", err)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != reqBody {
+		t.Errorf("%v: request body = %v; want %v", "verifyQueuedRequestReplayedOnReclaim", string(body), reqBody)
+	}
+
+	respBody := "replayed response body"
+	rawResp := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(respBody), respBody)
+	respData := append(reqData[:constants.REQUEST_ID_BUFF_SIZE:constants.REQUEST_ID_BUFF_SIZE], rawResp...)
+	if err := writeTunnelMessage(conn, constants.TUNNEL_MESSAGE_PROTOCOL_VERSION, protocol.RESPONSE, respData); err != nil {
+		t.Errorf("%v: Failed to send response %v", "verifyQueuedRequestReplayedOnReclaim", err)
+		return
+	}
+
+	resp := <-respCh
+	if resp == nil {
+		return
+	}
+	expectedResp := expectedResponse{
+		statusCode: http.StatusOK,
+		headers: map[string]string{
+			"Content-Length": strconv.Itoa(len(respBody)),
+		},
+		textBody: respBody,
+	}
+	validateRequestResponse(t, expectedResp, resp, "verifyQueuedRequestReplayedOnReclaim")
+	writeTunnelMessage(conn, constants.TUNNEL_MESSAGE_PROTOCOL_VERSION, protocol.CLIENT_DISCONNECT, nil)
+}
+
+// Test to verify requests held for a reconnecting tunnel are rejected when they exceed
+// what can be held, or when the tunnel is not reclaimed within the grace period
+func verifyQueuedRequestsRejected(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	subdomain := "expire-sim"
+	if _, err := createAndDropRawTunnel(subdomain); err != nil {
+		t.Errorf("%v: Failed to create tunnel %v", "verifyQueuedRequestsRejected", err)
+		return
+	}
+	url := fmt.Sprintf("http://%s.localhost:%s/expire", subdomain, constants.SERVER_HTTP_PORT)
+
+	largeBody := bytes.Repeat([]byte("a"), constants.MAX_RECONNECT_QUEUED_BYTES+1)
+	resp, err := httpClient().Post(url, "text/plain", bytes.NewReader(largeBody))
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("%v: too large held request = (%v, %v); want %v", "verifyQueuedRequestsRejected", resp, err, http.StatusServiceUnavailable)
+	}
+
+	start := time.Now()
+	resp, err = httpClient().Get(url)
+	if err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("%v: expired held request = (%v, %v); want %v", "verifyQueuedRequestsRejected", resp, err, http.StatusBadGateway)
+		return
+	}
+	if time.Since(start) < time.Second {
+		t.Errorf("%v: expired held request responded after %v; want it to be held", "verifyQueuedRequestsRejected", time.Since(start))
+	}
+}
+
+// Test to verify tunnel errors are rendered in the format end-users accept, with the
+// error code and request ID to trace them by
+func verifyTunnelErrContentNegotiated(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	url := fmt.Sprintf("http://missing-sim.localhost:%s/", constants.SERVER_HTTP_PORT)
+	for _, accept := range []string{"", "text/plain", "application/json", "text/html;q=0.5, application/json", "text/html", "text/*, application/json;q=0.9"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := httpClient().Do(req)
+		if err != nil {
+			t.Errorf("%v: Failed to make request %v", "verifyTunnelErrContentNegotiated", err)
+			return
+		}
+
+		switch accept {
+		case "application/json", "text/html;q=0.5, application/json":
+			expectedResp := expectedResponse{
+				statusCode: http.StatusNotFound,
+				headers:    map[string]string{"Content-Type": "application/json"},
+			}
+			var errResp map[string]interface{}
+			body, _ := io.ReadAll(resp.Body)
+			if err := json.Unmarshal(body, &errResp); err != nil || errResp["requestId"] == "" {
+				t.Errorf("%v: Accept %v body = %v; want JSON with a request ID", "verifyTunnelErrContentNegotiated", accept, string(body))
+				continue
+			}
+			expectedResp.jsonBody = map[string]interface{}{
+				"status":    http.StatusNotFound,
+				"code":      constants.ERR_CODE_TUNNEL_NOT_FOUND,
+				"message":   constants.CLIENT_DISCONNECT_ERR_TEXT,
+				"requestId": errResp["requestId"],
+			}
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			validateRequestResponse(t, expectedResp, resp, "verifyTunnelErrContentNegotiated")
+		case "text/html":
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusNotFound ||
+				resp.Header.Get("Content-Type") != "text/html; charset=utf-8" ||
+				!strings.Contains(string(body), constants.ERR_CODE_TUNNEL_NOT_FOUND) {
+				t.Errorf("%v: Accept %v resp = (%v, %v, %v); want an HTML error page", "verifyTunnelErrContentNegotiated", accept, resp.StatusCode, resp.Header.Get("Content-Type"), string(body))
+			}
+		default:
+			validateTunnelErrResponse(t, resp, http.StatusNotFound, constants.ERR_CODE_TUNNEL_NOT_FOUND, constants.CLIENT_DISCONNECT_ERR_TEXT, "verifyTunnelErrContentNegotiated")
+		}
+	}
+}
+
+// Test to verify error pages are rendered from the custom templates provided, with the
+// details of the request
+func verifyCustomErrorPageRendered(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://custom-page-sim.localhost:%s/", TLS_SERVER_HTTP_PORT), nil)
+	req.Header.Set("Accept", "text/html")
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		t.Errorf("%v: Failed to make request %v", "verifyCustomErrorPageRendered", err)
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+
+	expectedPrefix := fmt.Sprintf(
+		"<h1>404 Not Found</h1><p>%s|custom-page-sim|%d|",
+		constants.ERR_CODE_TUNNEL_NOT_FOUND,
+		time.Now().Year(),
+	)
+	requestId, found := strings.CutPrefix(string(body), expectedPrefix)
+	if resp.StatusCode != http.StatusNotFound || !found || requestId == "</p>" {
+		t.Errorf("%v: resp = (%v, %v); want (%v, %v<request id></p>)", "verifyCustomErrorPageRendered", resp.StatusCode, string(body), http.StatusNotFound, expectedPrefix)
+	}
+}
+
+// Test to verify the limits and reserved subdomains set in the config file are applied,
+// and reloaded on SIGHUP without dropping existing tunnels
+func verifyConfigReloadedOnSighup(t *testing.T, wg *sync.WaitGroup, configServer *os.Process) {
+	defer wg.Done()
+
+	createTunnel := func(subdomain string) (net.Conn, uint8) {
+		conn, _, msgType, _, err := requestRawTunnelOn(CONFIG_SERVER_TCP_PORT, protocol.CREATE_TUNNEL, protocol.TunnelRequest{Subdomain: subdomain})
+		if err != nil {
+			t.Errorf("%v: Failed to create tunnel %v", "verifyConfigReloadedOnSighup", err)
+			return nil, 0
+		}
+		return conn, msgType
+	}
+	// Keep created tunnels open until the end, so they count towards the limit
+	openConns := []net.Conn{}
+	defer func() {
+		for _, conn := range openConns {
+			conn.Close()
+		}
+	}()
+	expectTunnel := func(subdomain string, expectedMsgType uint8, when string) {
+		conn, msgType := createTunnel(subdomain)
+		if conn == nil {
+			return
+		}
+		if msgType != expectedMsgType {
+			t.Errorf("%v: %v %v tunnel = %v; want %v", "verifyConfigReloadedOnSighup", when, subdomain, msgType, expectedMsgType)
+		}
+		if msgType != protocol.TUNNEL_CREATED {
+			conn.Close()
+			return
+		}
+		openConns = append(openConns, conn)
+	}
+
+	expectTunnel("reserved-sim", protocol.INVALID_SUBDOMAIN_NAME, "before reload")
+	expectTunnel("config-sim", protocol.TUNNEL_CREATED, "before reload")
+	expectTunnel("config-sim-2", protocol.CLIENT_TUNNEL_LIMIT, "before reload")
+
+	if err := writeServerConfig(2, []string{}); err != nil {
+		t.Errorf("%v: Failed to write config %v", "verifyConfigReloadedOnSighup", err)
+		return
+	}
+	if err := configServer.Signal(syscall.SIGHUP); err != nil {
+		t.Errorf("%v: Failed to send SIGHUP %v", "verifyConfigReloadedOnSighup", err)
+		return
+	}
+	wait := time.NewTimer(500 * time.Millisecond)
+	<-wait.C
+
+	// The tunnel created before the reload still counts towards the new limit
+	expectTunnel("reserved-sim", protocol.TUNNEL_CREATED, "after reload")
+	expectTunnel("config-sim-3", protocol.CLIENT_TUNNEL_LIMIT, "after reload")
+}
+
+// Test to verify mmar client refuses to connect to a mmar server whose TLS certificate
+// does not match the pinned public key
+func verifyTlsPinMismatchRejected(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	wrongPin := "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	output := runMmarClientUntilExit(
+		"--tunnel-tcp-port", TLS_SERVER_TCP_PORT,
+		"--tunnel-http-port", TLS_SERVER_HTTP_PORT,
+		"--tls-ca", TLS_CERT_FILE,
+		"--tls-pin", wrongPin,
+	)
+	if !strings.Contains(output, constants.TLS_PIN_MISMATCH_ERR_TEXT) {
+		t.Errorf("%v: output = %v; want it to contain %v", "verifyTlsPinMismatchRejected", output, constants.TLS_PIN_MISMATCH_ERR_TEXT)
+	}
+}
+
+// Test to verify mmar server rejects a second tunnel for a client certificate identity
+// that is only allowed a single tunnel
+func verifyClientCertIdentityLimitEnforced(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	output := runMmarClientUntilExit(
+		"--tunnel-tcp-port", MTLS_SERVER_TCP_PORT,
+		"--tunnel-http-port", MTLS_SERVER_HTTP_PORT,
+		"--tls-ca", TLS_CERT_FILE,
+		"--tls-client-cert", MTLS_CLIENT_CERT_FILE,
+		"--tls-client-key", MTLS_CLIENT_KEY_FILE,
+	)
+	if !strings.Contains(output, constants.AUTH_TOKEN_LIMIT_EXCEEDED_ERR_TEXT) {
+		t.Errorf("%v: output = %v; want it to contain %v", "verifyClientCertIdentityLimitEnforced", output, constants.AUTH_TOKEN_LIMIT_EXCEEDED_ERR_TEXT)
+	}
+}
+
+// Test to verify mmar server rejects tunnels for client certificates issued by the
+// trusted CA that do not map to any identity
+func verifyUnknownClientCertRejected(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	output := runMmarClientUntilExit(
+		"--tunnel-tcp-port", MTLS_SERVER_TCP_PORT,
+		"--tunnel-http-port", MTLS_SERVER_HTTP_PORT,
+		"--tls-ca", TLS_CERT_FILE,
+		"--tls-client-cert", MTLS_UNKNOWN_CLIENT_CERT,
+		"--tls-client-key", MTLS_UNKNOWN_CLIENT_KEY,
+	)
+	if !strings.Contains(output, constants.CLIENT_CERT_INVALID_ERR_TEXT) {
+		t.Errorf("%v: output = %v; want it to contain %v", "verifyUnknownClientCertRejected", output, constants.CLIENT_CERT_INVALID_ERR_TEXT)
+	}
+}
+
+// Test to verify mmar server requiring client certificates closes connections
+// that do not present one
+func verifyMissingClientCertRejected(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	caData, err := os.ReadFile(TLS_CERT_FILE)
+	if err != nil {
+		t.Errorf("%v: failed to read CA: %v", "verifyMissingClientCertRejected", err)
+		return
+	}
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(caData)
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort("localhost", MTLS_SERVER_TCP_PORT), &tls.Config{RootCAs: rootCAs})
+	if err != nil {
+		// Rejected during the handshake
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	hello, _ := protocol.Hello{
+		Versions: []int{constants.TUNNEL_MESSAGE_PROTOCOL_VERSION},
+		Features: []string{},
+	}.MsgData()
+	writeTunnelMessage(conn, constants.HELLO_MESSAGE_PROTOCOL_VERSION, protocol.HELLO, hello)
+
+	if _, msgType, _, err := readTunnelMessage(bufio.NewReader(conn)); err == nil {
+		t.Errorf("%v: got message type %v; want connection to be rejected", "verifyMissingClientCertRejected", msgType)
+	}
+}
+
+// Test to verify admins can manage API keys, reserved subdomains and tunnels through the
+// admin API, with changes to API keys persisted to the API keys file
+func verifyAdminApiManagesTunnelsAndKeys(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+	testName := "verifyAdminApiManagesTunnelsAndKeys"
+
+	// Start a mmar client authenticated with the API key, until it is closed by an admin
+	// once the rest of the simulation is done
+	clientOutputCh := make(chan string, 1)
+	go func() {
+		clientOutputCh <- runMmarClientUntilExitWithin(
+			time.Minute,
+			"--tunnel-tcp-port", ADMIN_SERVER_TCP_PORT,
+			"--tunnel-http-port", ADMIN_SERVER_HTTP_PORT,
+			"--api-key", ADMIN_CLIENT_API_KEY,
+		)
+	}()
+
+	var tunnels statsResponse
+	if !waitUntil(5*time.Second, func() bool {
+		_, err := adminRequest("GET", "/admin/tunnels", nil, &tunnels)
+		return err == nil && tunnels.ConnectedClientsCount == 1
+	}) {
+		t.Errorf("%v: tunnels = %v; want the tunnel of the mmar client", testName, tunnels.ConnectedClients)
+		return
+	}
+	tunnelId := tunnels.ConnectedClients[0]["id"].(string)
+
+	var tunnel map[string]any
+	if status, err := adminRequest("GET", "/admin/tunnels/"+tunnelId, nil, &tunnel); err != nil || status != http.StatusOK {
+		t.Errorf("%v: inspecting tunnel = %v, %v; want %v", testName, status, err, http.StatusOK)
+	} else if features, _ := tunnel["features"].([]any); !slices.Contains(features, any(constants.FEATURE_TUNNEL_CLOSED)) {
+		t.Errorf("%v: tunnel features = %v; want them to include %v", testName, features, constants.FEATURE_TUNNEL_CLOSED)
+	}
+	if status, _ := adminRequest("GET", "/admin/tunnels/unknown-tunnel", nil, nil); status != http.StatusNotFound {
+		t.Errorf("%v: inspecting unknown tunnel = %v; want %v", testName, status, http.StatusNotFound)
+	}
+
+	// The main mmar server falls back to the default credentials, which cannot change anything
+	if status, _ := adminRequestOn(constants.SERVER_HTTP_PORT, "GET", "/admin/tunnels", nil, nil); status != http.StatusOK {
+		t.Errorf("%v: listing tunnels with default credentials = %v; want %v", testName, status, http.StatusOK)
+	}
+	if status, _ := adminRequestOn(constants.SERVER_HTTP_PORT, "PUT", "/admin/reservations/default-credentials", nil, nil); status != http.StatusForbidden {
+		t.Errorf("%v: reserving with default credentials = %v; want %v", testName, status, http.StatusForbidden)
+	}
+
+	// Raise the limit of the API key, and add a generated one
+	if status, _ := adminRequest("PATCH", "/admin/keys/"+ADMIN_CLIENT_API_KEY, map[string]int{"limit": 3}, nil); status != http.StatusNotFound {
+		t.Errorf("%v: changing key limit by the key itself = %v; want %v", testName, status, http.StatusNotFound)
+	}
+	var key map[string]any
+	if status, err := adminRequest("PATCH", "/admin/keys/"+auth.Fingerprint(ADMIN_CLIENT_API_KEY), map[string]int{"limit": 3}, &key); err != nil || status != http.StatusOK {
+		t.Errorf("%v: changing key limit = %v, %v; want %v", testName, status, err, http.StatusOK)
+	} else if key["limit"] != float64(3) || key["tunnels"] != float64(1) {
+		t.Errorf("%v: changed key = %v; want a limit of 3 with 1 tunnel", testName, key)
+	}
+	var generatedKey map[string]any
+	if status, err := adminRequest("POST", "/admin/keys", map[string]int{"limit": 2}, &generatedKey); err != nil || status != http.StatusCreated {
+		t.Errorf("%v: adding key = %v, %v; want %v", testName, status, err, http.StatusCreated)
+		return
+	}
+	if status, _ := adminRequest("POST", "/admin/keys", map[string]any{"key": ADMIN_CLIENT_API_KEY, "limit": 1}, nil); status != http.StatusConflict {
+		t.Errorf("%v: adding existing key = %v; want %v", testName, status, http.StatusConflict)
+	}
+
+	var keysConfig []map[string]any
+	keysFile, _ := os.ReadFile(ADMIN_API_KEYS_FILE)
+	json.Unmarshal(keysFile, &keysConfig)
+	expectedKeys := []map[string]any{
+		{"key": ADMIN_CLIENT_API_KEY, "limit": float64(3)},
+		{"key": generatedKey["key"], "limit": float64(2)},
+	}
+	for _, expectedKey := range expectedKeys {
+		if !slices.ContainsFunc(keysConfig, func(k map[string]any) bool {
+			return k["key"] == expectedKey["key"] && k["limit"] == expectedKey["limit"]
+		}) {
+			t.Errorf("%v: API keys file = %s; want it to contain %v", testName, keysFile, expectedKey)
+		}
+	}
+
+	// Reserved subdomains cannot be used by mmar clients until released
+	reservedSubdomain := "admin-sim-reserved"
+	if status, _ := adminRequest("PUT", "/admin/reservations/"+reservedSubdomain, map[string]string{"note": "simulations"}, nil); status != http.StatusCreated {
+		t.Errorf("%v: reserving subdomain = %v; want %v", testName, status, http.StatusCreated)
+	}
+	output := runMmarClientUntilExit(
+		"--tunnel-tcp-port", ADMIN_SERVER_TCP_PORT,
+		"--tunnel-http-port", ADMIN_SERVER_HTTP_PORT,
+		"--api-key", generatedKey["key"].(string),
+		"--custom-name", reservedSubdomain,
+	)
+	if !strings.Contains(output, constants.INVALID_SUBDOMAIN_NAME_ERR_TEXT) {
+		t.Errorf("%v: output = %v; want it to contain %v", testName, output, constants.INVALID_SUBDOMAIN_NAME_ERR_TEXT)
+	}
+	if status, _ := adminRequest("DELETE", "/admin/reservations/"+reservedSubdomain, nil, nil); status != http.StatusNoContent {
+		t.Errorf("%v: releasing subdomain = %v; want %v", testName, status, http.StatusNoContent)
+	}
+	if status, _ := adminRequest("DELETE", "/admin/reservations/"+reservedSubdomain, nil, nil); status != http.StatusNotFound {
+		t.Errorf("%v: releasing subdomain again = %v; want %v", testName, status, http.StatusNotFound)
+	}
+
+	// Revoking a key removes it from the API keys file
+	if status, _ := adminRequest("DELETE", "/admin/keys/"+generatedKey["id"].(string), nil, nil); status != http.StatusNoContent {
+		t.Errorf("%v: revoking key = %v; want %v", testName, status, http.StatusNoContent)
+	}
+	keysFile, _ = os.ReadFile(ADMIN_API_KEYS_FILE)
+	if strings.Contains(string(keysFile), generatedKey["key"].(string)) {
+		t.Errorf("%v: API keys file = %s; want the revoked key removed", testName, keysFile)
+	}
+
+	// Force-closing the tunnel lets the mmar client know why, so it exits
+	closeReason := "closed for simulations"
+	if status, _ := adminRequest("DELETE", "/admin/tunnels/"+tunnelId+"?reason="+url.QueryEscape(closeReason), nil, nil); status != http.StatusNoContent {
+		t.Errorf("%v: closing tunnel = %v; want %v", testName, status, http.StatusNoContent)
+	}
+	select {
+	case output := <-clientOutputCh:
+		if !strings.Contains(output, closeReason) {
+			t.Errorf("%v: output = %v; want it to contain %v", testName, output, closeReason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("%v: mmar client did not exit once its tunnel was closed", testName)
+	}
+	if _, err := adminRequest("GET", "/admin/tunnels", nil, &tunnels); err != nil || tunnels.ConnectedClientsCount != 0 {
+		t.Errorf("%v: tunnels = %v, %v; want none once closed", testName, tunnels.ConnectedClients, err)
+	}
+}
+
+// Test to verify the mmar admin command manages API keys through the admin API, printing
+// them as tables or JSON
+func verifyAdminCliManagesKeys(t *testing.T, wg *sync.WaitGroup) {
+	defer wg.Done()
+	testName := "verifyAdminCliManagesKeys"
+
+	output, err := runMmarAdmin("keys", "add", "--limit", "3", "--output", "json")
+	if err != nil {
+		t.Errorf("%v: adding key failed: %v, %v", testName, err, output)
+		return
+	}
+	var added map[string]any
+	if err := json.Unmarshal([]byte(output), &added); err != nil || added["limit"] != float64(3) {
+		t.Errorf("%v: added key = %v, %v; want a key with a limit of 3", testName, output, err)
+		return
+	}
+	keyId := added["id"].(string)
+
+	output, err = runMmarAdmin("keys", "ls")
+	if err != nil || !strings.Contains(output, "LIMIT") || !strings.Contains(output, keyId) {
+		t.Errorf("%v: keys table = %v, %v; want it to list key %v", testName, output, err, keyId)
+	}
+
+	output, err = runMmarAdmin("keys", "limit", keyId, "--limit", "5")
+	if err != nil || !strings.Contains(output, "changed to 5") {
+		t.Errorf("%v: changing key limit = %v, %v; want it changed to 5", testName, output, err)
+	}
+
+	if output, err = runMmarAdmin("keys", "revoke", keyId); err != nil {
+		t.Errorf("%v: revoking key failed: %v, %v", testName, err, output)
+	}
+	if output, _ = runMmarAdmin("keys", "ls"); strings.Contains(output, keyId) {
+		t.Errorf("%v: keys table = %v; want key %v revoked", testName, output, keyId)
+	}
+
+	// Errors of the admin API are reported, exiting unsuccessfully
+	output, err = runMmarAdmin("tunnels", "kill", "unknown-tunnel")
+	if err == nil || !strings.Contains(output, "tunnel not found") {
+		t.Errorf("%v: killing unknown tunnel = %v, %v; want it to fail with tunnel not found", testName, output, err)
+	}
+	output, err = runMmarAdmin("tunnels", "ls", "--output", "json")
+	if err != nil || !json.Valid([]byte(output)) {
+		t.Errorf("%v: tunnels = %v, %v; want them as JSON", testName, output, err)
+	}
+}
+
+// Test to verify tunnels being created, reclaimed and closed concurrently while requests
+// are tunneled and stats are listed leave mmar server consistent
+func verifyConcurrentTunnelChurnHandled(t *testing.T) {
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+
+	// Keep reading the tunnels through stats, metrics and requests to them until done
+	client := httpClient()
+	client.Timeout = 2 * time.Second
+	for reader := range STRESS_WORKERS / 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				serverStatsOn(STRESS_SERVER_HTTP_PORT, "")
+				serverMetricsOn(STRESS_SERVER_HTTP_PORT)
+				subdomain := fmt.Sprintf("stress-%d-%d", reader, i%STRESS_ITERATIONS)
+				if resp, err := client.Get("http://" + subdomain + ".localhost:" + STRESS_SERVER_HTTP_PORT); err == nil {
+					resp.Body.Close()
+				}
+			}
+		}()
+	}
+
+	var workers sync.WaitGroup
+	for worker := range STRESS_WORKERS {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range STRESS_ITERATIONS {
+				subdomain := fmt.Sprintf("stress-%d-%d", worker, i)
+				conn, _, msgType, msgData, err := requestRawTunnelOn(STRESS_SERVER_TCP_PORT, protocol.CREATE_TUNNEL, protocol.TunnelRequest{Subdomain: subdomain})
+				if err != nil || msgType != protocol.TUNNEL_CREATED {
+					t.Errorf("%v: create tunnel %v = (%v, %v); want (%v, nil)", "verifyConcurrentTunnelChurnHandled", subdomain, msgType, err, protocol.TUNNEL_CREATED)
+					if conn != nil {
+						conn.Close()
+					}
+					return
+				}
+
+				// Every other tunnel drops its connection and reclaims its subdomain right away,
+				// racing mmar server noticing it dropped
+				if i%2 == 0 {
+					created, _ := protocol.ParseTunnelCreated(msgData)
+					conn.Close()
+					conn, _, msgType, _, err = requestRawTunnelOn(STRESS_SERVER_TCP_PORT, protocol.RECLAIM_TUNNEL, protocol.TunnelRequest{Subdomain: subdomain, ResumeToken: created.ResumeToken})
+					if err != nil || msgType != protocol.TUNNEL_CREATED {
+						// Rejected since the dropped tunnel was not closed yet
+						if conn != nil {
+							conn.Close()
+						}
+						continue
+					}
+				}
+				writeTunnelMessage(conn, constants.TUNNEL_MESSAGE_PROTOCOL_VERSION, protocol.CLIENT_DISCONNECT, nil)
+				conn.Close()
+			}
+		}()
+	}
+	workers.Wait()
+	close(done)
+	readers.Wait()
+
+	// Once all tunnels are closed, none are left behind
+	var stats statsResponse
+	var err error
+	for range 10 {
+		stats, err = serverStatsOn(STRESS_SERVER_HTTP_PORT, "")
+		if err == nil && stats.ConnectedClientsCount == 0 {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if err != nil || stats.ConnectedClientsCount != 0 {
+		t.Errorf("%v: connected clients = (%v, %v); want (0, nil)", "verifyConcurrentTunnelChurnHandled", stats.ConnectedClientsCount, err)
+	}
+
+	// Tunnels are counted per IP correctly, so all of them can be created again at once
+	conns := []net.Conn{}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for range STRESS_MAX_TUNNELS_PER_IP {
+		conn, _, msgType, _, err := requestRawTunnelOn(STRESS_SERVER_TCP_PORT, protocol.CREATE_TUNNEL, protocol.TunnelRequest{})
+		if conn != nil {
+			conns = append(conns, conn)
+		}
+		if err != nil || msgType != protocol.TUNNEL_CREATED {
+			t.Errorf("%v: create tunnel %v = (%v, %v); want (%v, nil)", "verifyConcurrentTunnelChurnHandled", len(conns), msgType, err, protocol.TUNNEL_CREATED)
+			return
+		}
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	simulationCtx, simulationCancel := context.WithCancel(context.Background())
+
+	// Start a local dev server with http
+	localDevServer := StartLocalDevServer("http", "localhost")
+	defer localDevServer.Close()
+
+	// Start a local dev server with https
+	localDevTLSServer := StartLocalDevServer("https", "example.com")
+	defer localDevTLSServer.Close()
+
+	// Write cert to file so we are able to pass it into mmar client
+	certErr := os.WriteFile("./temp-cert", localDevTLSServer.Certificate().Raw, 0644) // 0644 is file permissions
+	if certErr != nil {
+		log.Fatal(certErr)
+	}
+
+	startDnsServer()
+
+	go StartMmarServer(
+		simulationCtx,
+		"--reclaim-grace-period", strconv.Itoa(RECLAIM_GRACE_PERIOD),
+		"--dest-request-timeout", strconv.Itoa(DEST_REQUEST_TIMEOUT),
+		"--max-udp-sessions", strconv.Itoa(MAX_UDP_SESSIONS),
+		"--max-tunnels-per-ip", strconv.Itoa(MAX_TUNNELS_PER_IP),
+	)
+
+	// Start another mmar server accepting mmar clients over TLS only, with a self-signed certificate
+	tlsPin, tlsCertErr := writeSelfSignedCert(TLS_CERT_FILE, TLS_KEY_FILE)
+	if tlsCertErr != nil {
+		log.Fatal(tlsCertErr)
+	}
+	if err := writeErrorPages(); err != nil {
+		log.Fatal(err)
+	}
+	go StartMmarServer(
+		simulationCtx,
+		"--http-port", TLS_SERVER_HTTP_PORT,
+		"--tcp-port", TLS_SERVER_TCP_PORT,
+		"--tls-cert", TLS_CERT_FILE,
+		"--tls-key", TLS_KEY_FILE,
+		"--error-pages-dir", ERROR_PAGES_DIR,
+	)
+
+	// Start another mmar server requiring client certificates issued by the same CA,
+	// allowing a single tunnel for the identity of the client certificate
+	for _, clientCert := range [][]string{
+		{MTLS_CLIENT_CERT_FILE, MTLS_CLIENT_KEY_FILE, MTLS_CLIENT_IDENTITY},
+		{MTLS_UNKNOWN_CLIENT_CERT, MTLS_UNKNOWN_CLIENT_KEY, "unknown-client"},
+	} {
+		if err := writeClientCert(clientCert[0], clientCert[1], clientCert[2], TLS_CERT_FILE, TLS_KEY_FILE); err != nil {
+			log.Fatal(err)
+		}
+	}
+	apiKeys := fmt.Sprintf(`[{"identity": "%s", "limit": 1}]`, MTLS_CLIENT_IDENTITY)
+	if err := os.WriteFile(MTLS_API_KEYS_FILE, []byte(apiKeys), 0644); err != nil {
+		log.Fatal(err)
+	}
+	go StartMmarServer(
+		simulationCtx,
+		"--http-port", MTLS_SERVER_HTTP_PORT,
+		"--tcp-port", MTLS_SERVER_TCP_PORT,
+		"--tls-cert", TLS_CERT_FILE,
+		"--tls-key", TLS_KEY_FILE,
+		"--tls-client-ca", TLS_CERT_FILE,
+		"--tls-require-client-cert",
+		"--api-keys-file", MTLS_API_KEYS_FILE,
+	)
+
+	// Start another mmar server configured through a config file, limiting tunnels per IP
+	// to one and reserving a subdomain
+	if err := writeServerConfig(1, []string{"reserved-sim"}); err != nil {
+		log.Fatal(err)
+	}
+	configServer := mmarServerCmd(simulationCtx, "--config", SERVER_CONFIG_FILE)
+	if err := configServer.Start(); err != nil {
+		log.Fatal(err)
+	}
+	go configServer.Wait()
+
+	// Start another mmar server managed through the admin API, with its own API keys file
+	// since it is changed by the admin API, and credentials configured to allow changes
+	adminApiKeys := fmt.Sprintf(`[{"key": "%s", "limit": 1}]`, ADMIN_CLIENT_API_KEY)
+	if err := os.WriteFile(ADMIN_API_KEYS_FILE, []byte(adminApiKeys), 0644); err != nil {
+		log.Fatal(err)
+	}
+	adminServer := mmarServerCmd(
+		simulationCtx,
+		"--http-port", ADMIN_SERVER_HTTP_PORT,
+		"--tcp-port", ADMIN_SERVER_TCP_PORT,
+		"--api-keys-file", ADMIN_API_KEYS_FILE,
+	)
+	adminServer.Env = append(
+		os.Environ(),
+		credentialsEnv(constants.SERVER_STATS_DEFAULT_USERNAME, constants.SERVER_STATS_DEFAULT_PASSWORD)...,
+	)
+	if err := adminServer.Start(); err != nil {
+		log.Fatal(err)
+	}
+	go adminServer.Wait()
+
+	wait := time.NewTimer(2 * time.Second)
+	<-wait.C
+
+	// Start a basic mmar client
+	basicClientUrlCh := make(chan string)
+	go StartMmarClient(simulationCtx, basicClientUrlCh, localDevServer.Port(), "", "", "", "", "")
+
+	// Start another basic mmar client
+	basicClientUrlCh2 := make(chan string)
+	go StartMmarClient(simulationCtx, basicClientUrlCh2, localDevServer.Port(), "", "", "", "", "")
+
+	// Wait for all tunnel urls
+	mmarClientsCount := 2
+	tunnelUrls := []string{}
+	for range mmarClientsCount {
+		select {
+		case tunnelUrl := <-basicClientUrlCh:
+			tunnelUrls = append(tunnelUrls, tunnelUrl)
+		case tunnelUrl := <-basicClientUrlCh2:
+			tunnelUrls = append(tunnelUrls, tunnelUrl)
+		}
+	}
+
+	// Initialize http client
+	client := httpClient()
+
+	var wg sync.WaitGroup
+
+	simulationTests := []func(t *testing.T, client *http.Client, tunnelUrl string, wg *sync.WaitGroup){
+		// Perform simulated usage tests
+		verifyGetRequestSuccess,
+		verifyGetRequestFail,
+		verifyPostRequestSuccess,
+		verifyPostRequestFail,
+		verifyRedirectsHandled,
+
+		// Perform Invalid HTTP requests to test durability of mmar
+		verifyInvalidMethodRequestHandled,
+		verifyRequestWithLargeBody,
+		verifyConcurrentLargeBodiesIntact,
+		verifyChunkedRequestBody,
+		verifyStreamedResponseBody,
+		verifyServerSentEventsFlushed,
+		verifyUnreadResponseDoesNotBlockTunnel,
+
+		// Perform edge case usage tests
+		verifyRequestWithVeryLargeBody,
+		verifyDevServerReturningInvalidRespHandled,
+		verifyDevServerLongRunningReqHandledGradefully,
+		verifyDevServerCrashHandledGracefully,
+	}
+
+	// Tests that require more control hence don't use the built in go http.client
+	manualClientSimulationTests := []func(t *testing.T, tunnelUrl string, wg *sync.WaitGroup){
+		// Perform Invalid HTTP requests to test durability of mmar
+		verifyInvalidHeadersRequestHandled,
 		verifyInvalidHttpVersionRequestHandled,
 		verifyInvalidContentLengthRequestHandled,
 		verifyMismatchedContentLengthRequestHandled,
 		verifyContentLengthWithNoBodyRequestHandled,
+
+		// Perform tests on connections switching protocols
+		verifyUpgradedConnectionStreams,
+	}
+
+	// Start a local TCP echo server, exposed through a TCP tunnel
+	localEchoServer := devserver.NewEchoServer()
+	defer localEchoServer.Close()
+
+	tcpClientUrlCh := make(chan string)
+	go StartMmarClient(simulationCtx, tcpClientUrlCh, localEchoServer.Port(), "", "", "", "", constants.TUNNEL_TYPE_TCP)
+	tcpTunnelUrl := <-tcpClientUrlCh
+
+	// Tests that run against TCP tunnels
+	tcpTunnelSimulationTests := []func(t *testing.T, tunnelUrl string, wg *sync.WaitGroup){
+		verifyTcpTunnelStreams,
+		verifyTcpTunnelStreams,
+		verifyTcpTunnelRejectsHttpRequests,
+	}
+
+	// Start a local UDP echo server, exposed through a UDP tunnel
+	localUdpEchoServer := devserver.NewUdpEchoServer()
+	defer localUdpEchoServer.Close()
+
+	udpClientUrlCh := make(chan string)
+	go StartMmarClient(simulationCtx, udpClientUrlCh, localUdpEchoServer.Port(), "", "", "", "", constants.TUNNEL_TYPE_UDP)
+	udpTunnelUrl := <-udpClientUrlCh
+
+	// Tests that run against UDP tunnels
+	udpTunnelSimulationTests := []func(t *testing.T, tunnelUrl string, wg *sync.WaitGroup){
+		verifyUdpTunnelRelaysDatagrams,
+		verifyUdpTunnelRelaysDatagrams,
 	}
 
 	// Loop through all tunnel urls and run simulation tests
@@ -859,10 +2410,103 @@ func TestSimulation(t *testing.T) {
 		}
 	}
 
+	for _, tcpTunnelSimTest := range tcpTunnelSimulationTests {
+		wg.Add(1)
+		go tcpTunnelSimTest(t, tcpTunnelUrl, &wg)
+	}
+
+	for _, udpTunnelSimTest := range udpTunnelSimulationTests {
+		wg.Add(1)
+		go udpTunnelSimTest(t, udpTunnelUrl, &wg)
+	}
+
+	// Start a mmar client attaching labels to its tunnel and requesting a lower body size limit
+	limitedClientUrlCh := make(chan string)
+	go StartMmarClient(simulationCtx, limitedClientUrlCh, localDevServer.Port(), "", "", "", "", "",
+		"--labels", LIMITED_CLIENT_LABELS, "--max-request-body-size", strconv.Itoa(LIMITED_CLIENT_MAX_REQ_BODY_SIZE))
+	limitedTunnelUrl := <-limitedClientUrlCh
+
+	// Tests that run against the tunnel created with labels and limits
+	limitedTunnelSimulationTests := []func(t *testing.T, tunnelUrl string, wg *sync.WaitGroup){
+		verifyTunnelRequestInStats,
+		verifyRequestedBodySizeLimitEnforced,
+		verifyMetricsExposed,
+		verifyStatsFilteredAndPaginated,
+	}
+
+	for _, limitedTunnelSimTest := range limitedTunnelSimulationTests {
+		wg.Add(1)
+		go limitedTunnelSimTest(t, limitedTunnelUrl, &wg)
+	}
+
+	// Start a mmar client connecting to the mmar server over TLS, verifying its certificate
+	tlsClientUrlCh := make(chan string)
+	go StartMmarClient(simulationCtx, tlsClientUrlCh, localDevServer.Port(), "", "", "", "", "",
+		"--tunnel-tcp-port", TLS_SERVER_TCP_PORT, "--tunnel-http-port", TLS_SERVER_HTTP_PORT,
+		"--tls-ca", TLS_CERT_FILE, "--tls-pin", tlsPin)
+	tlsTunnelUrl := <-tlsClientUrlCh
+
+	// Requests are tunneled the same way when the tunnel is encrypted
+	tlsTunnelSimulationTests := []func(t *testing.T, client *http.Client, tunnelUrl string, wg *sync.WaitGroup){
+		verifyGetRequestSuccess,
+		verifyPostRequestSuccess,
+		verifyRequestWithLargeBody,
+	}
+
+	for _, tlsTunnelSimTest := range tlsTunnelSimulationTests {
+		wg.Add(1)
+		go tlsTunnelSimTest(t, client, tlsTunnelUrl, &wg)
+	}
+
+	// Start a mmar client authenticating with a client certificate instead of an API key
+	mtlsClientUrlCh := make(chan string)
+	go StartMmarClient(simulationCtx, mtlsClientUrlCh, localDevServer.Port(), "", "", "", "", "",
+		"--tunnel-tcp-port", MTLS_SERVER_TCP_PORT, "--tunnel-http-port", MTLS_SERVER_HTTP_PORT,
+		"--tls-ca", TLS_CERT_FILE, "--tls-client-cert", MTLS_CLIENT_CERT_FILE, "--tls-client-key", MTLS_CLIENT_KEY_FILE)
+	mtlsTunnelUrl := <-mtlsClientUrlCh
+
+	wg.Add(1)
+	go verifyGetRequestSuccess(t, client, mtlsTunnelUrl, &wg)
+
+	// Tests that talk to mmar server directly, simulating mmar clients on other versions
+	protocolSimulationTests := []func(t *testing.T, wg *sync.WaitGroup){
+		verifyLegacyClientServed,
+		verifyUnsupportedProtocolVersionRejected,
+		verifyReclaimRequiresResumeToken,
+		verifyMalformedMessagesRejected,
+		verifyMessagesBeforeTunnelRejected,
+		verifyUdpSessionsCapped,
+		verifyTunnelCreatedIncludesLimits,
+		verifyQueuedRequestReplayedOnReclaim,
+		verifyQueuedRequestsRejected,
+		verifyTunnelErrContentNegotiated,
+		verifyCustomErrorPageRendered,
+		func(t *testing.T, wg *sync.WaitGroup) { verifyConfigReloadedOnSighup(t, wg, configServer.Process) },
+		verifyTlsPinMismatchRejected,
+		verifyClientCertIdentityLimitEnforced,
+		verifyUnknownClientCertRejected,
+		verifyMissingClientCertRejected,
+		verifyAdminApiManagesTunnelsAndKeys,
+		verifyAdminCliManagesKeys,
+	}
+
+	for _, protocolSimTest := range protocolSimulationTests {
+		wg.Add(1)
+		go protocolSimTest(t, &wg)
+	}
+
 	wg.Wait()
 
-	// Delete cert file
-	if rmErr := os.Remove("./temp-cert"); rmErr != nil {
+	// Delete cert files
+	for _, certFile := range []string{
+		"./temp-cert", TLS_CERT_FILE, TLS_KEY_FILE, MTLS_API_KEYS_FILE, SERVER_CONFIG_FILE, ADMIN_API_KEYS_FILE,
+		MTLS_CLIENT_CERT_FILE, MTLS_CLIENT_KEY_FILE, MTLS_UNKNOWN_CLIENT_CERT, MTLS_UNKNOWN_CLIENT_KEY,
+	} {
+		if rmErr := os.Remove(certFile); rmErr != nil {
+			log.Fatal(rmErr)
+		}
+	}
+	if rmErr := os.RemoveAll(ERROR_PAGES_DIR); rmErr != nil {
 		log.Fatal(rmErr)
 	}
 
@@ -872,3 +2516,34 @@ func TestSimulation(t *testing.T) {
 	wait.Reset(6 * time.Second)
 	<-wait.C
 }
+
+// Stress the tunnels of a mmar server of its own, separately from the other simulations
+// since their timings do not hold up under the race detector. Run it with the mmar binary
+// built with the race detector, halting on the first data race found:
+//
+//	go build -race -o ./simulations/mmar ./cmd/mmar
+//	GORACE=halt_on_error=1 go test -race -run TestConcurrentTunnelChurn ./simulations
+func TestConcurrentTunnelChurn(t *testing.T) {
+	simulationCtx, simulationCancel := context.WithCancel(context.Background())
+
+	startDnsServer()
+
+	// Allow enough tunnels per IP for all the tunnels created at once
+	go StartMmarServer(
+		simulationCtx,
+		"--http-port", STRESS_SERVER_HTTP_PORT,
+		"--tcp-port", STRESS_SERVER_TCP_PORT,
+		"--max-tunnels-per-ip", strconv.Itoa(STRESS_MAX_TUNNELS_PER_IP),
+	)
+
+	wait := time.NewTimer(2 * time.Second)
+	<-wait.C
+
+	verifyConcurrentTunnelChurnHandled(t)
+
+	// Stop stress test
+	simulationCancel()
+
+	wait.Reset(6 * time.Second)
+	<-wait.C
+}
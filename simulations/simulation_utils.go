@@ -4,17 +4,37 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/yusuf-musleh/mmar/constants"
+	"github.com/yusuf-musleh/mmar/internal/protocol"
 	"github.com/yusuf-musleh/mmar/simulations/dnsserver"
 )
 
@@ -23,6 +43,96 @@ type receivedRequest struct {
 	body    map[string]interface{}
 }
 
+// Range of public ports the mmar server allocates for TCP/UDP tunnels during simulations
+const (
+	TCP_TUNNEL_PORTS = "20000-20010"
+	UDP_TUNNEL_PORTS = "20000-20010"
+)
+
+// Labels and request body size limit requested by the mmar client of the limited tunnel
+const (
+	LIMITED_CLIENT_LABELS            = "team=simulations,env=test"
+	LIMITED_CLIENT_MAX_REQ_BODY_SIZE = 1000
+)
+
+// Seconds the mmar server reserves subdomains of disconnected tunnels for during simulations,
+// long enough for them not to expire while simulations that reclaim them are still running
+const RECLAIM_GRACE_PERIOD = 10
+
+// Tunnels the mmar server allows from the same IP during simulations, enough for the
+// simulations talking to it directly to all hold a tunnel at the same time
+const MAX_TUNNELS_PER_IP = 10
+
+// UDP sessions each UDP tunnel keeps open at once during simulations, low enough for
+// simulations to reach it
+const MAX_UDP_SESSIONS = 2
+
+// Seconds the mmar server waits on destination servers to respond during simulations,
+// lower than the default so mmar clients are seen applying it
+const DEST_REQUEST_TIMEOUT = 10
+
+// Ports and certificate files of the mmar server accepting mmar clients over TLS
+const (
+	TLS_SERVER_HTTP_PORT = "3377"
+	TLS_SERVER_TCP_PORT  = "6674"
+	TLS_CERT_FILE        = "./temp-tls-cert.pem"
+	TLS_KEY_FILE         = "./temp-tls-key.pem"
+)
+
+// Ports and config file of the mmar server configured through a config file, reloaded
+// while the simulation runs
+const (
+	CONFIG_SERVER_HTTP_PORT = "3379"
+	CONFIG_SERVER_TCP_PORT  = "6676"
+	SERVER_CONFIG_FILE      = "./temp-server-config.json"
+)
+
+// Directory of the custom error pages the mmar server accepting mmar clients over TLS
+// renders, the page for unknown tunnels includes all the variables available
+const (
+	ERROR_PAGES_DIR           = "./temp-error-pages"
+	TUNNEL_NOT_FOUND_PAGE     = "<h1>{{.Status}} {{.StatusText}}</h1><p>{{.Code}}|{{.Subdomain}}|{{.Timestamp.Year}}|{{.RequestId}}</p>"
+	DEFAULT_CUSTOM_ERROR_PAGE = "<h1>{{.Message}}</h1>"
+)
+
+// Ports of the mmar server requiring client certificates issued by the CA of the TLS
+// server's certificate, and the identity it allows to create a single tunnel
+const (
+	MTLS_SERVER_HTTP_PORT    = "3378"
+	MTLS_SERVER_TCP_PORT     = "6675"
+	MTLS_API_KEYS_FILE       = "./temp-api-keys.json"
+	MTLS_CLIENT_IDENTITY     = "simulations-client"
+	MTLS_CLIENT_CERT_FILE    = "./temp-client-cert.pem"
+	MTLS_CLIENT_KEY_FILE     = "./temp-client-key.pem"
+	MTLS_UNKNOWN_CLIENT_CERT = "./temp-unknown-client-cert.pem"
+	MTLS_UNKNOWN_CLIENT_KEY  = "./temp-unknown-client-key.pem"
+)
+
+// Ports and API keys file of the mmar server managed through the admin API, along with
+// the API key its mmar client starts with
+const (
+	ADMIN_SERVER_HTTP_PORT = "3380"
+	ADMIN_SERVER_TCP_PORT  = "6677"
+	ADMIN_API_KEYS_FILE    = "./temp-admin-api-keys.json"
+	ADMIN_CLIENT_API_KEY   = "admin-simulations-key"
+)
+
+// Ports of the mmar server tunnels are created and closed on concurrently, allowing enough
+// tunnels per IP for all of them, along with how many workers do so and how many times
+const (
+	STRESS_SERVER_HTTP_PORT   = "3381"
+	STRESS_SERVER_TCP_PORT    = "6678"
+	STRESS_MAX_TUNNELS_PER_IP = 100
+	STRESS_WORKERS            = 20
+	STRESS_ITERATIONS         = 10
+)
+
+// Ports of the mmar server requests are tunneled through in benchmarks
+const (
+	BENCH_SERVER_HTTP_PORT = "3382"
+	BENCH_SERVER_TCP_PORT  = "6679"
+)
+
 type expectedResponse struct {
 	statusCode int
 	headers    map[string]string
@@ -45,16 +155,16 @@ func validateRequestResponse(t *testing.T, expectedResp expectedResponse, resp *
 	}
 
 	// Verify correct body returned
+	body, readErr := io.ReadAll(resp.Body)
+	if readErr != nil {
+		t.Error("Failed to read response body", readErr)
+		return
+	}
+
 	var respBody interface{}
-	jsonDecoder := json.NewDecoder(resp.Body)
-	err := jsonDecoder.Decode(&respBody)
+	err := json.Unmarshal(body, &respBody)
 	if err != nil {
-		jsonDecoderBuffered := jsonDecoder.Buffered()
-		nonJsonBody, nonJsonBodyErr := io.ReadAll(jsonDecoderBuffered)
-		if nonJsonBodyErr != nil {
-			t.Error("Failed to read response body", err)
-			return
-		}
+		nonJsonBody := body
 
 		// Handle case when body is not JSON
 		if string(nonJsonBody) != string(expectedResp.textBody) {
@@ -71,8 +181,74 @@ func validateRequestResponse(t *testing.T, expectedResp expectedResponse, resp *
 	}
 }
 
+// Validate a plain text tunnel error response, its request ID differs across requests
+// so it is only checked to be present
+func validateTunnelErrResponse(t *testing.T, resp *http.Response, statusCode int, code string, message string, testName string) {
+	if resp.StatusCode != statusCode {
+		t.Errorf("%v: resp.statusCode = %v; want %v", testName, resp.StatusCode, statusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/plain; charset=utf-8" {
+		t.Errorf("%v: resp.headers[Content-Type] = %v; want %v", testName, contentType, "text/plain; charset=utf-8")
+	}
+
+	body, readErr := io.ReadAll(resp.Body)
+	if readErr != nil {
+		t.Error("Failed to read response body", readErr)
+		return
+	}
+
+	if resp.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Errorf("%v: resp.headers[Content-Length] = %v; want %v", testName, resp.Header.Get("Content-Length"), len(body))
+	}
+
+	expectedPrefix := fmt.Sprintf("%s\n\nError code: %s\nRequest ID: ", message, code)
+	requestId, found := strings.CutPrefix(string(body), expectedPrefix)
+	if !found || strings.TrimSpace(requestId) == "" {
+		t.Errorf("%v: body = %v; want %v<request id>", testName, string(body), expectedPrefix)
+	}
+}
+
+// Write the custom error page templates to the error pages directory
+func writeErrorPages() error {
+	if err := os.MkdirAll(ERROR_PAGES_DIR, 0755); err != nil {
+		return err
+	}
+	for name, page := range map[string]string{
+		constants.ERR_CODE_TUNNEL_NOT_FOUND + ".html": TUNNEL_NOT_FOUND_PAGE,
+		constants.DEFAULT_ERROR_PAGE:                  DEFAULT_CUSTOM_ERROR_PAGE,
+	} {
+		if err := os.WriteFile(filepath.Join(ERROR_PAGES_DIR, name), []byte(page), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the config file of the mmar server configured through it, allowing the number
+// of tunnels per IP and reserving the subdomains
+func writeServerConfig(maxTunnelsPerIP int, reservedSubdomains []string) error {
+	config := map[string]interface{}{
+		"httpPort":           CONFIG_SERVER_HTTP_PORT,
+		"tcpPort":            CONFIG_SERVER_TCP_PORT,
+		"tcpTunnelPorts":     "",
+		"udpTunnelPorts":     "",
+		"reservedSubdomains": reservedSubdomains,
+		"limits":             map[string]int{"maxTunnelsPerIp": maxTunnelsPerIP},
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(SERVER_CONFIG_FILE, data, 0644)
+}
+
+// Start the DNS server resolving subdomains of localhost, once for all simulations
+var startDnsServer = sync.OnceFunc(func() {
+	go dnsserver.StartDnsServer()
+})
+
 func extractTunnelURL(clientStdout string) string {
-	re := regexp.MustCompile(`http:\/\/[a-zA-Z0-9\-]+\.localhost:\d+`)
+	re := regexp.MustCompile(`http:\/\/[a-zA-Z0-9\-]+\.localhost:\d+|(tcp|udp):\/\/localhost:\d+`)
 	return re.FindString(clientStdout)
 }
 
@@ -153,3 +329,338 @@ func manualReadResponse(conn net.Conn) (*http.Response, error) {
 
 	return resp, nil
 }
+
+// Connect directly to the mmar server's TCP port from another loopback address, like a
+// mmar client on another machine would, so the simulation stays within the tunnels per IP limit
+func dialMmarServer() (net.Conn, error) {
+	return dialMmarServerOn(constants.SERVER_TCP_PORT)
+}
+
+func dialMmarServerOn(tcpPort string) (net.Conn, error) {
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}
+	return dialer.Dial("tcp", net.JoinHostPort("127.0.0.1", tcpPort))
+}
+
+// Write a tunnel message directly to the mmar server's TCP port with the given protocol
+// version, to simulate mmar clients running other versions of mmar
+func writeTunnelMessage(conn net.Conn, version uint8, msgType uint8, msgData []byte) error {
+	_, err := fmt.Fprintf(conn, "%c%c%d\n%s", version, msgType, len(msgData), msgData)
+	return err
+}
+
+// Run a mmar client expected to exit on its own, returning its output
+func runMmarClientUntilExit(args ...string) string {
+	return runMmarClientUntilExitWithin(10*time.Second, args...)
+}
+
+// Run a mmar client expected to exit on its own within the timeout, returning its output
+func runMmarClientUntilExitWithin(timeout time.Duration, args ...string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "./mmar", append([]string{"client", "--tunnel-host", "localhost"}, args...)...)
+	output, _ := cmd.CombinedOutput()
+	return string(output)
+}
+
+// Run a mmar admin command against the mmar server managed through the admin API,
+// returning its output along with an error if it exited unsuccessfully
+func runMmarAdmin(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "./mmar", append([]string{"admin", "--tunnel-host", "localhost", "--tunnel-http-port", ADMIN_SERVER_HTTP_PORT}, args...)...)
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+// Read a tunnel message sent by the mmar server, skipping heartbeats
+func readTunnelMessage(reader *bufio.Reader) (uint8, uint8, []byte, error) {
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return 0, 0, nil, err
+		}
+		lengthStr, err := reader.ReadString('\n')
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length, err := strconv.Atoi(lengthStr[:len(lengthStr)-1])
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		msgData := make([]byte, length)
+		if _, err := io.ReadFull(reader, msgData); err != nil {
+			return 0, 0, nil, err
+		}
+		if header[1] != protocol.HEARTBEAT_FROM_SERVER {
+			return header[0], header[1], msgData, nil
+		}
+	}
+}
+
+// Negotiate with the mmar server over a new connection and request to create or reclaim
+// a tunnel, returning the connection and its reader along with the type and data of the
+// response. No features are negotiated, so requests are tunneled in a single message.
+func requestRawTunnel(msgType uint8, tunnelReq protocol.TunnelRequest) (net.Conn, *bufio.Reader, uint8, []byte, error) {
+	return requestRawTunnelOn(constants.SERVER_TCP_PORT, msgType, tunnelReq)
+}
+
+func requestRawTunnelOn(tcpPort string, msgType uint8, tunnelReq protocol.TunnelRequest) (net.Conn, *bufio.Reader, uint8, []byte, error) {
+	conn, err := dialMmarServerOn(tcpPort)
+	if err != nil {
+		return nil, nil, 0, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	reader := bufio.NewReader(conn)
+
+	helloData, _ := protocol.Hello{
+		Versions: []int{constants.TUNNEL_MESSAGE_PROTOCOL_VERSION},
+		Features: []string{},
+	}.MsgData()
+	if err := writeTunnelMessage(conn, constants.HELLO_MESSAGE_PROTOCOL_VERSION, protocol.HELLO, helloData); err != nil {
+		conn.Close()
+		return nil, nil, 0, nil, err
+	}
+	if _, _, _, err := readTunnelMessage(reader); err != nil {
+		conn.Close()
+		return nil, nil, 0, nil, err
+	}
+
+	tunnelReq.Version = constants.TUNNEL_REQUEST_PAYLOAD_VERSION
+	reqData, _ := tunnelReq.MsgData()
+	if err := writeTunnelMessage(conn, constants.TUNNEL_MESSAGE_PROTOCOL_VERSION, msgType, reqData); err != nil {
+		conn.Close()
+		return nil, nil, 0, nil, err
+	}
+	_, respType, respData, err := readTunnelMessage(reader)
+	if err != nil {
+		conn.Close()
+		return nil, nil, 0, nil, err
+	}
+	return conn, reader, respType, respData, nil
+}
+
+// Create a tunnel with the subdomain, then drop its connection without shutting down so
+// the subdomain is reserved, returning the resume token to reclaim it with
+func createAndDropRawTunnel(subdomain string) (string, error) {
+	conn, _, msgType, msgData, err := requestRawTunnel(protocol.CREATE_TUNNEL, protocol.TunnelRequest{Subdomain: subdomain})
+	if err != nil {
+		return "", err
+	}
+	conn.Close()
+	if msgType != protocol.TUNNEL_CREATED {
+		return "", fmt.Errorf("unexpected message type %d", msgType)
+	}
+	created, err := protocol.ParseTunnelCreated(msgData)
+	if err != nil {
+		return "", err
+	}
+	return created.ResumeToken, waitForTunnelDropped(subdomain)
+}
+
+// Poll the condition until it holds or the timeout passes, returning whether it held
+func waitUntil(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// Wait for mmar server to notice the connection of the tunnel dropped, at which point its
+// subdomain is reserved for it to be reclaimed
+func waitForTunnelDropped(subdomain string) error {
+	dropped := waitUntil(5*time.Second, func() bool {
+		stats, err := serverStats("id=" + subdomain)
+		return err == nil && stats.MatchingClientsCount == 0
+	})
+	if !dropped {
+		return fmt.Errorf("tunnel %s is still connected", subdomain)
+	}
+	return nil
+}
+
+// Retrieve the connected clients listed in the mmar server stats
+func connectedClientsStats() ([]map[string]any, error) {
+	stats, err := serverStats("")
+	if err != nil {
+		return nil, err
+	}
+	return stats.ConnectedClients, nil
+}
+
+type statsResponse struct {
+	ConnectedClients      []map[string]any `json:"connectedClients"`
+	ConnectedClientsCount int              `json:"connectedClientsCount"`
+	MatchingClientsCount  int              `json:"matchingClientsCount"`
+}
+
+// Retrieve the mmar server stats, filtered, sorted and paginated by the query string
+func serverStats(query string) (statsResponse, error) {
+	return serverStatsOn(constants.SERVER_HTTP_PORT, query)
+}
+
+func serverStatsOn(httpPort string, query string) (statsResponse, error) {
+	var stats statsResponse
+	req, _ := http.NewRequest("GET", "http://stats.localhost:"+httpPort+"/?"+query, nil)
+	req.SetBasicAuth(constants.SERVER_STATS_DEFAULT_USERNAME, constants.SERVER_STATS_DEFAULT_PASSWORD)
+	statsResp, err := httpClient().Do(req)
+	if err != nil {
+		return stats, err
+	}
+	defer statsResp.Body.Close()
+
+	if statsResp.StatusCode != http.StatusOK {
+		return stats, fmt.Errorf("unexpected status %d", statsResp.StatusCode)
+	}
+	err = json.NewDecoder(statsResp.Body).Decode(&stats)
+	return stats, err
+}
+
+// Retrieve the metrics of the mmar server, in the Prometheus text format
+func serverMetrics() (string, error) {
+	return serverMetricsOn(constants.SERVER_HTTP_PORT)
+}
+
+func serverMetricsOn(httpPort string) (string, error) {
+	req, _ := http.NewRequest("GET", "http://stats.localhost:"+httpPort+"/metrics", nil)
+	req.SetBasicAuth(constants.SERVER_STATS_DEFAULT_USERNAME, constants.SERVER_STATS_DEFAULT_PASSWORD)
+	metricsResp, err := httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer metricsResp.Body.Close()
+
+	if metricsResp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d", metricsResp.StatusCode)
+	}
+	body, err := io.ReadAll(metricsResp.Body)
+	return string(body), err
+}
+
+// Send a request to the admin API of the mmar server managed through it, with the body
+// JSON encoded if provided, decoding the JSON response into result if provided
+func adminRequest(method string, path string, body any, result any) (int, error) {
+	return adminRequestOn(ADMIN_SERVER_HTTP_PORT, method, path, body, result)
+}
+
+func adminRequestOn(httpPort string, method string, path string, body any, result any) (int, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, _ := http.NewRequest(method, "http://stats.localhost:"+httpPort+path, reqBody)
+	req.SetBasicAuth(constants.SERVER_STATS_DEFAULT_USERNAME, constants.SERVER_STATS_DEFAULT_PASSWORD)
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if result != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// Environment variables configuring the Basic Auth credentials of a mmar server explicitly
+func credentialsEnv(username string, password string) []string {
+	usernameHash := sha256.Sum256([]byte(username))
+	passwordHash := sha256.Sum256([]byte(password))
+	return []string{
+		"USERNAME_HASH=" + hex.EncodeToString(usernameHash[:]),
+		"PASSWORD_HASH=" + hex.EncodeToString(passwordHash[:]),
+	}
+}
+
+// Write a self-signed TLS certificate for localhost and its private key to PEM files,
+// returning the pin of its public key. It also serves as the CA of client certificates.
+func writeSelfSignedCert(certPath string, keyPath string) (string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", err
+	}
+	if err := writeCertAndKey(certPath, keyPath, certDer, key); err != nil {
+		return "", err
+	}
+
+	cert, err := x509.ParseCertificate(certDer)
+	if err != nil {
+		return "", err
+	}
+	pin := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(pin[:]), nil
+}
+
+// Write a client certificate with the common name, issued by the CA in the PEM files
+func writeClientCert(certPath string, keyPath string, commonName string, caCertPath string, caKeyPath string) error {
+	ca, err := tls.LoadX509KeyPair(caCertPath, caKeyPath)
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return err
+	}
+	return writeCertAndKey(certPath, keyPath, certDer, key)
+}
+
+func writeCertAndKey(certPath string, keyPath string, certDer []byte, key *ecdsa.PrivateKey) error {
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer})
+	if err := os.WriteFile(certPath, certPem, 0644); err != nil {
+		return err
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	return os.WriteFile(keyPath, keyPem, 0600)
+}